@@ -0,0 +1,137 @@
+package backup
+
+import (
+	"archive/zip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ArchiveReader is an opened archive, plain or encrypted.
+type ArchiveReader struct {
+	*zip.Reader
+	Encrypted bool
+
+	file *os.File
+}
+
+// OpenArchive opens the archive at path. Encrypted archives are decrypted
+// on the fly with passphrase, the plain archive is never written to disk.
+func OpenArchive(path string, passphrase []byte) (*ArchiveReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	a, err := openArchive(f, fi.Size(), passphrase)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func openArchive(f *os.File, size int64, passphrase []byte) (*ArchiveReader, error) {
+	encrypted, err := isEncrypted(f)
+	if err != nil {
+		return nil, err
+	}
+	if !encrypted {
+		zr, err := zip.NewReader(f, size)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read archive")
+		}
+		return &ArchiveReader{Reader: zr, file: f}, nil
+	}
+
+	d, err := newDecryptReaderAt(f, size, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(d, d.Size())
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read decrypted archive")
+	}
+
+	return &ArchiveReader{Reader: zr, Encrypted: true, file: f}, nil
+}
+
+func (a *ArchiveReader) Close() error {
+	return a.file.Close()
+}
+
+const (
+	archivePrefix     = "acc-backup-"
+	archiveExtension  = ".zip"
+	archiveTimeLayout = "2006-01-02_15-04-05"
+	incrementalPrefix = ".inc-"
+)
+
+// archiveName names an archive created at createdAt. Incremental archives
+// carry the creation time of their parent, so chains can be followed
+// without opening the archives.
+func archiveName(createdAt, parent time.Time) string {
+	name := archivePrefix + createdAt.Format(archiveTimeLayout)
+	if !parent.IsZero() {
+		name += incrementalPrefix + parent.Format(archiveTimeLayout)
+	}
+	return name + archiveExtension
+}
+
+// ListArchives returns backup archives found in dir.
+func ListArchives(dir string) ([]Archive, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "could not list backups dir")
+	}
+
+	var archives []Archive
+	for _, e := range entries {
+		a, ok := parseArchiveName(e.Name())
+		if e.IsDir() || !ok {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not stat '%s'", e.Name())
+		}
+		a.Size = fi.Size()
+		archives = append(archives, a)
+	}
+
+	return archives, nil
+}
+
+func parseArchiveName(name string) (Archive, bool) {
+	if !strings.HasPrefix(name, archivePrefix) || !strings.HasSuffix(name, archiveExtension) {
+		return Archive{}, false
+	}
+	ts := strings.TrimSuffix(strings.TrimPrefix(name, archivePrefix), archiveExtension)
+	ts, parentTS, incremental := strings.Cut(ts, incrementalPrefix)
+
+	a := Archive{Name: name}
+	var err error
+	a.CreatedAt, err = time.ParseInLocation(archiveTimeLayout, ts, time.Local)
+	if err != nil {
+		return Archive{}, false
+	}
+	if incremental {
+		a.Parent, err = time.ParseInLocation(archiveTimeLayout, parentTS, time.Local)
+		if err != nil {
+			return Archive{}, false
+		}
+	}
+
+	return a, true
+}
@@ -2,24 +2,184 @@ package backup
 
 import (
 	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 var excludedExtensions = map[string]struct{}{
 	".zip": {},
 }
 
-func Backup(w io.WriteCloser, dir string) error {
+// files SQLite keeps next to the database, all covered by the snapshot
+var databaseSuffixes = []string{"", "-wal", "-shm", "-journal"}
+
+type Database interface {
+	// Snapshot writes a consistent copy of the database to path
+	Snapshot(path string) error
+	SchemaVersion() (uint, error)
+}
+
+type Source struct {
+	// Dir is walked for photos and other files to back up
+	Dir string
+	// Paths limits the walk to these paths relative to Dir, the whole of
+	// Dir is walked when empty. Missing paths are skipped.
+	Paths []string
+	// Include, when not empty, limits backed up files to those matching
+	// one of its patterns, or lying in a directory that does. Files and
+	// directories matching one of Exclude are skipped. Patterns without
+	// a slash match names, others paths relative to Dir, both with
+	// path.Match syntax.
+	Include []string
+	Exclude []string
+	// DBPath is the live database file. It is never copied directly,
+	// a snapshot taken with DB is archived under its base name instead.
+	DBPath string
+	DB     Database
+}
+
+// ValidatePatterns checks the syntax of the include and exclude patterns.
+func (src Source) ValidatePatterns() error {
+	for _, p := range append(slices.Clone(src.Include), src.Exclude...) {
+		_, err := path.Match(p, "")
+		if err != nil {
+			return errors.Wrapf(err, "invalid pattern '%s'", p)
+		}
+	}
+	return nil
+}
+
+// skip reports whether the file or directory at rel, a slash separated
+// path relative to Dir, is left out of the backup.
+func (src Source) skip(rel string, dir bool) bool {
+	if matchAny(src.Exclude, rel) {
+		return true
+	}
+	if dir || len(src.Include) == 0 {
+		return false
+	}
+	for p := rel; p != "."; p = path.Dir(p) {
+		if matchAny(src.Include, p) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		target := rel
+		if !strings.Contains(p, "/") {
+			target = path.Base(rel)
+		}
+		if ok, _ := path.Match(p, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Backup writes a full archive of src to w.
+func Backup(w io.Writer, src Source) error {
+	_, err := backup(w, src, "", Manifest{})
+	return err
+}
+
+// BackupIncremental writes an archive of src to w storing only files
+// changed since the archive named parent, described by its manifest prev.
+func BackupIncremental(w io.Writer, src Source, parent string, prev Manifest) error {
+	_, err := backup(w, src, parent, prev)
+	return err
+}
+
+func backup(w io.Writer, src Source, parent string, prev Manifest) (Manifest, error) {
 	zw := zip.NewWriter(w)
 	defer zw.Close()
 
-	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+	schemaVersion, err := src.DB.SchemaVersion()
+	if err != nil {
+		return Manifest{}, err
+	}
+	m := Manifest{
+		Version:       manifestVersion,
+		CreatedAt:     time.Now(),
+		SchemaVersion: schemaVersion,
+		Database:      filepath.Base(src.DBPath),
+		Parent:        parent,
+	}
+	prevFiles := map[string]ManifestFile{}
+	for _, f := range prev.Files {
+		prevFiles[f.Path] = f
+	}
+
+	tmpDir, err := os.MkdirTemp("", "acc2-snapshot-")
+	if err != nil {
+		return Manifest{}, errors.Wrap(err, "could not create snapshot dir")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	snapshot := filepath.Join(tmpDir, filepath.Base(src.DBPath))
+	err = src.DB.Snapshot(snapshot)
+	if err != nil {
+		return Manifest{}, err
+	}
+	// every snapshot is a new file, so the database is always stored
+	mf, err := addFile(zw, snapshot, m.Database, nil)
+	if err != nil {
+		return Manifest{}, errors.Wrap(err, "could not archive database snapshot")
+	}
+	m.Files = append(m.Files, mf)
+
+	skipped := map[string]struct{}{}
+	dbPath, err := filepath.Abs(src.DBPath)
+	if err != nil {
+		return Manifest{}, err
+	}
+	for _, suffix := range databaseSuffixes {
+		skipped[dbPath+suffix] = struct{}{}
+	}
+
+	err = src.ValidatePatterns()
+	if err != nil {
+		return Manifest{}, err
+	}
+	roots := []string{src.Dir}
+	if len(src.Paths) > 0 {
+		roots = roots[:0]
+		for _, p := range src.Paths {
+			roots = append(roots, filepath.Join(src.Dir, p))
+		}
+	}
+
+	walk := func(path string, entry os.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 
+		name, err := filepath.Rel(src.Dir, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if name == "." {
+			return nil
+		}
+		if src.skip(name, entry.IsDir()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
 		if entry.IsDir() {
 			return nil
 		}
@@ -28,34 +188,81 @@ func Backup(w io.WriteCloser, dir string) error {
 			return nil
 		}
 
-		file, err := entry.Info()
+		abs, err := filepath.Abs(path)
 		if err != nil {
 			return err
 		}
+		if _, ok := skipped[abs]; ok {
+			return nil
+		}
 
-		header, err := zip.FileInfoHeader(file)
+		mf, err := addFile(zw, path, name, prevFiles)
 		if err != nil {
 			return err
 		}
-		header.Name, err = filepath.Rel(dir, path)
-		if err != nil {
-			return err
+		m.Files = append(m.Files, mf)
+		return nil
+	}
+	for _, root := range roots {
+		_, err := os.Lstat(root)
+		if os.IsNotExist(err) {
+			continue
 		}
-
-		writer, err := zw.CreateHeader(header)
+		err = filepath.WalkDir(root, walk)
 		if err != nil {
-			return err
+			return Manifest{}, err
 		}
+	}
 
-		fileReader, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer fileReader.Close()
+	err = writeManifest(zw, m)
+	if err != nil {
+		return Manifest{}, errors.Wrap(err, "could not write manifest")
+	}
 
-		_, err = io.Copy(writer, fileReader)
-		return err
-	})
+	return m, zw.Close()
+}
 
-	return err
+// addFile archives path under name, unless prev shows it is unchanged
+// since the parent archive.
+func addFile(zw *zip.Writer, path, name string, prev map[string]ManifestFile) (ManifestFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return ManifestFile{}, err
+	}
+
+	if p, ok := prev[name]; ok && p.Size == fi.Size() && p.ModTime.Equal(fi.ModTime()) {
+		p.Stored = false
+		return p, nil
+	}
+
+	header, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	header.Name = name
+
+	writer, err := zw.CreateHeader(header)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(writer, hash), file)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+
+	return ManifestFile{
+		Path:    name,
+		Size:    n,
+		ModTime: fi.ModTime(),
+		SHA256:  hex.EncodeToString(hash.Sum(nil)),
+		Stored:  true,
+	}, nil
 }
@@ -0,0 +1,818 @@
+package backup_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matmazurk/acc2/backup"
+	"github.com/matmazurk/acc2/db"
+	"github.com/matmazurk/acc2/s3"
+	"github.com/matmazurk/acc2/s3/s3test"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+// defaultLedger is the ledger the migrations create.
+const defaultLedger = 1
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "exps.db")
+	c, err := db.New(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, c.CreatePayer(defaultLedger, "some payer"))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "photos"), 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "photos", "photo.jpeg"), []byte("photo"), 0o600))
+	require.NoError(t, os.WriteFile(dbPath+"-wal", []byte("wal"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "old.zip"), []byte("old"), 0o600))
+
+	archive := &bytes.Buffer{}
+	err = backup.Backup(archive, backup.Source{Dir: dir, DBPath: dbPath, DB: c})
+	require.NoError(t, err)
+
+	zr, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	require.NoError(t, err)
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	require.ElementsMatch(t, []string{"exps.db", "photos/photo.jpeg", "manifest.json"}, names)
+
+	t.Run("should_archive_usable_database_snapshot", func(t *testing.T) {
+		restored := filepath.Join(t.TempDir(), "exps.db")
+		extract(t, zr, "exps.db", restored)
+
+		rc, err := db.New(restored)
+		require.NoError(t, err)
+		payers, err := rc.ListPayers(defaultLedger)
+		require.NoError(t, err)
+		require.Equal(t, []string{"some payer"}, payers)
+	})
+}
+
+func TestBackupRules(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "exps.db")
+	c, err := db.New(dbPath)
+	require.NoError(t, err)
+	defer c.Close()
+	for name, contents := range map[string]string{
+		"logs":                      "log line",
+		"acc2":                      "binary",
+		"photos/a.jpeg":             "a",
+		"photos/a.jpeg.sha256":      "sum",
+		"photos/.tmp-123":           "partial",
+		"photos/old/b.png":          "b",
+		"quarantine/orphan.jpeg":    "orphan",
+		"notes/receipt.pdf":         "pdf",
+		"notes/tmp/scratch.pdf.tmp": "scratch",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o750))
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	}
+
+	archived := func(t *testing.T, src backup.Source) []string {
+		t.Helper()
+		src.Dir, src.DBPath, src.DB = dir, dbPath, c
+		archive := &bytes.Buffer{}
+		require.NoError(t, backup.Backup(archive, src))
+		zr, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+		require.NoError(t, err)
+		m, err := backup.ReadManifest(zr)
+		require.NoError(t, err)
+		var names []string
+		for _, f := range m.Files {
+			names = append(names, f.Path)
+		}
+		return names
+	}
+
+	t.Run("should_back_up_only_known_paths", func(t *testing.T) {
+		names := archived(t, backup.Source{Paths: []string{"photos", "missing"}})
+		require.ElementsMatch(t, []string{
+			"exps.db", "photos/a.jpeg", "photos/a.jpeg.sha256", "photos/.tmp-123", "photos/old/b.png",
+		}, names)
+	})
+
+	t.Run("should_apply_exclude_rules", func(t *testing.T) {
+		names := archived(t, backup.Source{Exclude: []string{".tmp-*", "*.tmp", "logs", "acc2", "quarantine", "photos/old"}})
+		require.ElementsMatch(t, []string{
+			"exps.db", "photos/a.jpeg", "photos/a.jpeg.sha256", "notes/receipt.pdf",
+		}, names)
+	})
+
+	t.Run("should_apply_include_rules", func(t *testing.T) {
+		names := archived(t, backup.Source{Include: []string{"*.pdf", "photos/old"}, Exclude: []string{"tmp"}})
+		require.ElementsMatch(t, []string{"exps.db", "notes/receipt.pdf", "photos/old/b.png"}, names)
+	})
+
+	t.Run("should_reject_invalid_patterns", func(t *testing.T) {
+		err := backup.Source{Exclude: []string{"[photos"}}.ValidatePatterns()
+		require.ErrorContains(t, err, "[photos")
+	})
+}
+
+func TestSizeReport(t *testing.T) {
+	m := backup.Manifest{Files: []backup.ManifestFile{
+		{Path: "exps.db", Size: 100, Stored: true},
+		{Path: "photos/a.jpeg", Size: 10, Stored: true},
+		{Path: "photos/b.jpeg", Size: 20},
+		{Path: "notes/receipt.pdf", Size: 5, Stored: true},
+	}}
+
+	require.Equal(t, []backup.SizeEntry{
+		{Path: "exps.db", Files: 1, Bytes: 100, StoredFiles: 1, StoredBytes: 100},
+		{Path: "notes", Files: 1, Bytes: 5, StoredFiles: 1, StoredBytes: 5},
+		{Path: "photos", Files: 2, Bytes: 30, StoredFiles: 1, StoredBytes: 10},
+	}, m.SizeReport())
+}
+
+func TestRestore(t *testing.T) {
+	src := t.TempDir()
+	dbPath := filepath.Join(src, "exps.db")
+	c, err := db.New(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, c.CreatePayer(defaultLedger, "some payer"))
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "photos"), 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "photos", "photo.jpeg"), []byte("photo"), 0o600))
+
+	archive := filepath.Join(t.TempDir(), "archive.zip")
+	f, err := os.Create(archive)
+	require.NoError(t, err)
+	require.NoError(t, backup.Backup(f, backup.Source{Dir: src, DBPath: dbPath, DB: c}))
+	require.NoError(t, f.Close())
+
+	latest, err := db.LatestSchemaVersion()
+	require.NoError(t, err)
+	dst := t.TempDir()
+	opts := backup.RestoreOptions{
+		DBPath:           filepath.Join(dst, "restored.db"),
+		StoreDir:         dst,
+		MaxSchemaVersion: latest,
+		Migrate: func(path string) error {
+			c, err := db.New(path)
+			if err != nil {
+				return err
+			}
+			return c.Close()
+		},
+	}
+
+	t.Run("should_refuse_newer_schema", func(t *testing.T) {
+		opts := opts
+		opts.MaxSchemaVersion = latest - 1
+		_, err := backup.Restore(archive, opts)
+		require.ErrorContains(t, err, "newer than supported")
+	})
+
+	t.Run("should_only_plan_on_dry_run", func(t *testing.T) {
+		opts := opts
+		opts.DryRun = true
+		plan, err := backup.Restore(archive, opts)
+		require.NoError(t, err)
+		require.Equal(t, latest, plan.Manifest.SchemaVersion)
+		require.Len(t, plan.Steps, 2)
+		require.NoFileExists(t, opts.DBPath)
+		require.NoFileExists(t, filepath.Join(dst, "photos", "photo.jpeg"))
+	})
+
+	t.Run("should_restore_nothing_from_tampered_archive", func(t *testing.T) {
+		tampered := filepath.Join(t.TempDir(), "tampered.zip")
+		rewriteArchive(t, archive, tampered, map[string][]byte{"photos/photo.jpeg": []byte("other")})
+		dst := t.TempDir()
+		opts := opts
+		opts.DBPath = filepath.Join(dst, "restored.db")
+		opts.StoreDir = dst
+
+		_, err := backup.Restore(tampered, opts)
+		require.ErrorContains(t, err, "checksum mismatch")
+		require.NoFileExists(t, opts.DBPath)
+		require.NoFileExists(t, filepath.Join(dst, "photos", "photo.jpeg"))
+		entries, err := os.ReadDir(filepath.Join(dst, "photos"))
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+
+	t.Run("should_restore_database_and_photos", func(t *testing.T) {
+		_, err := backup.Restore(archive, opts)
+		require.NoError(t, err)
+
+		photo, err := os.ReadFile(filepath.Join(dst, "photos", "photo.jpeg"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("photo"), photo)
+
+		rc, err := db.New(opts.DBPath)
+		require.NoError(t, err)
+		defer rc.Close()
+		payers, err := rc.ListPayers(defaultLedger)
+		require.NoError(t, err)
+		require.Equal(t, []string{"some payer"}, payers)
+	})
+
+	t.Run("should_refuse_overwriting_unless_forced", func(t *testing.T) {
+		_, err := backup.Restore(archive, opts)
+		require.ErrorIs(t, err, backup.ErrTargetNotEmpty)
+
+		opts := opts
+		opts.Force = true
+		_, err = backup.Restore(archive, opts)
+		require.NoError(t, err)
+	})
+
+	t.Run("should_refuse_non_empty_photos_dir_unless_forced", func(t *testing.T) {
+		dst := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(dst, "photos"), 0o750))
+		require.NoError(t, os.WriteFile(filepath.Join(dst, "photos", "other.jpeg"), []byte("other"), 0o600))
+		opts := opts
+		opts.DBPath = filepath.Join(dst, "restored.db")
+		opts.StoreDir = dst
+
+		_, err := backup.Restore(archive, opts)
+		require.ErrorIs(t, err, backup.ErrTargetNotEmpty)
+		require.NoFileExists(t, opts.DBPath)
+
+		opts.Force = true
+		_, err = backup.Restore(archive, opts)
+		require.NoError(t, err)
+		require.FileExists(t, filepath.Join(dst, "photos", "photo.jpeg"))
+	})
+}
+
+func extract(t *testing.T, zr *zip.Reader, name, dst string) {
+	t.Helper()
+	r, err := zr.Open(name)
+	require.NoError(t, err)
+	defer r.Close()
+	contents, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(dst, contents, 0o600))
+}
+
+func TestRetention(t *testing.T) {
+	// one archive a day for 100 days, newest first
+	start := time.Date(2024, time.June, 30, 3, 0, 0, 0, time.UTC)
+	var archives []backup.Archive
+	for i := 0; i < 100; i++ {
+		created := start.AddDate(0, 0, -i)
+		archives = append(archives, backup.Archive{Name: created.Format(time.DateOnly), CreatedAt: created})
+	}
+
+	t.Run("should_keep_everything_for_zero_policy", func(t *testing.T) {
+		require.Empty(t, backup.Retention{}.Expired(archives))
+	})
+
+	t.Run("should_keep_newest_of_each_period", func(t *testing.T) {
+		expired := backup.Retention{Daily: 3, Weekly: 2, Monthly: 3}.Expired(archives)
+
+		expiredNames := map[string]struct{}{}
+		for _, a := range expired {
+			expiredNames[a.Name] = struct{}{}
+		}
+		var kept []string
+		for _, a := range archives {
+			if _, ok := expiredNames[a.Name]; !ok {
+				kept = append(kept, a.Name)
+			}
+		}
+		require.Equal(t, []string{
+			"2024-06-30", // daily, weekly (ISO week 26) and monthly
+			"2024-06-29", // daily
+			"2024-06-28", // daily
+			"2024-06-23", // weekly (ISO week 25)
+			"2024-05-31", // monthly
+			"2024-04-30", // monthly
+		}, kept)
+	})
+
+	t.Run("should_always_keep_newest", func(t *testing.T) {
+		expired := backup.Retention{Monthly: 1}.Expired(archives[:1])
+		require.Empty(t, expired)
+	})
+
+	t.Run("should_keep_parents_of_kept_incrementals", func(t *testing.T) {
+		// a full archive followed by a chain of daily incrementals
+		chain := []backup.Archive{{Name: "full", CreatedAt: start.AddDate(0, 0, -3)}}
+		for i := 2; i >= 0; i-- {
+			chain = append(chain, backup.Archive{
+				Name:      start.AddDate(0, 0, -i).Format(time.DateOnly),
+				CreatedAt: start.AddDate(0, 0, -i),
+				Parent:    chain[len(chain)-1].CreatedAt,
+			})
+		}
+		require.Empty(t, backup.Retention{Daily: 1}.Expired(chain))
+	})
+}
+
+func TestScheduler(t *testing.T) {
+	src := t.TempDir()
+	dbPath := filepath.Join(src, "exps.db")
+	c, err := db.New(dbPath)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	for _, name := range []string{
+		"acc-backup-2020-01-01_03-00-00.zip",
+		"acc-backup-2020-01-02_03-00-00.zip",
+		"unrelated.zip",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("old"), 0o600))
+	}
+
+	s := backup.NewScheduler(backup.SchedulerConfig{
+		Dir:       dir,
+		Interval:  24 * time.Hour,
+		Retention: backup.Retention{Daily: 2},
+		Source:    backup.Source{Dir: src, DBPath: dbPath, DB: c},
+	})
+
+	name, err := s.RunOnce()
+	require.NoError(t, err)
+
+	m, err := backup.ReadManifestFile(filepath.Join(dir, name), nil)
+	require.NoError(t, err)
+	require.False(t, m.Incremental())
+
+	archives, err := backup.ListArchives(dir)
+	require.NoError(t, err)
+	require.Len(t, archives, 2)
+	require.FileExists(t, filepath.Join(dir, "acc-backup-2020-01-02_03-00-00.zip"))
+	require.NoFileExists(t, filepath.Join(dir, "acc-backup-2020-01-01_03-00-00.zip"))
+	require.FileExists(t, filepath.Join(dir, "unrelated.zip"))
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	src := t.TempDir()
+	dbPath := filepath.Join(src, "exps.db")
+	c, err := db.New(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, c.CreatePayer(defaultLedger, "some payer"))
+	photos := filepath.Join(src, "photos")
+	require.NoError(t, os.MkdirAll(photos, 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(photos, "unchanged.jpeg"), []byte("unchanged"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(photos, "changed.jpeg"), []byte("before"), 0o600))
+	source := backup.Source{Dir: src, DBPath: dbPath, DB: c}
+
+	archives := t.TempDir()
+	full := filepath.Join(archives, "full.zip")
+	writeArchive(t, full, func(w io.Writer) error { return backup.Backup(w, source) })
+	prev, err := backup.ReadManifestFile(full, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(photos, "changed.jpeg"), []byte("after"), 0o600))
+	require.NoError(t, os.Chtimes(filepath.Join(photos, "changed.jpeg"), time.Time{}, time.Now().Add(time.Minute)))
+	require.NoError(t, os.WriteFile(filepath.Join(photos, "added.jpeg"), []byte("added"), 0o600))
+	require.NoError(t, c.CreatePayer(defaultLedger, "other payer"))
+
+	incremental := filepath.Join(archives, "incremental.zip")
+	writeArchive(t, incremental, func(w io.Writer) error {
+		return backup.BackupIncremental(w, source, "full.zip", prev)
+	})
+
+	t.Run("should_store_only_changed_files", func(t *testing.T) {
+		zr, err := zip.OpenReader(incremental)
+		require.NoError(t, err)
+		defer zr.Close()
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		require.ElementsMatch(t, []string{"exps.db", "photos/changed.jpeg", "photos/added.jpeg", "manifest.json"}, names)
+
+		m, err := backup.ReadManifest(&zr.Reader)
+		require.NoError(t, err)
+		require.Equal(t, "full.zip", m.Parent)
+		require.Len(t, m.Files, 4)
+		for _, f := range m.Files {
+			require.NotEmpty(t, f.SHA256, f.Path)
+			require.Equal(t, f.Path != "photos/unchanged.jpeg", f.Stored, f.Path)
+		}
+	})
+
+	t.Run("should_restore_from_full_and_incremental", func(t *testing.T) {
+		dst := t.TempDir()
+		opts := backup.RestoreOptions{
+			DBPath:           filepath.Join(dst, "restored.db"),
+			StoreDir:         dst,
+			MaxSchemaVersion: prev.SchemaVersion,
+			Migrate: func(path string) error {
+				c, err := db.New(path)
+				if err != nil {
+					return err
+				}
+				return c.Close()
+			},
+		}
+		plan, err := backup.Restore(incremental, opts)
+		require.NoError(t, err)
+		for _, s := range plan.Steps {
+			if s.Entry == "photos/unchanged.jpeg" {
+				require.Equal(t, "full.zip", s.Archive)
+			} else {
+				require.Equal(t, "incremental.zip", s.Archive, s.Entry)
+			}
+		}
+
+		for name, contents := range map[string]string{
+			"unchanged.jpeg": "unchanged",
+			"changed.jpeg":   "after",
+			"added.jpeg":     "added",
+		} {
+			got, err := os.ReadFile(filepath.Join(dst, "photos", name))
+			require.NoError(t, err)
+			require.Equal(t, contents, string(got))
+		}
+
+		rc, err := db.New(opts.DBPath)
+		require.NoError(t, err)
+		defer rc.Close()
+		payers, err := rc.ListPayers(defaultLedger)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"some payer", "other payer"}, payers)
+	})
+
+	t.Run("should_fail_without_parent", func(t *testing.T) {
+		require.NoError(t, os.Remove(full))
+		_, err := backup.Restore(incremental, backup.RestoreOptions{
+			DBPath:           filepath.Join(t.TempDir(), "restored.db"),
+			StoreDir:         t.TempDir(),
+			MaxSchemaVersion: prev.SchemaVersion,
+		})
+		require.ErrorContains(t, err, "full.zip")
+	})
+}
+
+func TestTargets(t *testing.T) {
+	s3srv := s3test.NewServer("bucket")
+	t.Cleanup(s3srv.Close)
+	s3Target, err := backup.NewS3Target(s3.Config{
+		Endpoint:  s3srv.URL,
+		Bucket:    "bucket",
+		AccessKey: "access",
+		SecretKey: "secret",
+	}, "backups/")
+	require.NoError(t, err)
+
+	davFS := webdav.NewMemFS()
+	require.NoError(t, davFS.Mkdir(context.Background(), "/backups", 0o750))
+	davsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// like servers streaming archives in chunks, HEAD carries no size
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		(&webdav.Handler{
+			Prefix:     "/dav",
+			FileSystem: davFS,
+			LockSystem: webdav.NewMemLS(),
+		}).ServeHTTP(w, r)
+	}))
+	t.Cleanup(davsrv.Close)
+	davTarget, err := backup.NewWebDAVTarget(backup.WebDAVConfig{
+		URL:      davsrv.URL + "/dav/backups",
+		Username: "user",
+		Password: "pass",
+	})
+	require.NoError(t, err)
+
+	for name, target := range map[string]backup.Target{
+		"dir":    backup.NewDirTarget(t.TempDir()),
+		"s3":     s3Target,
+		"webdav": davTarget,
+	} {
+		t.Run(name, func(t *testing.T) {
+			src := t.TempDir()
+			dbPath := filepath.Join(src, "exps.db")
+			c, err := db.New(dbPath)
+			require.NoError(t, err)
+			defer c.Close()
+
+			for _, old := range []string{
+				"acc-backup-2020-01-01_03-00-00.zip",
+				"acc-backup-2020-01-02_03-00-00.zip",
+			} {
+				require.NoError(t, target.Put(old, bytes.NewReader([]byte("old")), 3))
+			}
+
+			dir := t.TempDir()
+			s := backup.NewScheduler(backup.SchedulerConfig{
+				Dir:       dir,
+				Interval:  24 * time.Hour,
+				Retention: backup.Retention{Daily: 2},
+				Source:    backup.Source{Dir: src, DBPath: dbPath, DB: c},
+				Targets:   []backup.Target{target},
+			})
+			name, err := s.RunOnce()
+			require.NoError(t, err)
+
+			fi, err := os.Stat(filepath.Join(dir, name))
+			require.NoError(t, err)
+			size, err := target.Stat(name)
+			require.NoError(t, err)
+			require.Equal(t, fi.Size(), size)
+
+			archives, err := target.List()
+			require.NoError(t, err)
+			var names []string
+			for _, a := range archives {
+				names = append(names, a.Name)
+			}
+			require.ElementsMatch(t, []string{name, "acc-backup-2020-01-02_03-00-00.zip"}, names)
+		})
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "acc-backup-2020-01-01_03-00-00.zip"), []byte("older"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "acc-backup-2020-01-02_03-00-00.zip"), []byte("newer"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "exps.db"), []byte("db"), 0o600))
+	c := backup.Catalog{Dir: dir}
+
+	t.Run("should_list_archives_newest_first", func(t *testing.T) {
+		infos, err := c.List()
+		require.NoError(t, err)
+		require.Len(t, infos, 2)
+		require.Equal(t, "acc-backup-2020-01-02_03-00-00.zip", infos[0].Name())
+		require.Equal(t, int64(5), infos[0].Size())
+	})
+
+	t.Run("should_open_only_archives", func(t *testing.T) {
+		f, _, err := c.Open("acc-backup-2020-01-01_03-00-00.zip")
+		require.NoError(t, err)
+		defer f.Close()
+		contents, err := io.ReadAll(f)
+		require.NoError(t, err)
+		require.Equal(t, "older", string(contents))
+
+		for _, name := range []string{"exps.db", "../acc-backup-2020-01-01_03-00-00.zip"} {
+			_, _, err := c.Open(name)
+			require.ErrorIs(t, err, fs.ErrNotExist, name)
+		}
+	})
+}
+
+func TestVerify(t *testing.T) {
+	src := t.TempDir()
+	dbPath := filepath.Join(src, "exps.db")
+	c, err := db.New(dbPath)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.CreatePayer(defaultLedger, "some payer"))
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "photos"), 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "photos", "photo.jpeg"), []byte("photo"), 0o600))
+
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "acc-backup-2024-06-30_03-00-00.zip")
+	writeArchive(t, archive, func(w io.Writer) error {
+		return backup.Backup(w, backup.Source{Dir: src, DBPath: dbPath, DB: c})
+	})
+	opts := backup.VerifyOptions{
+		CheckDatabase: db.CheckFile,
+		LiveExpenses:  c.CountExpenses,
+	}
+
+	t.Run("should_pass_intact_archive", func(t *testing.T) {
+		report, err := backup.Verify(archive, opts)
+		require.NoError(t, err)
+		require.Empty(t, report.Problems)
+		require.True(t, report.OK())
+		require.Equal(t, 2, report.Files)
+		require.Equal(t, 0, report.Expenses)
+		require.Equal(t, 0, report.LiveExpenses)
+	})
+
+	t.Run("should_report_checksum_mismatch", func(t *testing.T) {
+		tampered := filepath.Join(t.TempDir(), "tampered.zip")
+		rewriteArchive(t, archive, tampered, map[string][]byte{"photos/photo.jpeg": []byte("other")})
+
+		report, err := backup.Verify(tampered, opts)
+		require.NoError(t, err)
+		require.False(t, report.OK())
+		require.Len(t, report.Problems, 1)
+		require.Contains(t, report.Problems[0], "photos/photo.jpeg")
+	})
+
+	t.Run("should_report_corrupted_database", func(t *testing.T) {
+		corrupted := filepath.Join(t.TempDir(), "corrupted.zip")
+		rewriteArchive(t, archive, corrupted, map[string][]byte{"exps.db": []byte("not a database")})
+
+		report, err := backup.Verify(corrupted, opts)
+		require.NoError(t, err)
+		require.False(t, report.OK())
+		require.Contains(t, report.Problems[len(report.Problems)-1], "database")
+	})
+
+	t.Run("should_report_archive_holding_more_expenses_than_live_database", func(t *testing.T) {
+		opts := backup.VerifyOptions{
+			CheckDatabase: func(string) (int, error) { return 5, nil },
+			LiveExpenses:  func() (int, error) { return 3, nil },
+		}
+		report, err := backup.Verify(archive, opts)
+		require.NoError(t, err)
+		require.False(t, report.OK())
+		require.Equal(t, []string{"archive holds 5 expenses, the live database only 3"}, report.Problems)
+
+		// expenses added since the backup are fine
+		opts.LiveExpenses = func() (int, error) { return 8, nil }
+		report, err = backup.Verify(archive, opts)
+		require.NoError(t, err)
+		require.True(t, report.OK())
+	})
+
+	t.Run("should_report_failed_live_count", func(t *testing.T) {
+		opts := backup.VerifyOptions{
+			CheckDatabase: db.CheckFile,
+			LiveExpenses:  func() (int, error) { return 0, errors.New("database is locked") },
+		}
+		report, err := backup.Verify(archive, opts)
+		require.NoError(t, err)
+		require.Equal(t, 2, report.Files)
+		require.Equal(t, -1, report.LiveExpenses)
+		require.Len(t, report.Problems, 1)
+		require.Contains(t, report.Problems[0], "database is locked")
+	})
+
+	t.Run("should_verify_when_started", func(t *testing.T) {
+		v := backup.NewVerifier(backup.VerifierConfig{Dir: dir, Options: opts})
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			v.Run(ctx, time.Hour)
+			close(done)
+		}()
+		require.Eventually(t, func() bool {
+			_, ok := v.LastReport()
+			return ok
+		}, 5*time.Second, 10*time.Millisecond)
+		cancel()
+		<-done
+	})
+
+	t.Run("should_keep_last_report", func(t *testing.T) {
+		v := backup.NewVerifier(backup.VerifierConfig{Dir: dir, Options: opts})
+		_, ok := v.LastReport()
+		require.False(t, ok)
+
+		_, err := v.VerifyLatest()
+		require.NoError(t, err)
+		report, ok := v.LastReport()
+		require.True(t, ok)
+		require.True(t, report.OK())
+		require.Equal(t, filepath.Base(archive), report.Archive)
+	})
+
+	t.Run("should_report_nothing_without_archives", func(t *testing.T) {
+		v := backup.NewVerifier(backup.VerifierConfig{Dir: t.TempDir(), Options: opts})
+
+		report, err := v.VerifyLatest()
+		require.NoError(t, err)
+		require.Empty(t, report.Archive)
+		_, ok := v.LastReport()
+		require.False(t, ok)
+	})
+}
+
+// rewriteArchive copies the archive src to dst replacing the contents of
+// some entries, but not the manifest.
+func rewriteArchive(t *testing.T, src, dst string, replace map[string][]byte) {
+	t.Helper()
+	zr, err := zip.OpenReader(src)
+	require.NoError(t, err)
+	defer zr.Close()
+
+	f, err := os.Create(dst)
+	require.NoError(t, err)
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, entry := range zr.File {
+		w, err := zw.Create(entry.Name)
+		require.NoError(t, err)
+		if contents, ok := replace[entry.Name]; ok {
+			_, err = w.Write(contents)
+			require.NoError(t, err)
+			continue
+		}
+		r, err := entry.Open()
+		require.NoError(t, err)
+		_, err = io.Copy(w, r)
+		require.NoError(t, err)
+		r.Close()
+	}
+	require.NoError(t, zw.Close())
+}
+
+func writeArchive(t *testing.T, path string, backup func(w io.Writer) error) {
+	t.Helper()
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, backup(f))
+	require.NoError(t, f.Close())
+}
+
+func TestEncryptedArchive(t *testing.T) {
+	src := t.TempDir()
+	dbPath := filepath.Join(src, "exps.db")
+	c, err := db.New(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, c.CreatePayer(defaultLedger, "some payer"))
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "photos"), 0o750))
+	// incompressible, so it spans several encrypted chunks
+	photo := make([]byte, 500_000)
+	_, err = rand.Read(photo)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(src, "photos", "photo.jpeg"), photo, 0o600))
+	passphrase := []byte("correct horse battery staple")
+
+	dir := t.TempDir()
+	s := backup.NewScheduler(backup.SchedulerConfig{
+		Dir:        dir,
+		Interval:   24 * time.Hour,
+		Source:     backup.Source{Dir: src, DBPath: dbPath, DB: c},
+		Passphrase: passphrase,
+	})
+	name, err := s.RunOnce()
+	require.NoError(t, err)
+	archive := filepath.Join(dir, name)
+
+	t.Run("should_not_be_readable_as_plain_zip", func(t *testing.T) {
+		_, err := zip.OpenReader(archive)
+		require.Error(t, err)
+		contents, err := os.ReadFile(archive)
+		require.NoError(t, err)
+		require.NotContains(t, string(contents), "some payer")
+	})
+
+	t.Run("should_decrypt_with_passphrase", func(t *testing.T) {
+		a, err := backup.OpenArchive(archive, passphrase)
+		require.NoError(t, err)
+		defer a.Close()
+		require.True(t, a.Encrypted)
+
+		r, err := a.Open("photos/photo.jpeg")
+		require.NoError(t, err)
+		defer r.Close()
+		contents, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, photo, contents)
+	})
+
+	t.Run("should_fail_cleanly_on_wrong_passphrase", func(t *testing.T) {
+		_, err := backup.OpenArchive(archive, []byte("wrong"))
+		require.ErrorIs(t, err, backup.ErrWrongPassphrase)
+
+		_, err = backup.OpenArchive(archive, nil)
+		require.ErrorIs(t, err, backup.ErrPassphraseRequired)
+	})
+
+	t.Run("should_detect_tampering_and_truncation", func(t *testing.T) {
+		contents, err := os.ReadFile(archive)
+		require.NoError(t, err)
+
+		tampered := filepath.Join(t.TempDir(), "tampered.zip")
+		flipped := bytes.Clone(contents)
+		flipped[len(flipped)-1] ^= 1
+		require.NoError(t, os.WriteFile(tampered, flipped, 0o600))
+		_, err = backup.OpenArchive(tampered, passphrase)
+		require.ErrorIs(t, err, backup.ErrArchiveCorrupted)
+
+		truncated := filepath.Join(t.TempDir(), "truncated.zip")
+		require.NoError(t, os.WriteFile(truncated, contents[:len(contents)-100], 0o600))
+		_, err = backup.OpenArchive(truncated, passphrase)
+		require.ErrorIs(t, err, backup.ErrArchiveCorrupted)
+	})
+
+	t.Run("should_restore", func(t *testing.T) {
+		latest, err := db.LatestSchemaVersion()
+		require.NoError(t, err)
+		dst := t.TempDir()
+		_, err = backup.Restore(archive, backup.RestoreOptions{
+			DBPath:           filepath.Join(dst, "restored.db"),
+			StoreDir:         dst,
+			MaxSchemaVersion: latest,
+			Migrate:          func(string) error { return nil },
+			Passphrase:       passphrase,
+		})
+		require.NoError(t, err)
+
+		contents, err := os.ReadFile(filepath.Join(dst, "photos", "photo.jpeg"))
+		require.NoError(t, err)
+		require.Equal(t, photo, contents)
+	})
+}
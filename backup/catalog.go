@@ -0,0 +1,76 @@
+package backup
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/pkg/errors"
+)
+
+// Catalog gives access to the archives kept in Dir and makes new ones of
+// Source on demand, encrypted when Passphrase is set.
+type Catalog struct {
+	Dir        string
+	Source     Source
+	Passphrase []byte
+}
+
+// WriteBackup streams a new full archive to w.
+func (c Catalog) WriteBackup(w io.Writer) error {
+	if len(c.Passphrase) == 0 {
+		return Backup(w, c.Source)
+	}
+
+	ew, err := NewEncryptWriter(w, c.Passphrase)
+	if err != nil {
+		return err
+	}
+	err = Backup(ew, c.Source)
+	if err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+// List returns the archives in Dir, newest first.
+func (c Catalog) List() ([]fs.FileInfo, error) {
+	archives, err := ListArchives(c.Dir)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(archives, func(a, b Archive) int { return b.CreatedAt.Compare(a.CreatedAt) })
+
+	infos := make([]fs.FileInfo, 0, len(archives))
+	for _, a := range archives {
+		fi, err := os.Stat(filepath.Join(c.Dir, a.Name))
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not stat '%s'", a.Name)
+		}
+		infos = append(infos, fi)
+	}
+
+	return infos, nil
+}
+
+// Open opens the named archive of Dir. Names of anything but archives
+// are reported as not existing.
+func (c Catalog) Open(name string) (io.ReadSeekCloser, fs.FileInfo, error) {
+	if _, ok := parseArchiveName(name); !ok || name != filepath.Base(name) {
+		return nil, nil, fs.ErrNotExist
+	}
+
+	f, err := os.Open(filepath.Join(c.Dir, name))
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return f, fi, nil
+}
@@ -0,0 +1,331 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted archives are a header followed by the archive split into
+// chunks, each sealed with AES-GCM on its own, so neither encryption nor
+// decryption needs more than a chunk in memory:
+//
+//	magic "ACC2BAK" | version | log2(N) | r | p | salt | nonce prefix | key check
+//	chunk 0 | chunk 1 | ... | final chunk
+//
+// The key and the key check are derived from the passphrase with scrypt,
+// the key check lets a wrong passphrase be told apart from a damaged
+// archive. Chunk nonces are the nonce prefix, the chunk index and a flag
+// set only for the final chunk, so reordered, dropped or truncated chunks
+// fail authentication. Every chunk is authenticated together with the
+// header.
+const (
+	cryptMagic   = "ACC2BAK"
+	cryptVersion = 1
+
+	saltSize        = 16
+	noncePrefixSize = 7
+	keyCheckSize    = sha256.Size
+	headerSize      = len(cryptMagic) + 4 + saltSize + noncePrefixSize + keyCheckSize
+
+	chunkSize       = 64 << 10
+	tagSize         = 16
+	sealedChunkSize = chunkSize + tagSize
+
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+)
+
+var (
+	ErrWrongPassphrase    = errors.New("wrong backup passphrase")
+	ErrPassphraseRequired = errors.New("archive is encrypted, a passphrase is required")
+	ErrArchiveCorrupted   = errors.New("encrypted archive is corrupted")
+)
+
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	prefix []byte
+	buf    []byte
+	index  uint32
+	closed bool
+}
+
+// NewEncryptWriter returns a writer encrypting everything written to it
+// into w with a key derived from passphrase. Close must be called to
+// write the final chunk, it does not close w.
+func NewEncryptWriter(w io.Writer, passphrase []byte) (io.WriteCloser, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty backup passphrase")
+	}
+
+	header := make([]byte, 0, headerSize)
+	header = append(header, cryptMagic...)
+	header = append(header, cryptVersion, scryptLogN, scryptR, scryptP)
+	random := make([]byte, saltSize+noncePrefixSize)
+	_, err := rand.Read(random)
+	if err != nil {
+		return nil, err
+	}
+	header = append(header, random...)
+
+	key, check, err := deriveKey(passphrase, header)
+	if err != nil {
+		return nil, err
+	}
+	header = append(header, check...)
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		prefix: header[headerSize-keyCheckSize-noncePrefixSize : headerSize-keyCheckSize],
+		buf:    make([]byte, 0, chunkSize),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed encrypt writer")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is sealed only once more data follows, as it may
+		// turn out to be the final one
+		if len(e.buf) == chunkSize {
+			err := e.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):chunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(final bool) error {
+	if e.index == ^uint32(0) {
+		return errors.New("archive too large to encrypt")
+	}
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, e.index, final), e.buf, e.header)
+	_, err := e.w.Write(sealed)
+	if err != nil {
+		return err
+	}
+	e.index++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// decryptReaderAt gives random access to the plain contents of an
+// encrypted archive, decrypting one chunk at a time.
+type decryptReaderAt struct {
+	r      io.ReaderAt
+	aead   cipher.AEAD
+	header []byte
+	prefix []byte
+	size   int64
+	chunks int64
+
+	mu     sync.Mutex
+	cached int64
+	plain  []byte
+	sealed []byte
+}
+
+// isEncrypted reports whether the archive read by r starts with the
+// encrypted container header.
+func isEncrypted(r io.ReaderAt) (bool, error) {
+	magic := make([]byte, len(cryptMagic))
+	_, err := r.ReadAt(magic, 0)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return string(magic) == cryptMagic, nil
+}
+
+// newDecryptReaderAt checks the passphrase against the header of the
+// encrypted archive of the given size and the final chunk for truncation.
+func newDecryptReaderAt(r io.ReaderAt, size int64, passphrase []byte) (*decryptReaderAt, error) {
+	if len(passphrase) == 0 {
+		return nil, ErrPassphraseRequired
+	}
+	if size < int64(headerSize) {
+		return nil, ErrArchiveCorrupted
+	}
+	header := make([]byte, headerSize)
+	_, err := r.ReadAt(header, 0)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:len(cryptMagic)]) != cryptMagic {
+		return nil, errors.New("not an encrypted archive")
+	}
+	if v := header[len(cryptMagic)]; v != cryptVersion {
+		return nil, errors.Errorf("unsupported encrypted archive version %d", v)
+	}
+
+	key, check, err := deriveKey(passphrase, header[:headerSize-keyCheckSize])
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(check, header[headerSize-keyCheckSize:]) != 1 {
+		return nil, ErrWrongPassphrase
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	body := size - int64(headerSize)
+	chunks := (body + sealedChunkSize - 1) / sealedChunkSize
+	last := body - (chunks-1)*sealedChunkSize
+	if chunks == 0 || last < tagSize {
+		return nil, ErrArchiveCorrupted
+	}
+
+	d := &decryptReaderAt{
+		r:      r,
+		aead:   aead,
+		header: header,
+		prefix: header[headerSize-keyCheckSize-noncePrefixSize : headerSize-keyCheckSize],
+		size:   (chunks-1)*chunkSize + last - tagSize,
+		chunks: chunks,
+		cached: -1,
+		sealed: make([]byte, sealedChunkSize),
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err = d.load(chunks - 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *decryptReaderAt) Size() int64 {
+	return d.size
+}
+
+func (d *decryptReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	read := 0
+	for len(p) > 0 {
+		if off >= d.size {
+			return read, io.EOF
+		}
+		err := d.load(off / chunkSize)
+		if err != nil {
+			return read, err
+		}
+		n := copy(p, d.plain[off%chunkSize:])
+		p = p[n:]
+		off += int64(n)
+		read += n
+	}
+
+	return read, nil
+}
+
+// load decrypts chunk i into d.plain, unless it is there already.
+func (d *decryptReaderAt) load(i int64) error {
+	if d.cached == i {
+		return nil
+	}
+
+	sealed := d.sealed
+	if i == d.chunks-1 {
+		sealed = sealed[:d.size-i*chunkSize+tagSize]
+	}
+	_, err := d.r.ReadAt(sealed, int64(headerSize)+i*sealedChunkSize)
+	if err != nil && !(err == io.EOF && i == d.chunks-1) {
+		return err
+	}
+
+	plain, err := d.aead.Open(d.plain[:0], chunkNonce(d.prefix, uint32(i), i == d.chunks-1), sealed, d.header)
+	if err != nil {
+		d.cached = -1
+		return errors.Wrapf(ErrArchiveCorrupted, "chunk %d", i)
+	}
+	d.plain = plain
+	d.cached = i
+	return nil
+}
+
+func deriveKey(passphrase, params []byte) (key, check []byte, err error) {
+	logN, r, p := params[len(cryptMagic)+1], params[len(cryptMagic)+2], params[len(cryptMagic)+3]
+	if logN < 10 || logN > 22 || r == 0 || p == 0 {
+		return nil, nil, errors.New("invalid key derivation parameters")
+	}
+	salt := params[len(cryptMagic)+4 : len(cryptMagic)+4+saltSize]
+
+	derived, err := scrypt.Key(passphrase, salt, 1<<logN, int(r), int(p), 64)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not derive key")
+	}
+	sum := sha256.Sum256(derived[32:])
+	return derived[:32], sum[:], nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, index uint32, final bool) []byte {
+	nonce := bytes.NewBuffer(make([]byte, 0, 12))
+	nonce.Write(prefix)
+	binary.Write(nonce, binary.BigEndian, index)
+	if final {
+		nonce.WriteByte(1)
+	} else {
+		nonce.WriteByte(0)
+	}
+	return nonce.Bytes()
+}
@@ -0,0 +1,138 @@
+package backup
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	manifestName    = "manifest.json"
+	manifestVersion = 2
+)
+
+// Manifest describes the contents of an archive. It is written as the
+// last entry of every archive.
+type Manifest struct {
+	Version       int       `json:"version"`
+	CreatedAt     time.Time `json:"created_at"`
+	SchemaVersion uint      `json:"schema_version"`
+	// Database is the archive entry holding the database snapshot
+	Database string `json:"database"`
+	// Parent names the archive an incremental archive builds on,
+	// it is empty for full archives
+	Parent string `json:"parent,omitempty"`
+	// Files lists all backed up files, including the ones stored
+	// in parent archives
+	Files []ManifestFile `json:"files"`
+}
+
+func (m Manifest) Incremental() bool {
+	return m.Parent != ""
+}
+
+type ManifestFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256"`
+	// Stored is false for files unchanged since the parent archive,
+	// their contents are found up the chain of parents
+	Stored bool `json:"stored"`
+}
+
+func writeManifest(zw *zip.Writer, m Manifest) error {
+	w, err := zw.Create(manifestName)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
+// ReadManifest reads and checks the manifest of an opened archive.
+func ReadManifest(zr *zip.Reader) (Manifest, error) {
+	f, err := zr.Open(manifestName)
+	if err != nil {
+		return Manifest{}, errors.Wrap(err, "archive has no manifest")
+	}
+	defer f.Close()
+
+	var m Manifest
+	err = json.NewDecoder(f).Decode(&m)
+	if err != nil {
+		return Manifest{}, errors.Wrap(err, "could not decode manifest")
+	}
+	if m.Version < 1 || m.Version > manifestVersion {
+		return Manifest{}, errors.Errorf("unsupported manifest version %d", m.Version)
+	}
+	if m.Database == "" {
+		return Manifest{}, errors.New("manifest names no database")
+	}
+	// version 1 archives were always full
+	if m.Version == 1 {
+		for i := range m.Files {
+			m.Files[i].Stored = true
+		}
+	}
+
+	return m, nil
+}
+
+// ReadManifestFile reads the manifest of the archive at path, passphrase
+// is only needed for encrypted archives.
+func ReadManifestFile(path string, passphrase []byte) (Manifest, error) {
+	a, err := OpenArchive(path, passphrase)
+	if err != nil {
+		return Manifest{}, errors.Wrap(err, "could not open archive")
+	}
+	defer a.Close()
+
+	return ReadManifest(a.Reader)
+}
+
+// SizeEntry sums up the files of a manifest under one top level path.
+type SizeEntry struct {
+	Path  string
+	Files int
+	Bytes int64
+	// Stored counts only files stored in the archive itself, the rest
+	// is found in parent archives
+	StoredFiles int
+	StoredBytes int64
+}
+
+// SizeReport sums up the files of the manifest per top level path,
+// sorted by path.
+func (m Manifest) SizeReport() []SizeEntry {
+	byPath := map[string]*SizeEntry{}
+	var entries []*SizeEntry
+	for _, f := range m.Files {
+		top, _, _ := strings.Cut(f.Path, "/")
+		e, ok := byPath[top]
+		if !ok {
+			e = &SizeEntry{Path: top}
+			byPath[top] = e
+			entries = append(entries, e)
+		}
+		e.Files++
+		e.Bytes += f.Size
+		if f.Stored {
+			e.StoredFiles++
+			e.StoredBytes += f.Size
+		}
+	}
+
+	report := make([]SizeEntry, len(entries))
+	for i, e := range entries {
+		report[i] = *e
+	}
+	slices.SortFunc(report, func(a, b SizeEntry) int { return strings.Compare(a.Path, b.Path) })
+	return report
+}
@@ -0,0 +1,309 @@
+package backup
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/pkg/errors"
+)
+
+var ErrTargetNotEmpty = errors.New("restore target is not empty")
+
+type RestoreOptions struct {
+	DBPath   string
+	StoreDir string
+	// MaxSchemaVersion is the newest schema the running binary knows,
+	// archives of newer schemas are refused
+	MaxSchemaVersion uint
+	// Migrate runs migrations on the restored database file
+	Migrate func(dbPath string) error
+	// DryRun only plans the restore, nothing is written
+	DryRun bool
+	// Force allows restoring into a non-empty target, overwriting existing
+	// files
+	Force bool
+	// Passphrase decrypts encrypted archives
+	Passphrase []byte
+}
+
+type RestoreStep struct {
+	Entry string
+	// Archive names the archive of the chain holding the entry contents
+	Archive string
+	Dst     string
+	Size    int64
+	// Exists is set when Dst already exists and is overwritten
+	Exists bool
+
+	zr     *zip.Reader
+	sha256 string
+}
+
+type RestorePlan struct {
+	Manifest Manifest
+	Steps    []RestoreStep
+}
+
+// Restore puts the database and photos of an archive back in place.
+// Incremental archives are restored together with their parents, which
+// are expected in the same directory.
+func Restore(archive string, opts RestoreOptions) (RestorePlan, error) {
+	c, err := openChain(archive, opts.Passphrase)
+	if err != nil {
+		return RestorePlan{}, err
+	}
+	defer c.close()
+
+	m := c[0].manifest
+	if m.SchemaVersion > opts.MaxSchemaVersion {
+		return RestorePlan{}, errors.Errorf("archive schema version %d is newer than supported %d", m.SchemaVersion, opts.MaxSchemaVersion)
+	}
+
+	plan, err := planRestore(c, opts)
+	if err != nil {
+		return RestorePlan{}, err
+	}
+	if opts.DryRun {
+		return plan, nil
+	}
+	if !opts.Force {
+		target, err := nonEmptyTarget(plan)
+		if err != nil {
+			return plan, err
+		}
+		if target != "" {
+			return plan, errors.Wrapf(ErrTargetNotEmpty, "'%s' is not empty", target)
+		}
+	}
+
+	// every entry is extracted next to its destination and checked before
+	// anything is moved in place, so a failed restore leaves the current
+	// database and photos untouched
+	extracted := make([]string, len(plan.Steps))
+	defer func() {
+		for _, tmp := range extracted {
+			if tmp != "" {
+				os.Remove(tmp)
+			}
+		}
+	}()
+	for i, s := range plan.Steps {
+		extracted[i], err = extractStep(s, s.Entry == m.Database, opts.Migrate)
+		if err != nil {
+			return plan, errors.Wrapf(err, "could not restore '%s'", s.Entry)
+		}
+	}
+	for i, s := range plan.Steps {
+		err = commitStep(extracted[i], s, s.Entry == m.Database)
+		if err != nil {
+			return plan, errors.Wrapf(err, "could not restore '%s'", s.Entry)
+		}
+		extracted[i] = ""
+	}
+
+	return plan, nil
+}
+
+// nonEmptyTarget returns the database file when it exists or the first
+// directory files are restored to holding anything, empty when the
+// restore writes to empty targets only.
+func nonEmptyTarget(plan RestorePlan) (string, error) {
+	var dirs []string
+	for _, s := range plan.Steps {
+		if s.Exists {
+			return s.Dst, nil
+		}
+		if s.Entry != plan.Manifest.Database && !slices.Contains(dirs, filepath.Dir(s.Dst)) {
+			dirs = append(dirs, filepath.Dir(s.Dst))
+		}
+	}
+
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", errors.Wrapf(err, "could not read '%s'", dir)
+		}
+		if len(entries) > 0 {
+			return dir, nil
+		}
+	}
+
+	return "", nil
+}
+
+func planRestore(c chain, opts RestoreOptions) (RestorePlan, error) {
+	m := c[0].manifest
+	plan := RestorePlan{Manifest: m}
+	for _, f := range m.Files {
+		if !filepath.IsLocal(filepath.FromSlash(f.Path)) {
+			return RestorePlan{}, errors.Errorf("archive entry '%s' points outside the target", f.Path)
+		}
+		link, ok := c.find(f)
+		if !ok {
+			return RestorePlan{}, errors.Errorf("no archive of the chain stores '%s'", f.Path)
+		}
+
+		dst := filepath.Join(opts.StoreDir, filepath.FromSlash(f.Path))
+		if f.Path == m.Database {
+			dst = opts.DBPath
+		}
+		_, err := os.Stat(dst)
+		if err != nil && !os.IsNotExist(err) {
+			return RestorePlan{}, errors.Wrapf(err, "could not stat '%s'", dst)
+		}
+
+		plan.Steps = append(plan.Steps, RestoreStep{
+			Entry:   f.Path,
+			Archive: link.name,
+			Dst:     dst,
+			Size:    f.Size,
+			Exists:  err == nil,
+			zr:      link.archive.Reader,
+			sha256:  f.SHA256,
+		})
+	}
+
+	return plan, nil
+}
+
+// extractStep extracts the entry of s next to its destination, migrating
+// it when it is the database.
+func extractStep(s RestoreStep, database bool, migrate func(string) error) (string, error) {
+	tmp, err := extractTemp(s.zr, s.Entry, s.sha256, filepath.Dir(s.Dst))
+	if err != nil {
+		return "", err
+	}
+	if !database {
+		return tmp, nil
+	}
+
+	err = migrate(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return "", errors.Wrap(err, "could not migrate restored database")
+	}
+	return tmp, nil
+}
+
+// commitStep moves the extracted tmp in place of the destination of s,
+// dropping the journal files of a replaced database.
+func commitStep(tmp string, s RestoreStep, database bool) error {
+	if database {
+		for _, suffix := range databaseSuffixes[1:] {
+			err := os.Remove(s.Dst + suffix)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return os.Rename(tmp, s.Dst)
+}
+
+// extractTemp extracts entry to a temporary file of dir. The contents are
+// checked against sum unless it is empty, as in version 1 manifests.
+func extractTemp(zr *zip.Reader, entry, sum, dir string) (string, error) {
+	r, err := zr.Open(entry)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	err = os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, ".tmp-restore-*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), r)
+	if err == nil && sum != "" && hex.EncodeToString(hash.Sum(nil)) != sum {
+		err = errors.New("checksum mismatch")
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// maxChainLength guards against parent cycles
+const maxChainLength = 1000
+
+type chainLink struct {
+	name     string
+	archive  *ArchiveReader
+	manifest Manifest
+	// stored maps paths of files stored in this archive to their checksums
+	stored map[string]string
+}
+
+// chain is an archive followed by its parents, up to a full archive
+type chain []chainLink
+
+func openChain(path string, passphrase []byte) (chain, error) {
+	dir := filepath.Dir(path)
+	var c chain
+	for {
+		a, err := OpenArchive(path, passphrase)
+		if err != nil {
+			c.close()
+			return nil, errors.Wrapf(err, "could not open archive '%s'", path)
+		}
+		m, err := ReadManifest(a.Reader)
+		if err != nil {
+			a.Close()
+			c.close()
+			return nil, errors.Wrapf(err, "invalid archive '%s'", path)
+		}
+
+		link := chainLink{name: filepath.Base(path), archive: a, manifest: m, stored: map[string]string{}}
+		for _, f := range m.Files {
+			if f.Stored {
+				link.stored[f.Path] = f.SHA256
+			}
+		}
+		c = append(c, link)
+
+		if !m.Incremental() {
+			return c, nil
+		}
+		if len(c) == maxChainLength {
+			c.close()
+			return nil, errors.New("archive chain too long")
+		}
+		path = filepath.Join(dir, filepath.Base(m.Parent))
+	}
+}
+
+// find returns the newest archive of the chain storing f.
+func (c chain) find(f ManifestFile) (chainLink, bool) {
+	for _, l := range c {
+		if sum, ok := l.stored[f.Path]; ok && sum == f.SHA256 {
+			return l, true
+		}
+	}
+	return chainLink{}, false
+}
+
+func (c chain) close() {
+	for _, l := range c {
+		l.archive.Close()
+	}
+}
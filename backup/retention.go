@@ -0,0 +1,85 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Retention is a grandfather-father-son policy: the newest archive of each
+// of the last Daily days, Weekly ISO weeks and Monthly months is kept.
+// A zero Retention keeps everything.
+type Retention struct {
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+type Archive struct {
+	Name      string
+	CreatedAt time.Time
+	// Parent is the creation time of the archive an incremental archive
+	// builds on, zero for full archives
+	Parent time.Time
+	Size   int64
+}
+
+func (a Archive) Incremental() bool {
+	return !a.Parent.IsZero()
+}
+
+// Expired returns archives not kept by the policy. The newest archive
+// is always kept, as are the parents of kept incremental archives.
+func (r Retention) Expired(archives []Archive) []Archive {
+	if r == (Retention{}) || len(archives) == 0 {
+		return nil
+	}
+
+	sorted := make([]Archive, len(archives))
+	copy(sorted, archives)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].CreatedAt.After(sorted[j].CreatedAt) })
+
+	kept := map[string]struct{}{sorted[0].Name: {}}
+	keep := func(limit int, bucket func(t time.Time) string) {
+		seen := map[string]struct{}{}
+		for _, a := range sorted {
+			if len(seen) == limit {
+				return
+			}
+			b := bucket(a.CreatedAt)
+			if _, ok := seen[b]; ok {
+				continue
+			}
+			seen[b] = struct{}{}
+			kept[a.Name] = struct{}{}
+		}
+	}
+	keep(r.Daily, func(t time.Time) string { return t.Format(time.DateOnly) })
+	keep(r.Weekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%d", year, week)
+	})
+	keep(r.Monthly, func(t time.Time) string { return t.Format("2006-01") })
+
+	byCreatedAt := map[int64]Archive{}
+	for _, a := range sorted {
+		byCreatedAt[a.CreatedAt.Unix()] = a
+	}
+	// parents are older, so they are reached after their children
+	for _, a := range sorted {
+		if _, ok := kept[a.Name]; !ok || !a.Incremental() {
+			continue
+		}
+		if p, ok := byCreatedAt[a.Parent.Unix()]; ok {
+			kept[p.Name] = struct{}{}
+		}
+	}
+
+	var expired []Archive
+	for _, a := range sorted {
+		if _, ok := kept[a.Name]; !ok {
+			expired = append(expired, a)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,236 @@
+package backup
+
+import (
+	"context"
+	stderrors "errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type SchedulerConfig struct {
+	// At is the time of day, as offset from midnight, of the first run
+	At       time.Duration
+	Interval time.Duration
+	// Dir is where archives are written to
+	Dir       string
+	Retention Retention
+	Source    Source
+	// FullInterval is how often a full archive is made, archives in
+	// between only store files changed since the previous archive.
+	// Zero makes every archive full.
+	FullInterval time.Duration
+	// Passphrase encrypts archives when set
+	Passphrase []byte
+	// Targets get a copy of every archive, the retention policy is
+	// applied to them as well
+	Targets []Target
+	Logger  *slog.Logger
+}
+
+type Scheduler struct {
+	cfg SchedulerConfig
+	now func() time.Time
+}
+
+func NewScheduler(cfg SchedulerConfig) Scheduler {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	return Scheduler{
+		cfg: cfg,
+		now: time.Now,
+	}
+}
+
+// Run creates backups at configured times until ctx is done.
+func (s Scheduler) Run(ctx context.Context) {
+	next := s.firstRun()
+	for {
+		s.cfg.Logger.Info("next backup scheduled", slog.Time("at", next))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			s.cfg.Logger.Info("stopping backup scheduler")
+			return
+		case <-timer.C:
+		}
+
+		_, err := s.RunOnce()
+		if err != nil {
+			s.cfg.Logger.Error("backup failed", "error", err)
+		}
+
+		for !next.After(s.now()) {
+			next = next.Add(s.cfg.Interval)
+		}
+	}
+}
+
+func (s Scheduler) firstRun() time.Time {
+	now := s.now()
+	next := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).Add(s.cfg.At)
+	for !next.After(now) {
+		next = next.Add(s.cfg.Interval)
+	}
+	return next
+}
+
+// RunOnce writes a new archive, removes archives expired by the
+// retention policy and syncs the targets, returning the new archive name.
+func (s Scheduler) RunOnce() (string, error) {
+	start := s.now()
+	parent, prev := s.parent()
+	name := archiveName(start, parent.CreatedAt)
+	s.cfg.Logger.Info("starting backup", slog.String("archive", name), slog.String("parent", parent.Name))
+
+	var m Manifest
+	size, err := s.write(name, func(w io.Writer) error {
+		var err error
+		if len(s.cfg.Passphrase) == 0 {
+			m, err = s.backup(w, parent, prev)
+			return err
+		}
+
+		ew, err := NewEncryptWriter(w, s.cfg.Passphrase)
+		if err != nil {
+			return err
+		}
+		m, err = s.backup(ew, parent, prev)
+		if err != nil {
+			return err
+		}
+		return ew.Close()
+	})
+	if err != nil {
+		return "", err
+	}
+	s.cfg.Logger.Info("backup finished",
+		slog.String("archive", name),
+		slog.Bool("incremental", parent.Name != ""),
+		slog.Bool("encrypted", len(s.cfg.Passphrase) > 0),
+		slog.Int64("size", size),
+		slog.Duration("duration", s.now().Sub(start)),
+	)
+	for _, e := range m.SizeReport() {
+		s.cfg.Logger.Info("backup contents",
+			slog.String("archive", name),
+			slog.String("path", e.Path),
+			slog.Int("files", e.Files),
+			slog.Int64("bytes", e.Bytes),
+			slog.Int("stored_files", e.StoredFiles),
+			slog.Int64("stored_bytes", e.StoredBytes),
+		)
+	}
+
+	err = s.applyRetention()
+	if err != nil {
+		return name, errors.Wrap(err, "could not apply retention")
+	}
+
+	var errs []error
+	for _, t := range s.cfg.Targets {
+		err := s.syncTarget(t)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "could not sync target %s", t))
+		}
+	}
+
+	return name, stderrors.Join(errs...)
+}
+
+func (s Scheduler) backup(w io.Writer, parent Archive, prev Manifest) (Manifest, error) {
+	return backup(w, s.cfg.Source, parent.Name, prev)
+}
+
+// parent returns the archive the next one should build on, or a zero
+// Archive when the next archive should be full.
+func (s Scheduler) parent() (Archive, Manifest) {
+	if s.cfg.FullInterval <= 0 {
+		return Archive{}, Manifest{}
+	}
+	archives, err := ListArchives(s.cfg.Dir)
+	if err != nil || len(archives) == 0 {
+		return Archive{}, Manifest{}
+	}
+	latest := slices.MaxFunc(archives, func(a, b Archive) int { return a.CreatedAt.Compare(b.CreatedAt) })
+
+	c, err := openChain(filepath.Join(s.cfg.Dir, latest.Name), s.cfg.Passphrase)
+	if err != nil {
+		s.cfg.Logger.Warn("could not open latest archive chain, making full backup", slog.String("archive", latest.Name), "error", err)
+		return Archive{}, Manifest{}
+	}
+	prev, full := c[0].manifest, c[len(c)-1].manifest
+	c.close()
+	if s.now().Sub(full.CreatedAt) >= s.cfg.FullInterval {
+		return Archive{}, Manifest{}
+	}
+
+	return latest, prev
+}
+
+// write creates the archive under a hidden name first, so an interrupted
+// backup is never taken for a complete one.
+func (s Scheduler) write(name string, backup func(w io.Writer) error) (int64, error) {
+	err := os.MkdirAll(s.cfg.Dir, 0o750)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not create backups dir")
+	}
+
+	tmp := filepath.Join(s.cfg.Dir, "."+name)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not create backup file")
+	}
+	defer os.Remove(tmp)
+
+	err = backup(f)
+	if err != nil {
+		f.Close()
+		return 0, errors.Wrap(err, "could not execute backup")
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return 0, errors.Wrap(err, "could not sync backup file")
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, errors.Wrap(err, "could not stat backup file")
+	}
+	err = f.Close()
+	if err != nil {
+		return 0, errors.Wrap(err, "could not close backup file")
+	}
+
+	err = os.Rename(tmp, filepath.Join(s.cfg.Dir, name))
+	if err != nil {
+		return 0, errors.Wrap(err, "could not rename backup file")
+	}
+
+	return fi.Size(), nil
+}
+
+func (s Scheduler) applyRetention() error {
+	archives, err := ListArchives(s.cfg.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range s.cfg.Retention.Expired(archives) {
+		err := os.Remove(filepath.Join(s.cfg.Dir, a.Name))
+		if err != nil {
+			return errors.Wrapf(err, "could not remove '%s'", a.Name)
+		}
+		s.cfg.Logger.Info("removed expired backup", slog.String("archive", a.Name))
+	}
+
+	return nil
+}
@@ -0,0 +1,216 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/matmazurk/acc2/s3"
+	"github.com/pkg/errors"
+)
+
+// Target is an off-site location archives are copied to.
+type Target interface {
+	fmt.Stringer
+	// Put stores size bytes read from r as the named archive
+	Put(name string, r io.Reader, size int64) error
+	// Stat returns the stored size of the named archive, -1 when the
+	// target does not report it
+	Stat(name string) (int64, error)
+	// List returns the archives stored in the target
+	List() ([]Archive, error)
+	Delete(name string) error
+}
+
+// syncTarget uploads local archives missing from t, oldest first, so
+// incremental archives never land without their parents, then applies
+// the retention policy to the archives stored in t.
+func (s Scheduler) syncTarget(t Target) error {
+	local, err := ListArchives(s.cfg.Dir)
+	if err != nil {
+		return err
+	}
+	remote, err := t.List()
+	if err != nil {
+		return errors.Wrap(err, "could not list archives")
+	}
+	stored := map[string]bool{}
+	for _, a := range remote {
+		stored[a.Name] = true
+	}
+
+	slices.SortFunc(local, func(a, b Archive) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	for _, a := range local {
+		if stored[a.Name] {
+			continue
+		}
+		err := s.upload(t, a)
+		if err != nil {
+			return errors.Wrapf(err, "could not upload '%s'", a.Name)
+		}
+		s.cfg.Logger.Info("uploaded backup", slog.String("target", t.String()), slog.String("archive", a.Name), slog.Int64("size", a.Size))
+		remote = append(remote, a)
+	}
+
+	for _, a := range s.cfg.Retention.Expired(remote) {
+		err := t.Delete(a.Name)
+		if err != nil {
+			return errors.Wrapf(err, "could not remove '%s'", a.Name)
+		}
+		s.cfg.Logger.Info("removed expired backup", slog.String("target", t.String()), slog.String("archive", a.Name))
+	}
+
+	return nil
+}
+
+// upload copies archive a to t and checks the stored size, removing what
+// got stored on mismatch.
+func (s Scheduler) upload(t Target, a Archive) error {
+	f, err := os.Open(filepath.Join(s.cfg.Dir, a.Name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = t.Put(a.Name, f, a.Size)
+	if err != nil {
+		return err
+	}
+
+	size, err := t.Stat(a.Name)
+	if err != nil {
+		return errors.Wrap(err, "could not check upload")
+	}
+	if size >= 0 && size != a.Size {
+		err := t.Delete(a.Name)
+		if err != nil {
+			s.cfg.Logger.Warn("could not remove incomplete upload", slog.String("target", t.String()), slog.String("archive", a.Name), "error", err)
+		}
+		return errors.Errorf("uploaded %d bytes, target stored %d", a.Size, size)
+	}
+
+	return nil
+}
+
+type dirTarget struct {
+	dir string
+}
+
+// NewDirTarget returns a Target keeping archives in dir, e.g. a mounted
+// network share or an SFTP directory mounted with sshfs.
+func NewDirTarget(dir string) Target {
+	return dirTarget{dir: dir}
+}
+
+func (t dirTarget) String() string {
+	return "dir:" + t.dir
+}
+
+// Put writes the archive under a hidden name first, so an interrupted
+// copy is never listed.
+func (t dirTarget) Put(name string, r io.Reader, _ int64) error {
+	err := os.MkdirAll(t.dir, 0o750)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(t.dir, "."+name)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(t.dir, name))
+}
+
+func (t dirTarget) Stat(name string) (int64, error) {
+	fi, err := os.Stat(filepath.Join(t.dir, name))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (t dirTarget) List() ([]Archive, error) {
+	return ListArchives(t.dir)
+}
+
+func (t dirTarget) Delete(name string) error {
+	return os.Remove(filepath.Join(t.dir, name))
+}
+
+type s3Target struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// NewS3Target returns a Target keeping archives as objects of an
+// S3-compatible bucket, under keys starting with prefix.
+func NewS3Target(cfg s3.Config, prefix string) (Target, error) {
+	client, err := s3.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return s3Target{client: client, bucket: cfg.Bucket, prefix: prefix}, nil
+}
+
+func (t s3Target) String() string {
+	return "s3://" + t.bucket + "/" + t.prefix
+}
+
+func (t s3Target) Put(name string, r io.Reader, _ int64) error {
+	return t.client.PutObject(t.prefix+name, r)
+}
+
+func (t s3Target) Stat(name string) (int64, error) {
+	info, err := t.client.HeadObject(t.prefix + name)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (t s3Target) List() ([]Archive, error) {
+	objects, err := t.client.ListObjects(t.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var archives []Archive
+	for _, o := range objects {
+		a, ok := parseArchiveName(strings.TrimPrefix(o.Key, t.prefix))
+		if !ok {
+			continue
+		}
+		a.Size = o.Size
+		archives = append(archives, a)
+	}
+
+	return archives, nil
+}
+
+func (t s3Target) Delete(name string) error {
+	return t.client.DeleteObject(t.prefix + name)
+}
@@ -0,0 +1,250 @@
+package backup
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type VerifyOptions struct {
+	// Passphrase decrypts encrypted archives
+	Passphrase []byte
+	// CheckDatabase checks the integrity of the database file at path,
+	// opened read-only, and returns the number of expenses it holds
+	CheckDatabase func(path string) (int, error)
+	// LiveExpenses returns the number of expenses in the live database to
+	// compare with the archived one, it is optional
+	LiveExpenses func() (int, error)
+}
+
+// VerifyReport is the outcome of verifying an archive. Problems lists
+// everything that would make a restore fail or lose data.
+type VerifyReport struct {
+	Archive   string
+	CheckedAt time.Time
+	Manifest  Manifest
+	// Files is the number of files checked against the manifest
+	Files    int
+	Expenses int
+	// LiveExpenses is -1 when the live database was not compared
+	LiveExpenses int
+	Problems     []string
+}
+
+func (r VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Verify checks every file of an archive, following incremental archives
+// up to their full parent, against the manifest checksums and checks the
+// integrity of the archived database. An archive holding more expenses
+// than the live database is reported as a problem. The returned error is
+// set only when the archive could not be verified at all.
+func Verify(archive string, opts VerifyOptions) (VerifyReport, error) {
+	report := VerifyReport{
+		Archive:      filepath.Base(archive),
+		CheckedAt:    time.Now(),
+		LiveExpenses: -1,
+	}
+
+	c, err := openChain(archive, opts.Passphrase)
+	if err != nil {
+		return report, err
+	}
+	defer c.close()
+	report.Manifest = c[0].manifest
+
+	for _, f := range report.Manifest.Files {
+		link, ok := c.find(f)
+		if !ok {
+			report.Problems = append(report.Problems, fmt.Sprintf("'%s' is stored in no archive of the chain", f.Path))
+			continue
+		}
+		err := verifyFile(link.archive.Reader, f)
+		if err != nil {
+			report.Problems = append(report.Problems, fmt.Sprintf("'%s' in %s: %s", f.Path, link.name, err))
+			continue
+		}
+		report.Files++
+	}
+
+	databaseOK := false
+	if opts.CheckDatabase != nil {
+		report.Expenses, err = verifyDatabase(c, report.Manifest, opts.CheckDatabase)
+		if err != nil {
+			report.Problems = append(report.Problems, fmt.Sprintf("database: %s", err))
+		} else {
+			databaseOK = true
+		}
+	}
+	if opts.LiveExpenses != nil {
+		live, err := opts.LiveExpenses()
+		switch {
+		case err != nil:
+			report.Problems = append(report.Problems, fmt.Sprintf("could not count live expenses: %s", err))
+		case databaseOK && report.Expenses > live:
+			// expenses added since the backup explain the live database
+			// holding more, deleted ones rarely explain it holding fewer
+			report.LiveExpenses = live
+			report.Problems = append(report.Problems, fmt.Sprintf("archive holds %d expenses, the live database only %d", report.Expenses, live))
+		default:
+			report.LiveExpenses = live
+		}
+	}
+
+	return report, nil
+}
+
+// verifyFile reads f to the end, which also checks the zip CRC, and
+// compares it with the manifest. Version 1 manifests hold no checksums.
+func verifyFile(zr *zip.Reader, f ManifestFile) error {
+	r, err := zr.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, r)
+	if err != nil {
+		return err
+	}
+	if n != f.Size {
+		return errors.Errorf("size %d, manifest says %d", n, f.Size)
+	}
+	if f.SHA256 != "" && hex.EncodeToString(hash.Sum(nil)) != f.SHA256 {
+		return errors.New("checksum mismatch")
+	}
+
+	return nil
+}
+
+func verifyDatabase(c chain, m Manifest, check func(string) (int, error)) (int, error) {
+	link, ok := c.find(ManifestFile{Path: m.Database, SHA256: databaseChecksum(m)})
+	if !ok {
+		return 0, errors.New("not found in archive")
+	}
+
+	dir, err := os.MkdirTemp("", "acc2-verify-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp, err := extractTemp(link.archive.Reader, m.Database, "", dir)
+	if err != nil {
+		return 0, err
+	}
+
+	return check(tmp)
+}
+
+func databaseChecksum(m Manifest) string {
+	for _, f := range m.Files {
+		if f.Path == m.Database {
+			return f.SHA256
+		}
+	}
+	return ""
+}
+
+type VerifierConfig struct {
+	// Dir holds the archives, the newest one is verified on each run
+	Dir     string
+	Options VerifyOptions
+	Logger  *slog.Logger
+}
+
+// Verifier periodically verifies the newest archive and keeps the report
+// of the last run.
+type Verifier struct {
+	cfg VerifierConfig
+
+	mu   *sync.Mutex
+	last *VerifyReport
+}
+
+func NewVerifier(cfg VerifierConfig) Verifier {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	return Verifier{cfg: cfg, mu: &sync.Mutex{}, last: &VerifyReport{}}
+}
+
+// Run verifies the newest archive right away and then every interval
+// until ctx is done.
+func (v Verifier) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_, err := v.VerifyLatest()
+		if err != nil {
+			v.cfg.Logger.Error("backup verification failed", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			v.cfg.Logger.Info("stopping backup verifier")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// VerifyLatest verifies the newest archive of Dir. An empty report is
+// returned while Dir holds no archives yet.
+func (v Verifier) VerifyLatest() (VerifyReport, error) {
+	archives, err := ListArchives(v.cfg.Dir)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	if len(archives) == 0 {
+		v.cfg.Logger.Info("no backup archives to verify", slog.String("dir", v.cfg.Dir))
+		return VerifyReport{}, nil
+	}
+	latest := slices.MaxFunc(archives, func(a, b Archive) int { return a.CreatedAt.Compare(b.CreatedAt) })
+
+	report, err := Verify(filepath.Join(v.cfg.Dir, latest.Name), v.cfg.Options)
+	if err != nil {
+		report.Problems = append(report.Problems, err.Error())
+	}
+	v.mu.Lock()
+	*v.last = report
+	v.mu.Unlock()
+
+	if err != nil {
+		return report, err
+	}
+
+	attrs := []any{
+		slog.String("archive", report.Archive),
+		slog.Int("files", report.Files),
+		slog.Int("expenses", report.Expenses),
+		slog.Int("live_expenses", report.LiveExpenses),
+	}
+	if !report.OK() {
+		v.cfg.Logger.Error("backup verification found problems", append(attrs, slog.Any("problems", report.Problems))...)
+	} else {
+		v.cfg.Logger.Info("backup verified", attrs...)
+	}
+
+	return report, nil
+}
+
+// LastReport returns the report of the last run, if any.
+func (v Verifier) LastReport() (VerifyReport, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return *v.last, v.last.Archive != ""
+}
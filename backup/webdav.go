@@ -0,0 +1,235 @@
+package backup
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type WebDAVConfig struct {
+	// URL of the collection archives are kept in
+	URL      string
+	Username string
+	Password string
+	// HTTPClient defaults to a client with a generous timeout
+	HTTPClient *http.Client
+}
+
+type webDAVTarget struct {
+	base   *url.URL
+	user   string
+	pass   string
+	client *http.Client
+}
+
+// NewWebDAVTarget returns a Target keeping archives in a WebDAV collection,
+// which is created when missing.
+func NewWebDAVTarget(cfg WebDAVConfig) (Target, error) {
+	base, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid webdav url")
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, errors.Errorf("unsupported webdav url scheme '%s'", base.Scheme)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	base.RawPath = ""
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: time.Hour}
+	}
+
+	return webDAVTarget{base: base, user: cfg.Username, pass: cfg.Password, client: cfg.HTTPClient}, nil
+}
+
+func (t webDAVTarget) String() string {
+	return t.base.Redacted()
+}
+
+func (t webDAVTarget) Put(name string, r io.Reader, size int64) error {
+	req, err := t.request("PUT", name, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	resp, err := t.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Stat returns the getcontentlength property of the archive, HEAD
+// responses of chunked bodies leave the size out.
+func (t webDAVTarget) Stat(name string) (int64, error) {
+	resp, err := t.propfind(name, "0")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, r := range resp.Responses {
+		if size, ok := r.contentLength(); ok {
+			return size, nil
+		}
+	}
+	return -1, nil
+}
+
+func (t webDAVTarget) List() ([]Archive, error) {
+	resp, err := t.propfind("", "1")
+	if statusOf(err) == http.StatusNotFound {
+		return nil, t.createCollection()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var archives []Archive
+	for _, r := range resp.Responses {
+		href, err := url.PathUnescape(r.Href)
+		if err != nil {
+			continue
+		}
+		a, ok := parseArchiveName(path.Base(href))
+		if !ok {
+			continue
+		}
+		a.Size, _ = r.contentLength()
+		archives = append(archives, a)
+	}
+
+	return archives, nil
+}
+
+type multistatus struct {
+	Responses []propResponse `xml:"response"`
+}
+
+type propResponse struct {
+	Href     string `xml:"href"`
+	Propstat []struct {
+		Prop struct {
+			ContentLength *int64 `xml:"getcontentlength"`
+		} `xml:"prop"`
+		Status string `xml:"status"`
+	} `xml:"propstat"`
+}
+
+// contentLength returns the getcontentlength property found in r.
+func (r propResponse) contentLength() (int64, bool) {
+	for _, ps := range r.Propstat {
+		if strings.Contains(ps.Status, " 200 ") && ps.Prop.ContentLength != nil {
+			return *ps.Prop.ContentLength, true
+		}
+	}
+	return 0, false
+}
+
+// propfind requests the getcontentlength property of name, of the members
+// of the collection too with depth 1.
+func (t webDAVTarget) propfind(name, depth string) (multistatus, error) {
+	req, err := t.request("PROPFIND", name, strings.NewReader(
+		`<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><getcontentlength/></prop></propfind>`,
+	))
+	if err != nil {
+		return multistatus{}, err
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := t.do(req)
+	if err != nil {
+		return multistatus{}, err
+	}
+	defer resp.Body.Close()
+
+	var ms multistatus
+	err = xml.NewDecoder(resp.Body).Decode(&ms)
+	if err != nil {
+		return multistatus{}, errors.Wrap(err, "could not decode webdav properties")
+	}
+	return ms, nil
+}
+
+func (t webDAVTarget) Delete(name string) error {
+	req, err := t.request("DELETE", name, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (t webDAVTarget) createCollection() error {
+	req, err := t.request("MKCOL", "", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.do(req)
+	if err != nil {
+		return errors.Wrap(err, "could not create collection")
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (t webDAVTarget) request(method, name string, body io.Reader) (*http.Request, error) {
+	u := t.base.JoinPath(name)
+	if name == "" {
+		u = t.base
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create request")
+	}
+	if t.user != "" {
+		req.SetBasicAuth(t.user, t.pass)
+	}
+	return req, nil
+}
+
+// do sends req, returning a *webDAVError for non 2xx responses.
+func (t webDAVTarget) do(req *http.Request) (*http.Response, error) {
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s request failed", req.Method)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return nil, &webDAVError{Method: req.Method, StatusCode: resp.StatusCode}
+}
+
+type webDAVError struct {
+	Method     string
+	StatusCode int
+}
+
+func (e *webDAVError) Error() string {
+	return fmt.Sprintf("webdav: %s: status %d", e.Method, e.StatusCode)
+}
+
+func statusOf(err error) int {
+	var e *webDAVError
+	if errors.As(err, &e) {
+		return e.StatusCode
+	}
+	return 0
+}
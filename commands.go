@@ -0,0 +1,710 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/matmazurk/acc2/backup"
+	"github.com/matmazurk/acc2/db"
+	"github.com/matmazurk/acc2/imagestore"
+	"github.com/matmazurk/acc2/model"
+)
+
+// runCommand runs the named subcommand and returns the process exit code.
+func runCommand(name string, args []string) int {
+	commands := map[string]func(args []string) error{
+		"rotate-key": rotateKey,
+		"restore":    restore,
+		"backup":     backupCommand,
+		"user":       userCommand,
+		"payer":      payerCommand,
+		"ledger":     ledgerCommand,
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n", name)
+		return 2
+	}
+
+	err := cmd(args)
+	if err != nil {
+		slog.Error("command failed", slog.String("command", name), "error", err)
+		return 1
+	}
+
+	return 0
+}
+
+// rotateKey re-encrypts all stored photos from the currently configured
+// key (or plain photos when none) to a new key.
+func rotateKey(args []string) error {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	f := flags{}
+	f.registerStoreFlags(fs)
+	newKeyFile := fs.String("new-key-file", "", "file with the key photos are encrypted with from now on")
+	decrypt := fs.Bool("decrypt", false, "store photos unencrypted instead of using a new key")
+	fs.Parse(args)
+
+	if *newKeyFile == "" && !*decrypt {
+		return fmt.Errorf("either -new-key-file or -decrypt is required")
+	}
+
+	backend, err := openRawImagestoreBackend(f)
+	if err != nil {
+		return fmt.Errorf("could not open imagestore: %w", err)
+	}
+	oldKey, err := loadKey(f.storeKeyFile, storeKeyEnv)
+	if err != nil {
+		return err
+	}
+	var newKey []byte
+	if !*decrypt {
+		newKey, err = loadKey(*newKeyFile, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	rotated, err := imagestore.RotateKey(backend, oldKey, newKey, slog.Default())
+	if err != nil {
+		return fmt.Errorf("rotated %d photos before failing: %w", rotated, err)
+	}
+	slog.Info("photos key rotated", slog.Int("rotated", rotated))
+
+	return nil
+}
+
+// restore puts the database and photos of a backup archive in place.
+func restore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: acc2 restore [flags] <archive>")
+		fs.PrintDefaults()
+	}
+	dbFilename := fs.String("db", "exps.db", "expenses database filename")
+	storeDir := fs.String("store", ".", "imagestore directory")
+	dryRun := fs.Bool("dry-run", false, "only print what would be restored")
+	force := fs.Bool("force", false, "restore into a non-empty target, overwriting existing database and photos")
+	passphraseFile := fs.String("passphrase-file", "", "file with the passphrase of encrypted archives, "+backupPassphraseEnv+" is used when not set")
+	positional := parseInterspersed(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("exactly one archive expected")
+	}
+
+	passphrase, err := loadSecret(*passphraseFile, backupPassphraseEnv)
+	if err != nil {
+		return err
+	}
+	latest, err := db.LatestSchemaVersion()
+	if err != nil {
+		return err
+	}
+	plan, err := backup.Restore(positional[0], backup.RestoreOptions{
+		DBPath:           *dbFilename,
+		StoreDir:         *storeDir,
+		MaxSchemaVersion: latest,
+		Migrate: func(path string) error {
+			c, err := db.New(path)
+			if err != nil {
+				return err
+			}
+			return c.Close()
+		},
+		DryRun:     *dryRun,
+		Force:      *force,
+		Passphrase: passphrase,
+	})
+	if err != nil {
+		if errors.Is(err, backup.ErrTargetNotEmpty) {
+			return fmt.Errorf("%w, use -force to overwrite", err)
+		}
+		if errors.Is(err, backup.ErrPassphraseRequired) {
+			return fmt.Errorf("%w, use -passphrase-file or %s", err, backupPassphraseEnv)
+		}
+		return err
+	}
+
+	fmt.Printf("archive created at %s, schema version %d\n", plan.Manifest.CreatedAt.Format(time.RFC3339), plan.Manifest.SchemaVersion)
+	for _, s := range plan.Steps {
+		note := ""
+		if s.Exists {
+			note = " (overwrite)"
+		}
+		fmt.Printf("%s (from %s) -> %s, %d bytes%s\n", s.Entry, s.Archive, s.Dst, s.Size, note)
+	}
+	if *dryRun {
+		fmt.Println("dry run, nothing restored")
+	}
+
+	return nil
+}
+
+// backupCommand runs backup subcommands.
+func backupCommand(args []string) error {
+	subcommands := map[string]func(args []string) error{
+		"verify": verifyBackup,
+		"report": reportBackup,
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("usage: acc2 backup verify|report [flags] <archive>")
+	}
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown backup command '%s'", args[0])
+	}
+
+	return cmd(args[1:])
+}
+
+// verifyBackup checks an archive against its manifest and the integrity of
+// its database, comparing it with the live database when there is one.
+func verifyBackup(args []string) error {
+	fs := flag.NewFlagSet("backup verify", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: acc2 backup verify [flags] <archive>")
+		fs.PrintDefaults()
+	}
+	dbFilename := fs.String("db", "exps.db", "live expenses database filename, compared when it exists")
+	passphraseFile := fs.String("passphrase-file", "", "file with the passphrase of encrypted archives, "+backupPassphraseEnv+" is used when not set")
+	positional := parseInterspersed(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("exactly one archive expected")
+	}
+
+	passphrase, err := loadSecret(*passphraseFile, backupPassphraseEnv)
+	if err != nil {
+		return err
+	}
+	opts := backup.VerifyOptions{
+		Passphrase:    passphrase,
+		CheckDatabase: db.CheckFile,
+	}
+	if _, err := os.Stat(*dbFilename); err == nil {
+		opts.LiveExpenses = func() (int, error) { return db.CheckFile(*dbFilename) }
+	}
+
+	report, err := backup.Verify(positional[0], opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("archive created at %s, schema version %d\n", report.Manifest.CreatedAt.Format(time.RFC3339), report.Manifest.SchemaVersion)
+	fmt.Printf("%d of %d files match the manifest\n", report.Files, len(report.Manifest.Files))
+	fmt.Printf("%d expenses archived\n", report.Expenses)
+	if report.LiveExpenses >= 0 {
+		fmt.Printf("%d expenses in the live database\n", report.LiveExpenses)
+	}
+	for _, p := range report.Problems {
+		fmt.Printf("problem: %s\n", p)
+	}
+	if !report.OK() {
+		return fmt.Errorf("archive failed verification with %d problems", len(report.Problems))
+	}
+	fmt.Println("archive verified")
+
+	return nil
+}
+
+// reportBackup lists what went into an archive.
+func reportBackup(args []string) error {
+	fs := flag.NewFlagSet("backup report", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: acc2 backup report [flags] <archive>")
+		fs.PrintDefaults()
+	}
+	passphraseFile := fs.String("passphrase-file", "", "file with the passphrase of encrypted archives, "+backupPassphraseEnv+" is used when not set")
+	positional := parseInterspersed(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("exactly one archive expected")
+	}
+
+	passphrase, err := loadSecret(*passphraseFile, backupPassphraseEnv)
+	if err != nil {
+		return err
+	}
+	m, err := backup.ReadManifestFile(positional[0], passphrase)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("archive created at %s", m.CreatedAt.Format(time.RFC3339))
+	if m.Incremental() {
+		fmt.Printf(", incremental on %s", m.Parent)
+	}
+	fmt.Println()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "path\tfiles\tbytes\tstored files\tstored bytes\t")
+	var total backup.SizeEntry
+	for _, e := range m.SizeReport() {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t\n", e.Path, e.Files, e.Bytes, e.StoredFiles, e.StoredBytes)
+		total.Files += e.Files
+		total.Bytes += e.Bytes
+		total.StoredFiles += e.StoredFiles
+		total.StoredBytes += e.StoredBytes
+	}
+	fmt.Fprintf(tw, "total\t%d\t%d\t%d\t%d\t\n", total.Files, total.Bytes, total.StoredFiles, total.StoredBytes)
+
+	return tw.Flush()
+}
+
+// userCommand runs user subcommands.
+func userCommand(args []string) error {
+	subcommands := map[string]func(args []string) error{
+		"add":    addUser,
+		"passwd": setPassword,
+		"list":   listUsers,
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("usage: acc2 user add|passwd|list [flags] [name]")
+	}
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown user command '%s'", args[0])
+	}
+
+	return cmd(args[1:])
+}
+
+// addUser creates an account able to log in.
+func addUser(args []string) error {
+	fs := flag.NewFlagSet("user add", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: acc2 user add [flags] <name>")
+		fs.PrintDefaults()
+	}
+	dbFilename := fs.String("db", "exps.db", "expenses database filename")
+	admin := fs.Bool("admin", false, "let the user access admin pages")
+	ledger := fs.String("ledger", "", "ledger to make the user a member of")
+	roleName := fs.String("role", string(model.RoleEditor), "role of the user in the ledger, one of viewer, editor and owner")
+	passwordFile := fs.String("password-file", "", "file with the password, read from stdin when not set")
+	positional := parseInterspersed(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("exactly one name expected")
+	}
+
+	role, err := model.ParseRole(*roleName)
+	if err != nil {
+		return err
+	}
+	password, err := readPassword(*passwordFile)
+	if err != nil {
+		return err
+	}
+	u, err := model.NewUser(positional[0], password, *admin)
+	if err != nil {
+		return err
+	}
+
+	c, err := db.New(*dbFilename)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if *ledger != "" {
+		_, err = c.GetLedger(*ledger)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.CreateUser(u)
+	if err != nil {
+		return err
+	}
+	if *ledger == "" {
+		fmt.Printf("user '%s' created, grant a ledger with 'acc2 ledger grant -role <role> <ledger> %s'\n", u.Name, u.Name)
+		return nil
+	}
+	err = c.GrantLedger(*ledger, u.Name, role)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("user '%s' created as %s of ledger '%s'\n", u.Name, role, *ledger)
+
+	return nil
+}
+
+// setPassword replaces the password of a user, logging the user out.
+func setPassword(args []string) error {
+	fs := flag.NewFlagSet("user passwd", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: acc2 user passwd [flags] <name>")
+		fs.PrintDefaults()
+	}
+	dbFilename := fs.String("db", "exps.db", "expenses database filename")
+	passwordFile := fs.String("password-file", "", "file with the new password, read from stdin when not set")
+	positional := parseInterspersed(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("exactly one name expected")
+	}
+
+	password, err := readPassword(*passwordFile)
+	if err != nil {
+		return err
+	}
+	u, err := model.NewUser(positional[0], password, false)
+	if err != nil {
+		return err
+	}
+
+	c, err := db.New(*dbFilename)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	err = c.SetPassword(u.Name, u.PasswordHash)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("password of '%s' changed\n", u.Name)
+
+	return nil
+}
+
+func listUsers(args []string) error {
+	fs := flag.NewFlagSet("user list", flag.ExitOnError)
+	dbFilename := fs.String("db", "exps.db", "expenses database filename")
+	fs.Parse(args)
+
+	c, err := db.New(*dbFilename)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	users, err := c.ListUsers()
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		role := ""
+		if u.Admin {
+			role = " (admin)"
+		}
+		fmt.Printf("%s%s, created at %s\n", u.Name, role, u.CreatedAt.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// payerCommand runs payer subcommands.
+func payerCommand(args []string) error {
+	subcommands := map[string]func(args []string) error{
+		"add":  addPayer,
+		"link": linkPayer,
+		"list": listPayers,
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("usage: acc2 payer add|link|list [flags] [name] [user]")
+	}
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown payer command '%s'", args[0])
+	}
+
+	return cmd(args[1:])
+}
+
+// addPayer creates a payer, optionally linked to a user.
+func addPayer(args []string) error {
+	fs := flag.NewFlagSet("payer add", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: acc2 payer add [flags] <name>")
+		fs.PrintDefaults()
+	}
+	dbFilename := fs.String("db", "exps.db", "expenses database filename")
+	ledgerName := fs.String("ledger", "default", "ledger of the payer")
+	user := fs.String("user", "", "user to link the payer to")
+	positional := parseInterspersed(fs, args)
+	if len(positional) != 1 || strings.TrimSpace(positional[0]) == "" {
+		fs.Usage()
+		return fmt.Errorf("exactly one name expected")
+	}
+	name := strings.TrimSpace(positional[0])
+
+	c, err := db.New(*dbFilename)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ledger, err := c.GetLedger(*ledgerName)
+	if err != nil {
+		return err
+	}
+	if *user != "" {
+		err = c.CreateLinkedPayer(ledger.ID, name, *user)
+		if err != nil {
+			return fmt.Errorf("could not create payer: %w", err)
+		}
+		fmt.Printf("payer '%s' created for user '%s'\n", name, *user)
+		return nil
+	}
+	err = c.CreatePayer(ledger.ID, name)
+	if err != nil {
+		return fmt.Errorf("could not create payer: %w", err)
+	}
+	fmt.Printf("payer '%s' created\n", name)
+
+	return nil
+}
+
+// linkPayer links a payer to a user, or unlinks it when no user is given.
+func linkPayer(args []string) error {
+	fs := flag.NewFlagSet("payer link", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: acc2 payer link [flags] <name> [user]")
+		fs.PrintDefaults()
+	}
+	dbFilename := fs.String("db", "exps.db", "expenses database filename")
+	ledgerName := fs.String("ledger", "default", "ledger of the payer")
+	positional := parseInterspersed(fs, args)
+	if len(positional) != 1 && len(positional) != 2 {
+		fs.Usage()
+		return fmt.Errorf("payer name and optional user expected")
+	}
+	name := positional[0]
+	var user string
+	if len(positional) == 2 {
+		user = positional[1]
+	}
+
+	c, err := db.New(*dbFilename)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ledger, err := c.GetLedger(*ledgerName)
+	if err != nil {
+		return err
+	}
+	err = c.LinkPayer(ledger.ID, name, user)
+	if err != nil {
+		return err
+	}
+	if user == "" {
+		fmt.Printf("payer '%s' unlinked\n", name)
+		return nil
+	}
+	fmt.Printf("payer '%s' linked to user '%s'\n", name, user)
+
+	return nil
+}
+
+func listPayers(args []string) error {
+	fs := flag.NewFlagSet("payer list", flag.ExitOnError)
+	dbFilename := fs.String("db", "exps.db", "expenses database filename")
+	ledgerName := fs.String("ledger", "default", "ledger of the payers")
+	fs.Parse(args)
+
+	c, err := db.New(*dbFilename)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ledger, err := c.GetLedger(*ledgerName)
+	if err != nil {
+		return err
+	}
+	payers, err := c.ListPayerLinks(ledger.ID)
+	if err != nil {
+		return err
+	}
+	for _, p := range payers {
+		if p.User == "" {
+			fmt.Println(p.Name)
+			continue
+		}
+		fmt.Printf("%s, user %s\n", p.Name, p.User)
+	}
+
+	return nil
+}
+
+// ledgerCommand runs ledger subcommands.
+func ledgerCommand(args []string) error {
+	subcommands := map[string]func(args []string) error{
+		"add":    addLedger,
+		"grant":  grantLedger,
+		"revoke": revokeLedger,
+		"list":   listLedgers,
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("usage: acc2 ledger add|grant|revoke|list [flags] [name] [user]")
+	}
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown ledger command '%s'", args[0])
+	}
+
+	return cmd(args[1:])
+}
+
+// addLedger creates a ledger, optionally with owners.
+func addLedger(args []string) error {
+	fs := flag.NewFlagSet("ledger add", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: acc2 ledger add [flags] <name> [user...]")
+		fs.PrintDefaults()
+	}
+	dbFilename := fs.String("db", "exps.db", "expenses database filename")
+	positional := parseInterspersed(fs, args)
+	if len(positional) == 0 || strings.TrimSpace(positional[0]) == "" {
+		fs.Usage()
+		return fmt.Errorf("ledger name expected")
+	}
+	name := strings.TrimSpace(positional[0])
+
+	c, err := db.New(*dbFilename)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	err = c.CreateLedger(name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("ledger '%s' created\n", name)
+	for _, user := range positional[1:] {
+		err = c.GrantLedger(name, user, model.RoleOwner)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("user '%s' granted ledger '%s' as owner\n", user, name)
+	}
+
+	return nil
+}
+
+// grantLedger makes a user a member of a ledger, or changes the role of a
+// member.
+func grantLedger(args []string) error {
+	fs := newMembershipFlagSet("grant")
+	roleName := fs.String("role", string(model.RoleEditor), "role of the user in the ledger, one of viewer, editor and owner")
+	return changeMembership(fs, args, func(c db.Client, ledger, user string) error {
+		role, err := model.ParseRole(*roleName)
+		if err != nil {
+			return err
+		}
+		err = c.GrantLedger(ledger, user, role)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("user '%s' granted ledger '%s' as %s\n", user, ledger, role)
+		return nil
+	})
+}
+
+// revokeLedger removes a user from the members of a ledger.
+func revokeLedger(args []string) error {
+	return changeMembership(newMembershipFlagSet("revoke"), args, func(c db.Client, ledger, user string) error {
+		err := c.RevokeLedger(ledger, user)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("user '%s' revoked from ledger '%s'\n", user, ledger)
+		return nil
+	})
+}
+
+func newMembershipFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("ledger "+name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: acc2 ledger %s [flags] <ledger> <user>\n", name)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func changeMembership(fs *flag.FlagSet, args []string, change func(c db.Client, ledger, user string) error) error {
+	dbFilename := fs.String("db", "exps.db", "expenses database filename")
+	positional := parseInterspersed(fs, args)
+	if len(positional) != 2 {
+		fs.Usage()
+		return fmt.Errorf("ledger and user expected")
+	}
+
+	c, err := db.New(*dbFilename)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return change(c, positional[0], positional[1])
+}
+
+func listLedgers(args []string) error {
+	fs := flag.NewFlagSet("ledger list", flag.ExitOnError)
+	dbFilename := fs.String("db", "exps.db", "expenses database filename")
+	fs.Parse(args)
+
+	c, err := db.New(*dbFilename)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ledgers, err := c.ListLedgers()
+	if err != nil {
+		return err
+	}
+	for _, l := range ledgers {
+		fmt.Println(l.Name)
+	}
+
+	return nil
+}
+
+// readPassword reads a password from file, or the first line of stdin
+// when file is empty.
+func readPassword(file string) (string, error) {
+	if file != "" {
+		raw, err := loadSecret(file, "")
+		return string(raw), err
+	}
+
+	fmt.Fprint(os.Stderr, "password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("could not read password: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// parseInterspersed parses flags placed before, between and after
+// positional arguments, returning the positional ones.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
@@ -3,11 +3,14 @@ package db
 import (
 	"database/sql"
 	"fmt"
+	"net/url"
+	"strings"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/matmazurk/acc2/model"
 	"github.com/pkg/errors"
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 type Client struct {
@@ -28,21 +31,55 @@ func New(path string) (Client, error) {
 	return Client{db: db}, nil
 }
 
-func (d Client) Insert(e model.Expense) error {
-	p, err := d.getPayer(e.Payer())
+func (d Client) Close() error {
+	return d.db.Close()
+}
+
+// SchemaVersion returns the version of the last applied migration. A
+// migration that failed halfway leaves the database dirty, which is
+// reported as an error.
+func (d Client) SchemaVersion() (uint, error) {
+	var schema struct {
+		Version uint `db:"version"`
+		Dirty   bool `db:"dirty"`
+	}
+	err := d.db.Get(&schema, "SELECT version, dirty FROM schema_migrations LIMIT 1")
+	if err != nil {
+		return 0, fmt.Errorf("could not get schema version: %w", err)
+	}
+	if schema.Dirty {
+		return schema.Version, fmt.Errorf("schema version %d is dirty, its migration failed halfway", schema.Version)
+	}
+
+	return schema.Version, nil
+}
+
+// Snapshot writes a transactionally consistent copy of the database
+// to path, which must not exist.
+func (d Client) Snapshot(path string) error {
+	_, err := d.db.Exec("VACUUM INTO ?", path)
+	if err != nil {
+		return fmt.Errorf("could not snapshot database: %w", err)
+	}
+
+	return nil
+}
+
+func (d Client) Insert(ledgerID int64, e model.Expense) error {
+	p, err := d.getPayer(ledgerID, e.Payer())
 	if err != nil {
 		return err
 	}
 
-	c, err := d.getCategory(e.Category())
+	c, err := d.getCategory(ledgerID, e.Category())
 	if err != nil {
 		return err
 	}
 
 	_, err = d.db.Exec(`
-		INSERT INTO expense(id, category_id, payer_id, amount, currency, description, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		e.ID(), c.ID, p.ID, e.Amount(), e.Currency(), e.Description(), e.CreatedAt(),
+		INSERT INTO expense(id, ledger_id, category_id, payer_id, amount, currency, description, created_at, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, (SELECT id FROM user WHERE name = ?))`,
+		e.ID(), ledgerID, c.ID, p.ID, e.Amount(), e.Currency(), e.Description(), e.CreatedAt(), e.CreatedBy(),
 	)
 	if err != nil {
 		return fmt.Errorf("could not insert new expense: %w", err)
@@ -51,42 +88,209 @@ func (d Client) Insert(e model.Expense) error {
 	return nil
 }
 
-func (d Client) SelectExpenses() ([]model.Expense, error) {
+func (d Client) SelectExpenses(ledgerID int64) ([]model.Expense, error) {
 	var exps []expense
-	err := d.db.Select(&exps, "SELECT * FROM expenses ORDER BY created_at DESC")
+	err := d.db.Select(&exps, "SELECT * FROM expenses WHERE ledger_id = ? ORDER BY created_at DESC", ledgerID)
 	if err != nil {
 		return nil, fmt.Errorf("could not select expenses: %w", err)
 	}
 
 	es := make([]model.Expense, len(exps))
 	for i, e := range exps {
-		es[i], err = model.ExpenseBuilder{
-			Id:          e.ID,
-			Description: e.Description,
-			Payer:       e.Payer.Name,
-			Category:    e.CategoryID.Name,
-			Amount:      e.Amount,
-			Currency:    e.Currency,
-			CreatedAt:   e.CreatedAt,
-		}.Build()
+		es[i], err = e.toModel()
 	}
 
 	return es, nil
 }
 
-func (d Client) CreatePayer(name string) error {
-	_, err := d.db.Exec("INSERT INTO payer(name) VALUES (?)", name)
-	return err
+// GetExpense returns the expense with id of the ledger, or an error
+// matching model.ErrNotFound.
+func (d Client) GetExpense(ledgerID int64, id string) (model.Expense, error) {
+	var e expense
+	err := d.db.Get(&e, "SELECT * FROM expenses WHERE ledger_id = ? AND id = ?", ledgerID, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.Expense{}, fmt.Errorf("expense '%s': %w", id, model.ErrNotFound)
+		}
+		return model.Expense{}, fmt.Errorf("could not get expense: %w", err)
+	}
+
+	return e.toModel()
+}
+
+// QueryExpenses returns a page of expenses of the ledger matching q,
+// newest first, together with the number of all matching expenses.
+func (d Client) QueryExpenses(ledgerID int64, q model.ExpenseQuery) ([]model.Expense, int, error) {
+	where := []string{"ledger_id = ?"}
+	args := []any{ledgerID}
+	if q.Payer != "" {
+		where = append(where, `"payer.name" = ?`)
+		args = append(args, q.Payer)
+	}
+	if q.Category != "" {
+		where = append(where, `"category.name" = ?`)
+		args = append(args, q.Category)
+	}
+	if !q.From.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, q.From)
+	}
+	if !q.To.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, q.To)
+	}
+	cond := " WHERE " + strings.Join(where, " AND ")
+
+	var total int
+	err := d.db.Get(&total, "SELECT COUNT(*) FROM expenses"+cond, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not count expenses: %w", err)
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	var exps []expense
+	err = d.db.Select(&exps, "SELECT * FROM expenses"+cond+" ORDER BY created_at DESC LIMIT ? OFFSET ?", append(args, limit, q.Offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not select expenses: %w", err)
+	}
+
+	es := make([]model.Expense, len(exps))
+	for i, e := range exps {
+		es[i], err = e.toModel()
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return es, total, nil
+}
+
+// UpdateExpense replaces all fields of the stored expense of the ledger
+// with the ID of e, except who created it.
+func (d Client) UpdateExpense(ledgerID int64, e model.Expense) error {
+	p, err := d.getPayer(ledgerID, e.Payer())
+	if err != nil {
+		return err
+	}
+
+	c, err := d.getCategory(ledgerID, e.Category())
+	if err != nil {
+		return err
+	}
+
+	res, err := d.db.Exec(`
+		UPDATE expense SET category_id = ?, payer_id = ?, amount = ?, currency = ?, description = ?, created_at = ?
+		WHERE id = ? AND ledger_id = ?`,
+		c.ID, p.ID, e.Amount(), e.Currency(), e.Description(), e.CreatedAt(), e.ID(), ledgerID,
+	)
+	if err != nil {
+		return fmt.Errorf("could not update expense: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not update expense: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("expense '%s': %w", e.ID(), model.ErrNotFound)
+	}
+
+	return nil
+}
+
+func (d Client) ExpenseIDs() ([]string, error) {
+	var ids []string
+	err := d.db.Select(&ids, "SELECT id FROM expense")
+	if err != nil {
+		return nil, fmt.Errorf("could not select expense ids: %w", err)
+	}
+
+	return ids, nil
+}
+
+func (d Client) CountExpenses() (int, error) {
+	var count int
+	err := d.db.Get(&count, "SELECT COUNT(*) FROM expense")
+	if err != nil {
+		return 0, fmt.Errorf("could not count expenses: %w", err)
+	}
+
+	return count, nil
+}
+
+// CheckFile opens the database file at path read-only, runs an integrity
+// check on it and returns the number of expenses it holds.
+func CheckFile(path string) (int, error) {
+	// ?, # and % in the path would be taken for parts of the uri
+	db, err := sqlx.Open("sqlite", "file:"+(&url.URL{Path: path}).EscapedPath()+"?mode=ro")
+	if err != nil {
+		return 0, fmt.Errorf("could not open database: %w", err)
+	}
+	defer db.Close()
+
+	var problems []string
+	err = db.Select(&problems, "PRAGMA integrity_check")
+	if err != nil {
+		return 0, fmt.Errorf("could not check integrity: %w", err)
+	}
+	if len(problems) != 1 || problems[0] != "ok" {
+		return 0, fmt.Errorf("integrity check failed: %s", strings.Join(problems, "; "))
+	}
+
+	return Client{db: db}.CountExpenses()
 }
 
-func (d Client) CreateCategory(name string) error {
-	_, err := d.db.Exec("INSERT INTO category(name) VALUES (?)", name)
+// CreatePayer creates the payer of the ledger with name, creating an
+// existing one fails with model.ErrInUse.
+func (d Client) CreatePayer(ledgerID int64, name string) error {
+	_, err := d.db.Exec("INSERT INTO payer(ledger_id, name) VALUES (?, ?)", ledgerID, name)
+	return inUse(err, "payer '%s'", name)
+}
+
+// CreateLinkedPayer creates the payer of the ledger with name and links it
+// to the user with userName at once, nothing is created when linking
+// fails.
+func (d Client) CreateLinkedPayer(ledgerID int64, name, userName string) error {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO payer(ledger_id, name) VALUES (?, ?)", ledgerID, name)
+	if err != nil {
+		return inUse(err, "payer '%s'", name)
+	}
+	err = linkPayer(tx, ledgerID, name, userName)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CreateCategory creates the category of the ledger with name, creating an
+// existing one fails with model.ErrInUse.
+func (d Client) CreateCategory(ledgerID int64, name string) error {
+	_, err := d.db.Exec("INSERT INTO category(ledger_id, name) VALUES (?, ?)", ledgerID, name)
+	return inUse(err, "category '%s'", name)
+}
+
+// inUse wraps err with model.ErrInUse when it violates a unique constraint,
+// format and args name the record that already exists.
+func inUse(err error, format string, args ...any) error {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+		return fmt.Errorf(format+" already exists: %w", append(args, model.ErrInUse)...)
+	}
 	return err
 }
 
-func (d Client) ListPayers() ([]string, error) {
+func (d Client) ListPayers(ledgerID int64) ([]string, error) {
 	var payers []payer
-	err := d.db.Select(&payers, "SELECT * FROM payer")
+	err := d.db.Select(&payers, "SELECT * FROM payer WHERE ledger_id = ?", ledgerID)
 	if err != nil {
 		return nil, fmt.Errorf("could not get all payers: %w", err)
 	}
@@ -99,9 +303,92 @@ func (d Client) ListPayers() ([]string, error) {
 	return ret, nil
 }
 
-func (d Client) ListCategories() ([]string, error) {
+// ListPayerLinks returns payers of the ledger ordered by name, with the
+// names of the users they are linked to.
+func (d Client) ListPayerLinks(ledgerID int64) ([]model.Payer, error) {
+	var payers []struct {
+		Name string `db:"name"`
+		User string `db:"user"`
+	}
+	err := d.db.Select(&payers, `
+		SELECT p.name, COALESCE(u.name, '') AS user FROM payer p
+		LEFT JOIN user u ON u.id = p.user_id
+		WHERE p.ledger_id = ?
+		ORDER BY p.name`,
+		ledgerID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not list payers: %w", err)
+	}
+
+	ret := make([]model.Payer, len(payers))
+	for i, p := range payers {
+		ret[i] = model.Payer{Name: p.Name, User: p.User}
+	}
+
+	return ret, nil
+}
+
+// LinkPayer links the payer of the ledger with name to the user with
+// userName, or unlinks it when userName is empty. A user can be linked to
+// one payer of a ledger only, linking it to another one fails with
+// model.ErrInUse.
+func (d Client) LinkPayer(ledgerID int64, name, userName string) error {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = linkPayer(tx, ledgerID, name, userName)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func linkPayer(tx *sqlx.Tx, ledgerID int64, name, userName string) error {
+	var payerID uint
+	err := tx.Get(&payerID, "SELECT id FROM payer WHERE ledger_id = ? AND name = ?", ledgerID, name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("payer '%s': %w", name, model.ErrNotFound)
+		}
+		return fmt.Errorf("could not get payer: %w", err)
+	}
+
+	var userID sql.NullInt64
+	if userName != "" {
+		err = tx.Get(&userID, "SELECT id FROM user WHERE name = ?", userName)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("user '%s': %w", userName, model.ErrNotFound)
+			}
+			return fmt.Errorf("could not get user: %w", err)
+		}
+
+		var linked string
+		err = tx.Get(&linked, "SELECT name FROM payer WHERE ledger_id = ? AND user_id = ? AND id != ?", ledgerID, userID, payerID)
+		if err == nil {
+			return fmt.Errorf("user '%s' is linked to payer '%s': %w", userName, linked, model.ErrInUse)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("could not get linked payer: %w", err)
+		}
+	}
+
+	_, err = tx.Exec("UPDATE payer SET user_id = ? WHERE id = ?", userID, payerID)
+	if err != nil {
+		return fmt.Errorf("could not link payer: %w", inUse(err, "link of user '%s'", userName))
+	}
+
+	return nil
+}
+
+func (d Client) ListCategories(ledgerID int64) ([]string, error) {
 	var categories []category
-	err := d.db.Select(&categories, "SELECT * FROM category")
+	err := d.db.Select(&categories, "SELECT * FROM category WHERE ledger_id = ?", ledgerID)
 	if err != nil {
 		return nil, fmt.Errorf("could not get all categories: %w", err)
 	}
@@ -114,8 +401,8 @@ func (d Client) ListCategories() ([]string, error) {
 	return ret, nil
 }
 
-func (d Client) RemoveExpense(e model.Expense) error {
-	_, err := d.db.Exec("DELETE FROM expense WHERE id = ?", e.ID())
+func (d Client) RemoveExpense(ledgerID int64, e model.Expense) error {
+	_, err := d.db.Exec("DELETE FROM expense WHERE ledger_id = ? AND id = ?", ledgerID, e.ID())
 	if err != nil {
 		return fmt.Errorf("could not remove expense: %w", err)
 	}
@@ -123,9 +410,54 @@ func (d Client) RemoveExpense(e model.Expense) error {
 	return nil
 }
 
-func (d Client) getPayer(name string) (payer, error) {
+// RemovePayer removes the payer of the ledger with name, unless expenses
+// refer to it.
+func (d Client) RemovePayer(ledgerID int64, name string) error {
+	return d.removeUnused(ledgerID, "payer", "payer_id", name)
+}
+
+// RemoveCategory removes the category of the ledger with name, unless
+// expenses refer to it.
+func (d Client) RemoveCategory(ledgerID int64, name string) error {
+	return d.removeUnused(ledgerID, "category", "category_id", name)
+}
+
+func (d Client) removeUnused(ledgerID int64, table, column, name string) error {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var id uint
+	err = tx.Get(&id, "SELECT id FROM "+table+" WHERE ledger_id = ? AND name = ?", ledgerID, name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%s '%s': %w", table, name, model.ErrNotFound)
+		}
+		return fmt.Errorf("could not get %s: %w", table, err)
+	}
+
+	var used int
+	err = tx.Get(&used, "SELECT COUNT(*) FROM expense WHERE "+column+" = ?", id)
+	if err != nil {
+		return fmt.Errorf("could not count expenses of %s: %w", table, err)
+	}
+	if used > 0 {
+		return fmt.Errorf("%s '%s' has %d expenses: %w", table, name, used, model.ErrInUse)
+	}
+
+	_, err = tx.Exec("DELETE FROM "+table+" WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("could not remove %s: %w", table, err)
+	}
+
+	return tx.Commit()
+}
+
+func (d Client) getPayer(ledgerID int64, name string) (payer, error) {
 	var p payer
-	err := d.db.Get(&p, "SELECT * FROM payer WHERE name = ?", name)
+	err := d.db.Get(&p, "SELECT * FROM payer WHERE ledger_id = ? AND name = ?", ledgerID, name)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return p, fmt.Errorf("no such payer: '%s'", name)
@@ -136,9 +468,9 @@ func (d Client) getPayer(name string) (payer, error) {
 	return p, nil
 }
 
-func (d Client) getCategory(name string) (category, error) {
+func (d Client) getCategory(ledgerID int64, name string) (category, error) {
 	var c category
-	err := d.db.Get(&c, "SELECT * FROM category WHERE name = ?", name)
+	err := d.db.Get(&c, "SELECT * FROM category WHERE ledger_id = ? AND name = ?", ledgerID, name)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return c, fmt.Errorf("no such category: '%s'", name)
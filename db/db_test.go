@@ -1,6 +1,9 @@
 package db_test
 
 import (
+	"database/sql"
+	"os"
+	"path/filepath"
 	"slices"
 	"testing"
 	"time"
@@ -17,28 +20,44 @@ func TestDB(t *testing.T) {
 	c, err := db.New(dbFile)
 	require.NoError(t, err)
 
+	// the database file is kept between runs, a new ledger keeps them apart
+	ledgerName := uuid.NewString()
+	require.NoError(t, c.CreateLedger(ledgerName))
+	ledger, err := c.GetLedger(ledgerName)
+	require.NoError(t, err)
+
 	payer := uuid.NewString()
 	category := uuid.NewString()
 
+	t.Run("should_be_migrated_to_latest_schema_version", func(t *testing.T) {
+		latest, err := db.LatestSchemaVersion()
+		require.NoError(t, err)
+		require.NotZero(t, latest)
+
+		version, err := c.SchemaVersion()
+		require.NoError(t, err)
+		require.Equal(t, latest, version)
+	})
+
 	t.Run("should_properly_insert_list_payers", func(t *testing.T) {
-		err := c.CreatePayer(payer)
+		err := c.CreatePayer(ledger.ID, payer)
 		require.NoError(t, err)
-		err = c.CreatePayer(payer)
-		require.Error(t, err)
+		err = c.CreatePayer(ledger.ID, payer)
+		require.ErrorIs(t, err, model.ErrInUse)
 
-		payers, err := c.ListPayers()
+		payers, err := c.ListPayers(ledger.ID)
 		require.NoError(t, err)
 		idx := slices.IndexFunc(payers, func(name string) bool { return name == payer })
 		require.NotEqual(t, -1, idx)
 	})
 
 	t.Run("should_properly_insert_list_categories", func(t *testing.T) {
-		err := c.CreateCategory(category)
+		err := c.CreateCategory(ledger.ID, category)
 		require.NoError(t, err)
-		err = c.CreateCategory(category)
+		err = c.CreateCategory(ledger.ID, category)
 		require.Error(t, err)
 
-		categories, err := c.ListCategories()
+		categories, err := c.ListCategories(ledger.ID)
 		require.NoError(t, err)
 		idx := slices.IndexFunc(categories, func(name string) bool { return name == category })
 		require.NotEqual(t, -1, idx)
@@ -55,7 +74,7 @@ func TestDB(t *testing.T) {
 			CreatedAt:   now,
 		}.Build()
 		require.NoError(t, err)
-		err = c.Insert(exp1)
+		err = c.Insert(ledger.ID, exp1)
 		require.NoError(t, err)
 
 		exp2, err := model.ExpenseBuilder{
@@ -67,7 +86,7 @@ func TestDB(t *testing.T) {
 			CreatedAt:   now.Add(time.Minute),
 		}.Build()
 		require.NoError(t, err)
-		err = c.Insert(exp2)
+		err = c.Insert(ledger.ID, exp2)
 		require.NoError(t, err)
 
 		exp3, err := model.ExpenseBuilder{
@@ -79,7 +98,7 @@ func TestDB(t *testing.T) {
 			CreatedAt:   now.Add(time.Hour),
 		}.Build()
 		require.NoError(t, err)
-		err = c.Insert(exp3)
+		err = c.Insert(ledger.ID, exp3)
 		require.NoError(t, err)
 
 		expectedOrder := []model.Expense{
@@ -88,7 +107,7 @@ func TestDB(t *testing.T) {
 			exp1,
 		}
 
-		exps, err := c.SelectExpenses()
+		exps, err := c.SelectExpenses(ledger.ID)
 		require.NoError(t, err)
 
 		filteredExps := filterExpenses(exps, exp1.ID(), exp2.ID(), exp3.ID())
@@ -111,22 +130,431 @@ func TestDB(t *testing.T) {
 			CreatedAt:   now,
 		}.Build()
 		require.NoError(t, err)
-		err = c.Insert(exp)
+		err = c.Insert(ledger.ID, exp)
 		require.NoError(t, err)
 
-		exps, err := c.SelectExpenses()
+		exps, err := c.SelectExpenses(ledger.ID)
 		require.NoError(t, err)
 		idx := slices.IndexFunc(exps, func(e model.Expense) bool { return e.ID() == exp.ID() })
 		require.Positive(t, idx)
 
-		err = c.RemoveExpense(exp)
+		ids, err := c.ExpenseIDs()
+		require.NoError(t, err)
+		require.Contains(t, ids, exp.ID())
+
+		err = c.RemoveExpense(ledger.ID, exp)
 		require.NoError(t, err)
 
-		exps, err = c.SelectExpenses()
+		ids, err = c.ExpenseIDs()
+		require.NoError(t, err)
+		require.NotContains(t, ids, exp.ID())
+
+		exps, err = c.SelectExpenses(ledger.ID)
 		require.NoError(t, err)
 		idx = slices.IndexFunc(exps, func(e model.Expense) bool { return e.ID() == exp.ID() })
 		require.Equal(t, -1, idx)
 	})
+
+	t.Run("should_query_get_and_update_expenses", func(t *testing.T) {
+		queryPayer := uuid.NewString()
+		require.NoError(t, c.CreatePayer(ledger.ID, queryPayer))
+		loc, err := time.LoadLocation("Europe/Warsaw")
+		require.NoError(t, err)
+		base := time.Date(2024, time.March, 1, 12, 0, 0, 0, loc)
+
+		var ids []string
+		for i := range 3 {
+			exp, err := model.ExpenseBuilder{
+				Description: "query",
+				Payer:       queryPayer,
+				Category:    category,
+				Amount:      "1",
+				Currency:    "PLN",
+				CreatedAt:   base.AddDate(0, 0, i),
+			}.Build()
+			require.NoError(t, err)
+			require.NoError(t, c.Insert(ledger.ID, exp))
+			ids = append(ids, exp.ID())
+		}
+
+		exps, total, err := c.QueryExpenses(ledger.ID, model.ExpenseQuery{Payer: queryPayer, Limit: 2})
+		require.NoError(t, err)
+		require.Equal(t, 3, total)
+		require.Len(t, exps, 2)
+		require.Equal(t, ids[2], exps[0].ID())
+
+		exps, total, err = c.QueryExpenses(ledger.ID, model.ExpenseQuery{Payer: queryPayer, Limit: 2, Offset: 2})
+		require.NoError(t, err)
+		require.Equal(t, 3, total)
+		require.Len(t, exps, 1)
+		require.Equal(t, ids[0], exps[0].ID())
+
+		exps, total, err = c.QueryExpenses(ledger.ID, model.ExpenseQuery{
+			Payer:    queryPayer,
+			Category: category,
+			From:     base.AddDate(0, 0, 1),
+			To:       base.AddDate(0, 0, 2),
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, total)
+		require.Equal(t, ids[1], exps[0].ID())
+
+		_, total, err = c.QueryExpenses(ledger.ID, model.ExpenseQuery{Payer: queryPayer, Category: uuid.NewString()})
+		require.NoError(t, err)
+		require.Zero(t, total)
+
+		exp, err := c.GetExpense(ledger.ID, ids[0])
+		require.NoError(t, err)
+		updated, err := model.ExpenseBuilder{
+			Id:          exp.ID(),
+			Description: "updated",
+			Payer:       payer,
+			Category:    category,
+			Amount:      "2.50",
+			Currency:    "EUR",
+			CreatedAt:   exp.CreatedAt(),
+		}.Build()
+		require.NoError(t, err)
+		require.NoError(t, c.UpdateExpense(ledger.ID, updated))
+		exp, err = c.GetExpense(ledger.ID, ids[0])
+		require.NoError(t, err)
+		expensesEqual(t, updated, exp)
+
+		_, err = c.GetExpense(ledger.ID, uuid.NewString())
+		require.ErrorIs(t, err, model.ErrNotFound)
+		missing, err := model.ExpenseBuilder{Description: "d", Payer: payer, Category: category, Amount: "1", Currency: "PLN", CreatedAt: base}.Build()
+		require.NoError(t, err)
+		require.ErrorIs(t, c.UpdateExpense(ledger.ID, missing), model.ErrNotFound)
+	})
+
+	t.Run("should_remove_only_unused_payers_and_categories", func(t *testing.T) {
+		unused := uuid.NewString()
+		require.NoError(t, c.CreatePayer(ledger.ID, unused))
+		require.NoError(t, c.CreateCategory(ledger.ID, unused))
+
+		require.NoError(t, c.RemovePayer(ledger.ID, unused))
+		require.NoError(t, c.RemoveCategory(ledger.ID, unused))
+		payers, err := c.ListPayers(ledger.ID)
+		require.NoError(t, err)
+		require.NotContains(t, payers, unused)
+		categories, err := c.ListCategories(ledger.ID)
+		require.NoError(t, err)
+		require.NotContains(t, categories, unused)
+
+		require.ErrorIs(t, c.RemovePayer(ledger.ID, unused), model.ErrNotFound)
+		require.ErrorIs(t, c.RemoveCategory(ledger.ID, unused), model.ErrNotFound)
+		require.ErrorIs(t, c.RemovePayer(ledger.ID, payer), model.ErrInUse)
+		require.ErrorIs(t, c.RemoveCategory(ledger.ID, category), model.ErrInUse)
+	})
+
+	t.Run("should_create_get_and_list_users", func(t *testing.T) {
+		u, err := model.NewUser(uuid.NewString(), "some password", true)
+		require.NoError(t, err)
+		require.NoError(t, c.CreateUser(u))
+		require.Error(t, c.CreateUser(u))
+
+		got, err := c.GetUser(u.Name)
+		require.NoError(t, err)
+		require.NotZero(t, got.ID)
+		require.Equal(t, u.Name, got.Name)
+		require.True(t, got.Admin)
+		require.True(t, got.CheckPassword("some password"))
+		require.True(t, u.CreatedAt.Equal(got.CreatedAt))
+
+		_, err = c.GetUser(uuid.NewString())
+		require.ErrorIs(t, err, model.ErrNotFound)
+
+		users, err := c.ListUsers()
+		require.NoError(t, err)
+		idx := slices.IndexFunc(users, func(user model.User) bool { return user.Name == u.Name })
+		require.NotEqual(t, -1, idx)
+	})
+
+	t.Run("should_create_get_and_remove_sessions", func(t *testing.T) {
+		u, err := model.NewUser(uuid.NewString(), "some password", false)
+		require.NoError(t, err)
+		require.NoError(t, c.CreateUser(u))
+		u, err = c.GetUser(u.Name)
+		require.NoError(t, err)
+
+		now := time.Now()
+		valid := model.Session{TokenHash: uuid.NewString(), User: u, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+		expired := model.Session{TokenHash: uuid.NewString(), User: u, CreatedAt: now, ExpiresAt: now.Add(-time.Second)}
+		require.NoError(t, c.CreateSession(valid))
+		require.NoError(t, c.CreateSession(expired))
+
+		s, err := c.GetSession(valid.TokenHash)
+		require.NoError(t, err)
+		require.Equal(t, u.Name, s.User.Name)
+		require.Equal(t, u.ID, s.User.ID)
+		require.Equal(t, valid.ExpiresAt.Unix(), s.ExpiresAt.Unix())
+
+		_, err = c.GetSession(expired.TokenHash)
+		require.ErrorIs(t, err, model.ErrNotFound)
+
+		require.NoError(t, c.RemoveSession(valid.TokenHash))
+		_, err = c.GetSession(valid.TokenHash)
+		require.ErrorIs(t, err, model.ErrNotFound)
+	})
+
+	t.Run("should_create_use_and_revoke_api_tokens", func(t *testing.T) {
+		u, err := model.NewUser(uuid.NewString(), "some password", false)
+		require.NoError(t, err)
+		require.NoError(t, c.CreateUser(u))
+		u, err = c.GetUser(u.Name)
+		require.NoError(t, err)
+
+		token, err := model.NewAPIToken(u, "script", model.ScopeRead, uuid.NewString())
+		require.NoError(t, err)
+		require.NoError(t, c.CreateAPIToken(token))
+		require.Error(t, c.CreateAPIToken(token))
+
+		got, err := c.GetAPIToken(token.TokenHash)
+		require.NoError(t, err)
+		require.Equal(t, "script", got.Name)
+		require.Equal(t, model.ScopeRead, got.Scope)
+		require.Equal(t, u.ID, got.User.ID)
+		require.True(t, got.LastUsedAt.IsZero())
+
+		used := time.Now()
+		require.NoError(t, c.TouchAPIToken(got.ID, used))
+		tokens, err := c.ListAPITokens(u.ID)
+		require.NoError(t, err)
+		require.Len(t, tokens, 1)
+		require.Equal(t, used.Unix(), tokens[0].LastUsedAt.Unix())
+
+		require.NoError(t, c.RevokeAPIToken(u.ID, "script"))
+		require.ErrorIs(t, c.RevokeAPIToken(u.ID, "script"), model.ErrNotFound)
+		_, err = c.GetAPIToken(token.TokenHash)
+		require.ErrorIs(t, err, model.ErrNotFound)
+	})
+
+	t.Run("should_set_password_and_remove_sessions", func(t *testing.T) {
+		u, err := model.NewUser(uuid.NewString(), "some password", false)
+		require.NoError(t, err)
+		require.NoError(t, c.CreateUser(u))
+		u, err = c.GetUser(u.Name)
+		require.NoError(t, err)
+
+		now := time.Now()
+		s := model.Session{TokenHash: uuid.NewString(), User: u, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+		require.NoError(t, c.CreateSession(s))
+
+		changed, err := model.NewUser(u.Name, "other password", false)
+		require.NoError(t, err)
+		require.NoError(t, c.SetPassword(u.Name, changed.PasswordHash))
+
+		got, err := c.GetUser(u.Name)
+		require.NoError(t, err)
+		require.True(t, got.CheckPassword("other password"))
+		_, err = c.GetSession(s.TokenHash)
+		require.ErrorIs(t, err, model.ErrNotFound)
+
+		require.ErrorIs(t, c.SetPassword(uuid.NewString(), changed.PasswordHash), model.ErrNotFound)
+	})
+
+	t.Run("should_link_payers_to_users", func(t *testing.T) {
+		u, err := model.NewUser(uuid.NewString(), "some password", false)
+		require.NoError(t, err)
+		require.NoError(t, c.CreateUser(u))
+		linked, other := uuid.NewString(), uuid.NewString()
+		require.NoError(t, c.CreatePayer(ledger.ID, linked))
+		require.NoError(t, c.CreatePayer(ledger.ID, other))
+
+		require.NoError(t, c.LinkPayer(ledger.ID, linked, u.Name))
+		require.ErrorIs(t, c.LinkPayer(ledger.ID, other, u.Name), model.ErrInUse)
+		require.ErrorIs(t, c.LinkPayer(ledger.ID, other, uuid.NewString()), model.ErrNotFound)
+		require.ErrorIs(t, c.LinkPayer(ledger.ID, uuid.NewString(), u.Name), model.ErrNotFound)
+		// relinking the same payer is fine
+		require.NoError(t, c.LinkPayer(ledger.ID, linked, u.Name))
+
+		payers, err := c.ListPayerLinks(ledger.ID)
+		require.NoError(t, err)
+		require.Contains(t, payers, model.Payer{Name: linked, User: u.Name})
+		require.Contains(t, payers, model.Payer{Name: other})
+
+		require.NoError(t, c.LinkPayer(ledger.ID, linked, ""))
+		require.NoError(t, c.LinkPayer(ledger.ID, other, u.Name))
+
+		payers, err = c.ListPayerLinks(ledger.ID)
+		require.NoError(t, err)
+		require.Contains(t, payers, model.Payer{Name: linked})
+		require.Contains(t, payers, model.Payer{Name: other, User: u.Name})
+
+		// payers failing to link are not created
+		created := uuid.NewString()
+		require.ErrorIs(t, c.CreateLinkedPayer(ledger.ID, created, u.Name), model.ErrInUse)
+		require.ErrorIs(t, c.CreateLinkedPayer(ledger.ID, created, uuid.NewString()), model.ErrNotFound)
+		require.ErrorIs(t, c.CreateLinkedPayer(ledger.ID, other, ""), model.ErrInUse)
+		names, err := c.ListPayers(ledger.ID)
+		require.NoError(t, err)
+		require.NotContains(t, names, created)
+		require.NoError(t, c.LinkPayer(ledger.ID, other, ""))
+		require.NoError(t, c.CreateLinkedPayer(ledger.ID, created, u.Name))
+		payers, err = c.ListPayerLinks(ledger.ID)
+		require.NoError(t, err)
+		require.Contains(t, payers, model.Payer{Name: created, User: u.Name})
+	})
+
+	t.Run("should_keep_ledgers_apart", func(t *testing.T) {
+		otherName := uuid.NewString()
+		require.NoError(t, c.CreateLedger(otherName))
+		require.Error(t, c.CreateLedger(otherName))
+		other, err := c.GetLedger(otherName)
+		require.NoError(t, err)
+		_, err = c.GetLedger(uuid.NewString())
+		require.ErrorIs(t, err, model.ErrNotFound)
+
+		// names are unique within a ledger only
+		require.NoError(t, c.CreatePayer(other.ID, payer))
+		require.NoError(t, c.CreateCategory(other.ID, category))
+		exp, err := model.ExpenseBuilder{Description: "other", Payer: payer, Category: category, Amount: "1", Currency: "PLN", CreatedAt: time.Now()}.Build()
+		require.NoError(t, err)
+		require.NoError(t, c.Insert(other.ID, exp))
+
+		exps, err := c.SelectExpenses(other.ID)
+		require.NoError(t, err)
+		require.Len(t, exps, 1)
+		_, total, err := c.QueryExpenses(other.ID, model.ExpenseQuery{})
+		require.NoError(t, err)
+		require.Equal(t, 1, total)
+		exps, err = c.SelectExpenses(ledger.ID)
+		require.NoError(t, err)
+		require.Empty(t, filterExpenses(exps, exp.ID()))
+
+		_, err = c.GetExpense(ledger.ID, exp.ID())
+		require.ErrorIs(t, err, model.ErrNotFound)
+		require.ErrorIs(t, c.UpdateExpense(ledger.ID, exp), model.ErrNotFound)
+		require.NoError(t, c.RemoveExpense(ledger.ID, exp))
+		_, err = c.GetExpense(other.ID, exp.ID())
+		require.NoError(t, err)
+
+		// the payer of the other ledger is in use, the one of this ledger is
+		// left alone
+		require.ErrorIs(t, c.RemovePayer(other.ID, payer), model.ErrInUse)
+		payers, err := c.ListPayers(ledger.ID)
+		require.NoError(t, err)
+		require.Contains(t, payers, payer)
+	})
+
+	t.Run("should_grant_and_revoke_ledgers", func(t *testing.T) {
+		u, err := model.NewUser(uuid.NewString(), "some password", false)
+		require.NoError(t, err)
+		require.NoError(t, c.CreateUser(u))
+		u, err = c.GetUser(u.Name)
+		require.NoError(t, err)
+
+		ledgers, err := c.UserLedgers(u.ID)
+		require.NoError(t, err)
+		require.Empty(t, ledgers)
+
+		require.NoError(t, c.GrantLedger(ledger.Name, u.Name, model.RoleViewer))
+		ledgers, err = c.UserLedgers(u.ID)
+		require.NoError(t, err)
+		require.Equal(t, []model.Ledger{{ID: ledger.ID, Name: ledger.Name, Role: model.RoleViewer}}, ledgers)
+
+		// granting again changes the role
+		require.NoError(t, c.GrantLedger(ledger.Name, u.Name, model.RoleOwner))
+		ledgers, err = c.UserLedgers(u.ID)
+		require.NoError(t, err)
+		require.Equal(t, []model.Ledger{{ID: ledger.ID, Name: ledger.Name, Role: model.RoleOwner}}, ledgers)
+
+		all, err := c.ListLedgers()
+		require.NoError(t, err)
+		require.Contains(t, all, ledger)
+
+		require.ErrorIs(t, c.GrantLedger(uuid.NewString(), u.Name, model.RoleViewer), model.ErrNotFound)
+		require.ErrorIs(t, c.GrantLedger(ledger.Name, uuid.NewString(), model.RoleViewer), model.ErrNotFound)
+
+		require.NoError(t, c.RevokeLedger(ledger.Name, u.Name))
+		require.ErrorIs(t, c.RevokeLedger(ledger.Name, u.Name), model.ErrNotFound)
+		ledgers, err = c.UserLedgers(u.ID)
+		require.NoError(t, err)
+		require.Empty(t, ledgers)
+	})
+
+	t.Run("should_keep_who_created_expense", func(t *testing.T) {
+		u, err := model.NewUser(uuid.NewString(), "some password", false)
+		require.NoError(t, err)
+		require.NoError(t, c.CreateUser(u))
+		exp, err := model.ExpenseBuilder{
+			Description: "created by user",
+			Payer:       payer,
+			Category:    category,
+			Amount:      "1.00",
+			Currency:    "EUR",
+			CreatedAt:   time.Now(),
+			CreatedBy:   u.Name,
+		}.Build()
+		require.NoError(t, err)
+		require.NoError(t, c.Insert(ledger.ID, exp))
+
+		got, err := c.GetExpense(ledger.ID, exp.ID())
+		require.NoError(t, err)
+		require.Equal(t, u.Name, got.CreatedBy())
+
+		updated, err := model.ExpenseBuilder{
+			Id:          exp.ID(),
+			Description: "updated by someone else",
+			Payer:       payer,
+			Category:    category,
+			Amount:      "2.00",
+			Currency:    "EUR",
+			CreatedAt:   exp.CreatedAt(),
+		}.Build()
+		require.NoError(t, err)
+		require.NoError(t, c.UpdateExpense(ledger.ID, updated))
+		got, err = c.GetExpense(ledger.ID, exp.ID())
+		require.NoError(t, err)
+		require.Equal(t, "updated by someone else", got.Description())
+		require.Equal(t, u.Name, got.CreatedBy())
+	})
+
+	t.Run("should_count_expenses_and_check_file", func(t *testing.T) {
+		ids, err := c.ExpenseIDs()
+		require.NoError(t, err)
+
+		count, err := c.CountExpenses()
+		require.NoError(t, err)
+		require.Equal(t, len(ids), count)
+
+		count, err = db.CheckFile(dbFile)
+		require.NoError(t, err)
+		require.Equal(t, len(ids), count)
+	})
+
+	t.Run("should_report_dirty_schema", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dirty.db")
+		dirty, err := db.New(path)
+		require.NoError(t, err)
+		defer dirty.Close()
+		raw, err := sql.Open("sqlite", path)
+		require.NoError(t, err)
+		defer raw.Close()
+		_, err = raw.Exec("UPDATE schema_migrations SET dirty = 1")
+		require.NoError(t, err)
+
+		_, err = dirty.SchemaVersion()
+		require.ErrorContains(t, err, "dirty")
+	})
+
+	t.Run("should_check_file_with_uri_characters_in_path", func(t *testing.T) {
+		src := filepath.Join(t.TempDir(), "plain.db")
+		plain, err := db.New(src)
+		require.NoError(t, err)
+		require.NoError(t, plain.Close())
+		raw, err := os.ReadFile(src)
+		require.NoError(t, err)
+
+		dir := filepath.Join(t.TempDir(), "odd ?#% dir")
+		require.NoError(t, os.MkdirAll(dir, 0o750))
+		path := filepath.Join(dir, "exps.db")
+		require.NoError(t, os.WriteFile(path, raw, 0o600))
+
+		count, err := db.CheckFile(path)
+		require.NoError(t, err)
+		require.Zero(t, count)
+	})
 }
 
 func expensesEqual(t *testing.T, e1, e2 model.Expense) {
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matmazurk/acc2/model"
+	"github.com/pkg/errors"
+)
+
+type ledger struct {
+	ID   int64  `db:"id"`
+	Name string `db:"name"`
+	// Role is only selected along with the membership of a user
+	Role string `db:"role"`
+}
+
+func (l ledger) toModel() model.Ledger {
+	return model.Ledger{ID: l.ID, Name: l.Name, Role: model.Role(l.Role)}
+}
+
+func (d Client) CreateLedger(name string) error {
+	_, err := d.db.Exec("INSERT INTO ledger(name) VALUES (?)", name)
+	if err != nil {
+		return fmt.Errorf("could not create ledger: %w", err)
+	}
+
+	return nil
+}
+
+// GetLedger returns the ledger with name, or an error matching
+// model.ErrNotFound.
+func (d Client) GetLedger(name string) (model.Ledger, error) {
+	var l ledger
+	err := d.db.Get(&l, "SELECT * FROM ledger WHERE name = ?", name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.Ledger{}, fmt.Errorf("ledger '%s': %w", name, model.ErrNotFound)
+		}
+		return model.Ledger{}, fmt.Errorf("could not get ledger: %w", err)
+	}
+
+	return l.toModel(), nil
+}
+
+func (d Client) ListLedgers() ([]model.Ledger, error) {
+	return d.selectLedgers("SELECT * FROM ledger ORDER BY name")
+}
+
+// UserLedgers returns the ledgers the user with userID is a member of,
+// along with the role of the user in them.
+func (d Client) UserLedgers(userID int64) ([]model.Ledger, error) {
+	return d.selectLedgers(`
+		SELECT l.*, m.role FROM ledger l
+		JOIN ledger_member m ON m.ledger_id = l.id
+		WHERE m.user_id = ?
+		ORDER BY l.name`,
+		userID,
+	)
+}
+
+func (d Client) selectLedgers(query string, args ...any) ([]model.Ledger, error) {
+	var ledgers []ledger
+	err := d.db.Select(&ledgers, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not list ledgers: %w", err)
+	}
+
+	ret := make([]model.Ledger, len(ledgers))
+	for i, l := range ledgers {
+		ret[i] = l.toModel()
+	}
+
+	return ret, nil
+}
+
+// GrantLedger makes the user with userName a member of the ledger with
+// name, or changes the role of a member.
+func (d Client) GrantLedger(name, userName string, role model.Role) error {
+	l, u, err := d.ledgerAndUser(name, userName)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec(`
+		INSERT INTO ledger_member(ledger_id, user_id, role) VALUES (?, ?, ?)
+		ON CONFLICT (ledger_id, user_id) DO UPDATE SET role = excluded.role`,
+		l, u, role,
+	)
+	if err != nil {
+		return fmt.Errorf("could not grant ledger: %w", err)
+	}
+
+	return nil
+}
+
+// RevokeLedger removes the user with userName from the members of the
+// ledger with name.
+func (d Client) RevokeLedger(name, userName string) error {
+	l, u, err := d.ledgerAndUser(name, userName)
+	if err != nil {
+		return err
+	}
+
+	res, err := d.db.Exec("DELETE FROM ledger_member WHERE ledger_id = ? AND user_id = ?", l, u)
+	if err != nil {
+		return fmt.Errorf("could not revoke ledger: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not revoke ledger: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("user '%s' is not a member of ledger '%s': %w", userName, name, model.ErrNotFound)
+	}
+
+	return nil
+}
+
+func (d Client) ledgerAndUser(name, userName string) (int64, int64, error) {
+	l, err := d.GetLedger(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	u, err := d.GetUser(userName)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return l.ID, u.ID, nil
+}
@@ -3,6 +3,8 @@ package db
 import (
 	"embed"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/sqlite"
@@ -40,3 +42,23 @@ func migrateUp(db *sqlx.DB) error {
 
 	return nil
 }
+
+// LatestSchemaVersion returns the version of the newest embedded migration.
+func LatestSchemaVersion() (uint, error) {
+	entries, err := fs.ReadDir("migrations")
+	if err != nil {
+		return 0, fmt.Errorf("could not list migrations: %w", err)
+	}
+
+	var latest uint
+	for _, e := range entries {
+		prefix, _, _ := strings.Cut(e.Name(), "_")
+		version, err := strconv.ParseUint(prefix, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid migration name '%s': %w", e.Name(), err)
+		}
+		latest = max(latest, uint(version))
+	}
+
+	return latest, nil
+}
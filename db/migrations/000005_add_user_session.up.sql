@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS user (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT UNIQUE NOT NULL,
+	password_hash TEXT NOT NULL,
+	admin BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS session (
+	token_hash TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	created_at DATETIME NOT NULL,
+	expires_at INTEGER NOT NULL,
+
+	FOREIGN KEY (user_id) REFERENCES user(id)
+);
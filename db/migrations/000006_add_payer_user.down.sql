@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS payer_user_id;
+ALTER TABLE payer DROP COLUMN user_id;
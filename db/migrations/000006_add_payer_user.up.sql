@@ -0,0 +1,5 @@
+ALTER TABLE payer ADD COLUMN user_id INTEGER;
+CREATE UNIQUE INDEX IF NOT EXISTS payer_user_id ON payer(user_id);
+
+-- users are created after the migrations run, so existing payers are left
+-- unlinked; link them with 'acc2 payer link' or at /admin/payers
@@ -0,0 +1,31 @@
+-- fails when names of payers or categories repeat across ledgers
+DROP VIEW IF EXISTS expenses;
+
+DROP INDEX IF EXISTS expense_ledger_id;
+ALTER TABLE expense DROP COLUMN ledger_id;
+
+CREATE TABLE payer_global (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT UNIQUE,
+	user_id INTEGER
+);
+INSERT INTO payer_global(id, name, user_id) SELECT id, name, user_id FROM payer;
+DROP TABLE payer;
+ALTER TABLE payer_global RENAME TO payer;
+CREATE UNIQUE INDEX IF NOT EXISTS payer_user_id ON payer(user_id);
+
+CREATE TABLE category_global (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT UNIQUE
+);
+INSERT INTO category_global(id, name) SELECT id, name FROM category;
+DROP TABLE category;
+ALTER TABLE category_global RENAME TO category;
+
+CREATE VIEW IF NOT EXISTS expenses AS
+SELECT e.id, e.amount, e.currency, e.description, e.created_at, c.id AS "category.id", c.name AS "category.name", p.id AS "payer.id", p.name AS "payer.name"  FROM expense e
+JOIN category c ON c.id = e.category_id
+JOIN payer p ON p.id = e.payer_id;
+
+DROP TABLE IF EXISTS ledger_member;
+DROP TABLE IF EXISTS ledger;
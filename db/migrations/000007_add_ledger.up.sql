@@ -0,0 +1,57 @@
+CREATE TABLE IF NOT EXISTS ledger (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS ledger_member (
+	ledger_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+
+	PRIMARY KEY (ledger_id, user_id),
+	FOREIGN KEY (ledger_id) REFERENCES ledger(id),
+	FOREIGN KEY (user_id) REFERENCES user(id)
+);
+
+-- everything created before ledgers existed belongs to the default
+-- ledger, shared by all existing users
+INSERT INTO ledger(id, name) VALUES (1, 'default');
+INSERT INTO ledger_member(ledger_id, user_id) SELECT 1, id FROM user;
+
+DROP VIEW IF EXISTS expenses;
+
+-- names of payers and categories are unique within a ledger only, so
+-- their tables are rebuilt without the unique name constraint
+CREATE TABLE payer_ledger (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	ledger_id INTEGER NOT NULL,
+	name TEXT,
+	user_id INTEGER,
+
+	UNIQUE (ledger_id, name),
+	UNIQUE (ledger_id, user_id),
+	FOREIGN KEY (ledger_id) REFERENCES ledger(id)
+);
+INSERT INTO payer_ledger(id, ledger_id, name, user_id) SELECT id, 1, name, user_id FROM payer;
+DROP INDEX IF EXISTS payer_user_id;
+DROP TABLE payer;
+ALTER TABLE payer_ledger RENAME TO payer;
+
+CREATE TABLE category_ledger (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	ledger_id INTEGER NOT NULL,
+	name TEXT,
+
+	UNIQUE (ledger_id, name),
+	FOREIGN KEY (ledger_id) REFERENCES ledger(id)
+);
+INSERT INTO category_ledger(id, ledger_id, name) SELECT id, 1, name FROM category;
+DROP TABLE category;
+ALTER TABLE category_ledger RENAME TO category;
+
+ALTER TABLE expense ADD COLUMN ledger_id INTEGER NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS expense_ledger_id ON expense(ledger_id);
+
+CREATE VIEW IF NOT EXISTS expenses AS
+SELECT e.id, e.ledger_id, e.amount, e.currency, e.description, e.created_at, c.id AS "category.id", c.name AS "category.name", p.id AS "payer.id", p.name AS "payer.name"  FROM expense e
+JOIN category c ON c.id = e.category_id
+JOIN payer p ON p.id = e.payer_id;
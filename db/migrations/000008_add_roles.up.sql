@@ -0,0 +1,13 @@
+-- existing members keep being able to do everything
+ALTER TABLE ledger_member ADD COLUMN role TEXT NOT NULL DEFAULT 'owner';
+
+-- expenses added before are not owned by anyone
+ALTER TABLE expense ADD COLUMN created_by INTEGER REFERENCES user(id);
+
+DROP VIEW IF EXISTS expenses;
+
+CREATE VIEW IF NOT EXISTS expenses AS
+SELECT e.id, e.ledger_id, e.amount, e.currency, e.description, e.created_at, COALESCE(u.name, '') AS created_by, c.id AS "category.id", c.name AS "category.name", p.id AS "payer.id", p.name AS "payer.name"  FROM expense e
+JOIN category c ON c.id = e.category_id
+JOIN payer p ON p.id = e.payer_id
+LEFT JOIN user u ON u.id = e.created_by;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS api_token (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	scope TEXT NOT NULL,
+	token_hash TEXT UNIQUE NOT NULL,
+	created_at DATETIME NOT NULL,
+	-- unix time, NULL for tokens never used
+	last_used_at INTEGER,
+
+	UNIQUE (user_id, name),
+	FOREIGN KEY (user_id) REFERENCES user(id)
+);
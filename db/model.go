@@ -1,22 +1,42 @@
 package db
 
 import (
+	"database/sql"
 	"time"
+
+	"github.com/matmazurk/acc2/model"
 )
 
 type expense struct {
 	ID          string    `db:"id"`
+	LedgerID    int64     `db:"ledger_id"`
 	Payer       payer     `db:"payer"`
 	CategoryID  category  `db:"category"`
 	Description string    `db:"description"`
 	Amount      string    `db:"amount"`
 	Currency    string    `db:"currency"`
 	CreatedAt   time.Time `db:"created_at"`
+	CreatedBy   string    `db:"created_by"`
+}
+
+func (e expense) toModel() (model.Expense, error) {
+	return model.ExpenseBuilder{
+		Id:          e.ID,
+		Description: e.Description,
+		Payer:       e.Payer.Name,
+		Category:    e.CategoryID.Name,
+		Amount:      e.Amount,
+		Currency:    e.Currency,
+		CreatedAt:   e.CreatedAt,
+		CreatedBy:   e.CreatedBy,
+	}.Build()
 }
 
 type payer struct {
-	ID   uint   `db:"id"`
-	Name string `db:"name"`
+	ID       uint          `db:"id"`
+	LedgerID int64         `db:"ledger_id"`
+	Name     string        `db:"name"`
+	UserID   sql.NullInt64 `db:"user_id"`
 }
 
 func (p payer) isZero() bool {
@@ -24,8 +44,9 @@ func (p payer) isZero() bool {
 }
 
 type category struct {
-	ID   uint   `db:"id"`
-	Name string `db:"name"`
+	ID       uint   `db:"id"`
+	LedgerID int64  `db:"ledger_id"`
+	Name     string `db:"name"`
 }
 
 func (c category) isZero() bool {
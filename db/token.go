@@ -0,0 +1,114 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/matmazurk/acc2/model"
+	"github.com/pkg/errors"
+)
+
+type apiToken struct {
+	ID         int64         `db:"id"`
+	Name       string        `db:"name"`
+	Scope      string        `db:"scope"`
+	TokenHash  string        `db:"token_hash"`
+	CreatedAt  time.Time     `db:"created_at"`
+	LastUsedAt sql.NullInt64 `db:"last_used_at"`
+	User       user          `db:"user"`
+}
+
+func (t apiToken) toModel() model.APIToken {
+	ret := model.APIToken{
+		ID:        t.ID,
+		Name:      t.Name,
+		Scope:     model.TokenScope(t.Scope),
+		TokenHash: t.TokenHash,
+		User:      t.User.toModel(),
+		CreatedAt: t.CreatedAt,
+	}
+	if t.LastUsedAt.Valid {
+		ret.LastUsedAt = time.Unix(t.LastUsedAt.Int64, 0)
+	}
+	return ret
+}
+
+const selectAPITokens = `
+	SELECT t.id, t.name, t.scope, t.token_hash, t.created_at, t.last_used_at,
+		u.id AS "user.id", u.name AS "user.name", u.password_hash AS "user.password_hash",
+		u.admin AS "user.admin", u.created_at AS "user.created_at"
+	FROM api_token t
+	JOIN user u ON u.id = t.user_id`
+
+// CreateAPIToken stores t, names of tokens are unique per user.
+func (d Client) CreateAPIToken(t model.APIToken) error {
+	_, err := d.db.Exec(
+		"INSERT INTO api_token(user_id, name, scope, token_hash, created_at) VALUES (?, ?, ?, ?, ?)",
+		t.User.ID, t.Name, t.Scope, t.TokenHash, t.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("could not create api token: %w", err)
+	}
+
+	return nil
+}
+
+// GetAPIToken returns the token with tokenHash together with its user, or
+// an error matching model.ErrNotFound.
+func (d Client) GetAPIToken(tokenHash string) (model.APIToken, error) {
+	var t apiToken
+	err := d.db.Get(&t, selectAPITokens+" WHERE t.token_hash = ?", tokenHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.APIToken{}, fmt.Errorf("api token: %w", model.ErrNotFound)
+		}
+		return model.APIToken{}, fmt.Errorf("could not get api token: %w", err)
+	}
+
+	return t.toModel(), nil
+}
+
+// ListAPITokens returns the tokens of the user with userID.
+func (d Client) ListAPITokens(userID int64) ([]model.APIToken, error) {
+	var tokens []apiToken
+	err := d.db.Select(&tokens, selectAPITokens+" WHERE t.user_id = ? ORDER BY t.name", userID)
+	if err != nil {
+		return nil, fmt.Errorf("could not list api tokens: %w", err)
+	}
+
+	ret := make([]model.APIToken, len(tokens))
+	for i, t := range tokens {
+		ret[i] = t.toModel()
+	}
+
+	return ret, nil
+}
+
+// RevokeAPIToken removes the token with name of the user with userID, or
+// returns an error matching model.ErrNotFound.
+func (d Client) RevokeAPIToken(userID int64, name string) error {
+	res, err := d.db.Exec("DELETE FROM api_token WHERE user_id = ? AND name = ?", userID, name)
+	if err != nil {
+		return fmt.Errorf("could not revoke api token: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not revoke api token: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("api token '%s': %w", name, model.ErrNotFound)
+	}
+
+	return nil
+}
+
+// TouchAPIToken records the token with id was used at.
+func (d Client) TouchAPIToken(id int64, at time.Time) error {
+	_, err := d.db.Exec("UPDATE api_token SET last_used_at = ? WHERE id = ?", at.Unix(), id)
+	if err != nil {
+		return fmt.Errorf("could not update api token: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/matmazurk/acc2/model"
+	"github.com/pkg/errors"
+)
+
+type user struct {
+	ID           int64     `db:"id"`
+	Name         string    `db:"name"`
+	PasswordHash string    `db:"password_hash"`
+	Admin        bool      `db:"admin"`
+	CreatedAt    time.Time `db:"created_at"`
+}
+
+func (u user) toModel() model.User {
+	return model.User{
+		ID:           u.ID,
+		Name:         u.Name,
+		PasswordHash: u.PasswordHash,
+		Admin:        u.Admin,
+		CreatedAt:    u.CreatedAt,
+	}
+}
+
+func (d Client) CreateUser(u model.User) error {
+	_, err := d.db.Exec(
+		"INSERT INTO user(name, password_hash, admin, created_at) VALUES (?, ?, ?, ?)",
+		u.Name, u.PasswordHash, u.Admin, u.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("could not create user: %w", err)
+	}
+
+	return nil
+}
+
+// GetUser returns the user with name, or an error matching
+// model.ErrNotFound.
+func (d Client) GetUser(name string) (model.User, error) {
+	var u user
+	err := d.db.Get(&u, "SELECT * FROM user WHERE name = ?", name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.User{}, fmt.Errorf("user '%s': %w", name, model.ErrNotFound)
+		}
+		return model.User{}, fmt.Errorf("could not get user: %w", err)
+	}
+
+	return u.toModel(), nil
+}
+
+func (d Client) ListUsers() ([]model.User, error) {
+	var users []user
+	err := d.db.Select(&users, "SELECT * FROM user ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("could not list users: %w", err)
+	}
+
+	ret := make([]model.User, len(users))
+	for i, u := range users {
+		ret[i] = u.toModel()
+	}
+
+	return ret, nil
+}
+
+// SetPassword replaces the password hash of the user with name and logs
+// the user out everywhere.
+func (d Client) SetPassword(name, passwordHash string) error {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.Get(&id, "SELECT id FROM user WHERE name = ?", name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("user '%s': %w", name, model.ErrNotFound)
+		}
+		return fmt.Errorf("could not get user: %w", err)
+	}
+
+	_, err = tx.Exec("UPDATE user SET password_hash = ? WHERE id = ?", passwordHash, id)
+	if err != nil {
+		return fmt.Errorf("could not set password: %w", err)
+	}
+	_, err = tx.Exec("DELETE FROM session WHERE user_id = ?", id)
+	if err != nil {
+		return fmt.Errorf("could not remove sessions: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// CreateSession stores s and removes expired sessions.
+func (d Client) CreateSession(s model.Session) error {
+	_, err := d.db.Exec("DELETE FROM session WHERE expires_at <= ?", time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("could not remove expired sessions: %w", err)
+	}
+
+	_, err = d.db.Exec(
+		"INSERT INTO session(token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		s.TokenHash, s.User.ID, s.CreatedAt, s.ExpiresAt.Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("could not create session: %w", err)
+	}
+
+	return nil
+}
+
+// GetSession returns the unexpired session with tokenHash together with
+// its user, or an error matching model.ErrNotFound.
+func (d Client) GetSession(tokenHash string) (model.Session, error) {
+	var s struct {
+		TokenHash string    `db:"token_hash"`
+		CreatedAt time.Time `db:"created_at"`
+		ExpiresAt int64     `db:"expires_at"`
+		User      user      `db:"user"`
+	}
+	err := d.db.Get(&s, `
+		SELECT s.token_hash, s.created_at, s.expires_at,
+			u.id AS "user.id", u.name AS "user.name", u.password_hash AS "user.password_hash",
+			u.admin AS "user.admin", u.created_at AS "user.created_at"
+		FROM session s
+		JOIN user u ON u.id = s.user_id
+		WHERE s.token_hash = ? AND s.expires_at > ?`,
+		tokenHash, time.Now().Unix(),
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.Session{}, fmt.Errorf("session: %w", model.ErrNotFound)
+		}
+		return model.Session{}, fmt.Errorf("could not get session: %w", err)
+	}
+
+	return model.Session{
+		TokenHash: s.TokenHash,
+		User:      s.User.toModel(),
+		CreatedAt: s.CreatedAt,
+		ExpiresAt: time.Unix(s.ExpiresAt, 0),
+	}, nil
+}
+
+func (d Client) RemoveSession(tokenHash string) error {
+	_, err := d.db.Exec("DELETE FROM session WHERE token_hash = ?", tokenHash)
+	if err != nil {
+		return fmt.Errorf("could not remove session: %w", err)
+	}
+
+	return nil
+}
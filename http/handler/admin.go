@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// adminOnly lets through requests of admin users, it expects to be
+// wrapped by authenticated.
+func (h handler) adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, ok := currentUser(r)
+		if !ok || !u.Admin {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("admin access required"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h handler) GetBackups() http.HandlerFunc {
+	type archive struct {
+		Name string
+		Size string
+		Time string
+	}
+	type verification struct {
+		Archive      string
+		Time         string
+		OK           bool
+		Files        int
+		Expenses     int
+		LiveExpenses int
+		Problems     []string
+	}
+	type data struct {
+		Archives     []archive
+		Verification *verification
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		infos, err := h.backups.List()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		d := data{Archives: make([]archive, len(infos))}
+		for i, fi := range infos {
+			d.Archives[i] = archive{
+				Name: fi.Name(),
+				Size: formatSize(fi.Size()),
+				Time: fi.ModTime().In(h.location).Format("02 Jan 06 15:04"),
+			}
+		}
+		if h.verifier != nil {
+			if report, ok := h.verifier.LastReport(); ok {
+				d.Verification = &verification{
+					Archive:      report.Archive,
+					Time:         report.CheckedAt.In(h.location).Format("02 Jan 06 15:04"),
+					OK:           report.OK(),
+					Files:        report.Files,
+					Expenses:     report.Expenses,
+					LiveExpenses: report.LiveExpenses,
+					Problems:     report.Problems,
+				}
+			}
+		}
+		h.templates.ExecuteTemplate(w, "backups.html", d)
+	})
+}
+
+func (h handler) GetBackupArchive() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+
+		f, fi, err := h.backups.Open(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte("archive '" + name + "' not found"))
+				return
+			}
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fi.Name()))
+		http.ServeContent(w, r, "", fi.ModTime(), f)
+	})
+}
+
+// DownloadBackup streams a fresh archive. Once streaming started errors
+// can not be reported with the status code anymore, so the connection is
+// aborted and the browser reports a failed download.
+func (h handler) DownloadBackup() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := "acc-backup-" + time.Now().In(h.location).Format("2006-01-02_15-04-05") + ".zip"
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		w.Header().Set("Cache-Control", "no-store")
+
+		cw := &countingWriter{w: w}
+		err := h.backups.WriteBackup(cw)
+		if err != nil {
+			h.logger.Error().Err(err).Msg("could not stream backup")
+			if cw.n > 0 {
+				panic(http.ErrAbortHandler)
+			}
+			w.Header().Del("Content-Disposition")
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+		}
+	})
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,582 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matmazurk/acc2/model"
+)
+
+const (
+	apiPrefix = "/api/v1"
+
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+	// maxJSONSize is the default limit of JSON request bodies of the api
+	maxJSONSize = 1 << 20
+)
+
+// error codes of api error bodies
+const (
+	codeInvalidRequest       = "invalid_request"
+	codeUnauthorized         = "unauthorized"
+	codeForbidden            = "forbidden"
+	codeNotFound             = "not_found"
+	codeConflict             = "conflict"
+	codePayloadTooLarge      = "payload_too_large"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeTooManyRequests      = "too_many_requests"
+	codeInternal             = "internal"
+)
+
+var amountRe = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// apiEndpoint is a route of the api, path is relative to apiPrefix and
+// matches the path template of the OpenAPI document.
+type apiEndpoint struct {
+	method  string
+	path    string
+	handler http.Handler
+}
+
+func (h handler) apiEndpoints() []apiEndpoint {
+	// everything but the list of ledgers works on the ledger of the request,
+	// as long as the role of the user in it allows
+	in := func(role model.Role, next http.Handler) http.Handler {
+		return h.inLedger(h.requireRole(role, next))
+	}
+	viewer, editor, owner := model.RoleViewer, model.RoleEditor, model.RoleOwner
+	return []apiEndpoint{
+		{"GET", "/ledgers", h.APIListLedgers()},
+
+		{"GET", "/expenses", in(viewer, h.APIListExpenses())},
+		{"POST", "/expenses", in(editor, h.APICreateExpense())},
+		{"GET", "/expenses/{id}", in(viewer, h.APIGetExpense())},
+		{"PUT", "/expenses/{id}", in(editor, h.APIUpdateExpense())},
+		{"DELETE", "/expenses/{id}", in(owner, h.APIDeleteExpense())},
+		{"GET", "/expenses/{id}/photo", in(viewer, h.APIGetPhoto())},
+		{"PUT", "/expenses/{id}/photo", in(editor, h.APIPutPhoto())},
+
+		{"GET", "/payers", in(viewer, h.APIListNames(h.pers.ListPayers))},
+		{"POST", "/payers", in(owner, h.APICreateName(h.pers.ListPayers, h.pers.CreatePayer))},
+		{"DELETE", "/payers/{name}", in(owner, h.APIRemoveName(h.pers.RemovePayer))},
+
+		{"GET", "/categories", in(viewer, h.APIListNames(h.pers.ListCategories))},
+		{"POST", "/categories", in(owner, h.APICreateName(h.pers.ListCategories, h.pers.CreateCategory))},
+		{"DELETE", "/categories/{name}", in(owner, h.APIRemoveName(h.pers.RemoveCategory))},
+	}
+}
+
+func (h handler) apiRoutes(handle func(pattern string, next http.Handler)) {
+	// api requests are logged whatever their method, scripts reading with a
+	// token are told apart by it
+	for _, e := range h.apiEndpoints() {
+		handle(e.method+" "+apiPrefix+e.path, logh(e.handler, h.logger))
+	}
+
+	handle("GET /api/openapi.json", h.GetOpenAPI())
+	handle("GET /api/docs", h.GetAPIDocs())
+}
+
+type apiExpense struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description"`
+	Payer       string    `json:"payer"`
+	Category    string    `json:"category"`
+	Amount      string    `json:"amount"`
+	Currency    string    `json:"currency"`
+	CreatedAt   time.Time `json:"created_at"`
+	CreatedBy   string    `json:"created_by"`
+}
+
+func toAPIExpense(e model.Expense) apiExpense {
+	return apiExpense{
+		ID:          e.ID(),
+		Description: e.Description(),
+		Payer:       e.Payer(),
+		Category:    e.Category(),
+		Amount:      e.Amount(),
+		Currency:    e.Currency(),
+		CreatedAt:   e.CreatedAt(),
+		CreatedBy:   e.CreatedBy(),
+	}
+}
+
+// expenseInput is the body of expense create and update requests, a zero
+// CreatedAt means now for new expenses and is left as is on updates.
+type expenseInput struct {
+	Description string    `json:"description"`
+	Payer       string    `json:"payer"`
+	Category    string    `json:"category"`
+	Amount      string    `json:"amount"`
+	Currency    string    `json:"currency"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, apiError{Error: apiErrorBody{Code: code, Message: message}})
+}
+
+// writePersistenceError maps persistence errors to api errors.
+func (h handler) writePersistenceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, model.ErrNotFound):
+		writeAPIError(w, http.StatusNotFound, codeNotFound, err.Error())
+	case errors.Is(err, model.ErrInUse):
+		writeAPIError(w, http.StatusConflict, codeConflict, err.Error())
+	default:
+		h.logger.Error().Err(err).Msg("api persistence call failed")
+		writeAPIError(w, http.StatusInternalServerError, codeInternal, err.Error())
+	}
+}
+
+// writeUploadError maps errors of reading multipart requests and their
+// photos to api errors.
+func (h handler) writeUploadError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr), errors.Is(err, errPhotoTooLarge):
+		writeAPIError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, err.Error())
+	case errors.Is(err, errUnsupportedFileType):
+		writeAPIError(w, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, err.Error())
+	case errors.Is(err, http.ErrNotMultipart):
+		writeAPIError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+	default:
+		h.logger.Error().Err(err).Msg("could not read upload")
+		writeAPIError(w, http.StatusInternalServerError, codeInternal, err.Error())
+	}
+}
+
+func (h handler) APIListExpenses() http.HandlerFunc {
+	type page struct {
+		Items  []apiExpense `json:"items"`
+		Total  int          `json:"total"`
+		Limit  int          `json:"limit"`
+		Offset int          `json:"offset"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, err := h.parseExpenseQuery(r)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+
+		exps, total, err := h.pers.QueryExpenses(currentLedger(r).ID, q)
+		if err != nil {
+			h.writePersistenceError(w, err)
+			return
+		}
+
+		p := page{Items: make([]apiExpense, len(exps)), Total: total, Limit: q.Limit, Offset: q.Offset}
+		for i, e := range exps {
+			p.Items[i] = toAPIExpense(e)
+		}
+		writeJSON(w, http.StatusOK, p)
+	})
+}
+
+// parseExpenseQuery reads the payer, category, from, to, limit and offset
+// query parameters. Times are RFC 3339 or dates, which mean midnight in
+// the handler location.
+func (h handler) parseExpenseQuery(r *http.Request) (model.ExpenseQuery, error) {
+	params := r.URL.Query()
+	q := model.ExpenseQuery{
+		Payer:    params.Get("payer"),
+		Category: params.Get("category"),
+		Limit:    defaultPageLimit,
+	}
+
+	var err error
+	if v := params.Get("from"); v != "" {
+		q.From, err = h.parseTime(v)
+		if err != nil {
+			return q, errors.New("invalid 'from': " + err.Error())
+		}
+	}
+	if v := params.Get("to"); v != "" {
+		q.To, err = h.parseTime(v)
+		if err != nil {
+			return q, errors.New("invalid 'to': " + err.Error())
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		q.Limit, err = strconv.Atoi(v)
+		if err != nil || q.Limit < 1 || q.Limit > maxPageLimit {
+			return q, errors.New("'limit' must be a number between 1 and " + strconv.Itoa(maxPageLimit))
+		}
+	}
+	if v := params.Get("offset"); v != "" {
+		q.Offset, err = strconv.Atoi(v)
+		if err != nil || q.Offset < 0 {
+			return q, errors.New("'offset' must be a non-negative number")
+		}
+	}
+
+	return q, nil
+}
+
+func (h handler) parseTime(v string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, v)
+	if err == nil {
+		return t.In(h.location), nil
+	}
+	t, err = time.ParseInLocation(time.DateOnly, v, h.location)
+	if err != nil {
+		return time.Time{}, errors.New("expected RFC 3339 time or YYYY-MM-DD date")
+	}
+	return t, nil
+}
+
+func (h handler) APIGetExpense() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exp, err := h.pers.GetExpense(currentLedger(r).ID, r.PathValue("id"))
+		if err != nil {
+			h.writePersistenceError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, toAPIExpense(exp))
+	})
+}
+
+// APICreateExpense accepts a JSON body, or a multipart form with the
+// fields of the JSON body and an optional photo.
+func (h handler) APICreateExpense() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			in        expenseInput
+			multipart bool
+		)
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType == "multipart/form-data" {
+			multipart = true
+			err := r.ParseMultipartForm(10 << 20)
+			if err != nil {
+				h.writeUploadError(w, err)
+				return
+			}
+			in = expenseInput{
+				Description: r.FormValue("description"),
+				Payer:       r.FormValue("payer"),
+				Category:    r.FormValue("category"),
+				Amount:      r.FormValue("amount"),
+				Currency:    r.FormValue("currency"),
+			}
+			if v := r.FormValue("created_at"); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					writeAPIError(w, http.StatusBadRequest, codeInvalidRequest, "invalid 'created_at': "+err.Error())
+					return
+				}
+				in.CreatedAt = t
+			}
+		} else if !decodeJSON(w, r, &in) {
+			return
+		}
+
+		if in.CreatedAt.IsZero() {
+			in.CreatedAt = time.Now()
+		}
+		exp, ok := h.buildExpense(w, currentLedger(r).ID, "", userName(r), in)
+		if !ok {
+			return
+		}
+
+		if multipart {
+			err := h.savePhoto(r, exp)
+			if err != nil {
+				h.writeUploadError(w, err)
+				return
+			}
+		}
+
+		err := h.pers.Insert(currentLedger(r).ID, exp)
+		if err != nil {
+			h.writePersistenceError(w, err)
+			return
+		}
+
+		w.Header().Set("Location", apiPrefix+"/expenses/"+exp.ID())
+		writeJSON(w, http.StatusCreated, toAPIExpense(exp))
+	})
+}
+
+func (h handler) APIUpdateExpense() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current, err := h.pers.GetExpense(currentLedger(r).ID, r.PathValue("id"))
+		if err != nil {
+			h.writePersistenceError(w, err)
+			return
+		}
+		if !canEdit(r, current) {
+			h.forbidden(w, r, errNotOwn)
+			return
+		}
+
+		var in expenseInput
+		if !decodeJSON(w, r, &in) {
+			return
+		}
+		if in.CreatedAt.IsZero() {
+			in.CreatedAt = current.CreatedAt()
+		}
+		exp, ok := h.buildExpense(w, currentLedger(r).ID, current.ID(), current.CreatedBy(), in)
+		if !ok {
+			return
+		}
+
+		err = h.pers.UpdateExpense(currentLedger(r).ID, exp)
+		if err != nil {
+			h.writePersistenceError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, toAPIExpense(exp))
+	})
+}
+
+func (h handler) APIDeleteExpense() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exp, err := h.pers.GetExpense(currentLedger(r).ID, r.PathValue("id"))
+		if err != nil {
+			h.writePersistenceError(w, err)
+			return
+		}
+
+		err = h.pers.RemoveExpense(currentLedger(r).ID, exp)
+		if err != nil {
+			h.writePersistenceError(w, err)
+			return
+		}
+
+		// a photo left behind is quarantined by the imagestore garbage collector
+		err = h.store.RemoveExpensePhoto(exp)
+		if err != nil {
+			h.logger.Error().Err(err).Str("expense_id", exp.ID()).Msg("could not remove expense photo")
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (h handler) APIGetPhoto() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exp, err := h.pers.GetExpense(currentLedger(r).ID, r.PathValue("id"))
+		if err != nil {
+			h.writePersistenceError(w, err)
+			return
+		}
+
+		err = h.servePhoto(w, r, exp)
+		if err != nil {
+			if os.IsNotExist(err) {
+				writeAPIError(w, http.StatusNotFound, codeNotFound, "expense '"+exp.ID()+"' has no photo")
+				return
+			}
+			if errors.Is(err, model.ErrPhotoCorrupted) {
+				h.logger.Error().Err(err).Str("expense_id", exp.ID()).Msg("expense photo is corrupted")
+			} else {
+				h.logger.Error().Err(err).Str("expense_id", exp.ID()).Msg("could not load expense photo")
+			}
+			writeAPIError(w, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+	})
+}
+
+// APIPutPhoto replaces the photo of an expense with the photo field of a
+// multipart form.
+func (h handler) APIPutPhoto() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exp, err := h.pers.GetExpense(currentLedger(r).ID, r.PathValue("id"))
+		if err != nil {
+			h.writePersistenceError(w, err)
+			return
+		}
+		if !canEdit(r, exp) {
+			h.forbidden(w, r, errNotOwn)
+			return
+		}
+
+		err = r.ParseMultipartForm(10 << 20)
+		if err != nil {
+			h.writeUploadError(w, err)
+			return
+		}
+		if _, _, err := r.FormFile("photo"); err != nil {
+			writeAPIError(w, http.StatusBadRequest, codeInvalidRequest, "missing 'photo' file")
+			return
+		}
+
+		// the old photo may be stored with a different extension
+		err = h.store.RemoveExpensePhoto(exp)
+		if err != nil {
+			h.logger.Error().Err(err).Str("expense_id", exp.ID()).Msg("could not remove expense photo")
+			writeAPIError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		err = h.savePhoto(r, exp)
+		if err != nil {
+			h.writeUploadError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// buildExpense validates in against the ledger and builds the expense with
+// id added by createdBy, writing the error response when in is invalid.
+func (h handler) buildExpense(w http.ResponseWriter, ledgerID int64, id, createdBy string, in expenseInput) (model.Expense, bool) {
+	if in.Amount != "" && !amountRe.MatchString(in.Amount) {
+		writeAPIError(w, http.StatusBadRequest, codeInvalidRequest, "amount must be a non-negative decimal number")
+		return model.Expense{}, false
+	}
+
+	exp, err := model.ExpenseBuilder{
+		Id:          id,
+		Description: in.Description,
+		Payer:       in.Payer,
+		Category:    in.Category,
+		Amount:      in.Amount,
+		Currency:    in.Currency,
+		CreatedAt:   in.CreatedAt.In(h.location),
+		CreatedBy:   createdBy,
+	}.Build()
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return model.Expense{}, false
+	}
+
+	for _, c := range []struct {
+		kind, name string
+		list       func(ledgerID int64) ([]string, error)
+	}{
+		{"payer", exp.Payer(), h.pers.ListPayers},
+		{"category", exp.Category(), h.pers.ListCategories},
+	} {
+		names, err := c.list(ledgerID)
+		if err != nil {
+			h.writePersistenceError(w, err)
+			return model.Expense{}, false
+		}
+		if !slices.Contains(names, c.name) {
+			writeAPIError(w, http.StatusBadRequest, codeInvalidRequest, "unknown "+c.kind+" '"+c.name+"'")
+			return model.Expense{}, false
+		}
+	}
+
+	return exp, true
+}
+
+// decodeJSON decodes the JSON request body into v, writing the error
+// response when it could not.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		writeAPIError(w, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "expected application/json body")
+		return false
+	}
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, err.Error())
+			return false
+		}
+		writeAPIError(w, http.StatusBadRequest, codeInvalidRequest, "invalid json: "+err.Error())
+		return false
+	}
+
+	return true
+}
+
+func (h handler) APIListNames(list func(ledgerID int64) ([]string, error)) http.HandlerFunc {
+	type data struct {
+		Items []string `json:"items"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		names, err := list(currentLedger(r).ID)
+		if err != nil {
+			h.writePersistenceError(w, err)
+			return
+		}
+		if names == nil {
+			names = []string{}
+		}
+
+		writeJSON(w, http.StatusOK, data{Items: names})
+	})
+}
+
+func (h handler) APICreateName(list func(ledgerID int64) ([]string, error), create func(ledgerID int64, name string) error) http.HandlerFunc {
+	type data struct {
+		Name string `json:"name"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var in data
+		if !decodeJSON(w, r, &in) {
+			return
+		}
+		in.Name = strings.TrimSpace(in.Name)
+		if in.Name == "" {
+			writeAPIError(w, http.StatusBadRequest, codeInvalidRequest, "name cannot be empty")
+			return
+		}
+
+		names, err := list(currentLedger(r).ID)
+		if err != nil {
+			h.writePersistenceError(w, err)
+			return
+		}
+		if slices.Contains(names, in.Name) {
+			writeAPIError(w, http.StatusConflict, codeConflict, "'"+in.Name+"' already exists")
+			return
+		}
+
+		err = create(currentLedger(r).ID, in.Name)
+		if err != nil {
+			h.writePersistenceError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, in)
+	})
+}
+
+func (h handler) APIRemoveName(remove func(ledgerID int64, name string) error) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := remove(currentLedger(r).ID, r.PathValue("name"))
+		if err != nil {
+			h.writePersistenceError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,380 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matmazurk/acc2/http/handler"
+	"github.com/matmazurk/acc2/model"
+	"github.com/stretchr/testify/require"
+)
+
+type apiExpense struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description"`
+	Payer       string    `json:"payer"`
+	Category    string    `json:"category"`
+	Amount      string    `json:"amount"`
+	Currency    string    `json:"currency"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type apiError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func TestAPIExpenses(t *testing.T) {
+	pf := newPersistenceFake()
+	pf.payers = []string{"mat", "paulka"}
+	pf.categories = []string{"food", "travel"}
+	is := newImagestoreFake()
+	h, err := handler.NewHandler(pf, is)
+	require.NoError(t, err)
+
+	srv := loggedIn(t, h, pf, false)
+
+	base := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+	for i, e := range []struct{ payer, category string }{
+		{"mat", "food"},
+		{"paulka", "food"},
+		{"mat", "travel"},
+		{"mat", "food"},
+	} {
+		exp, err := model.ExpenseBuilder{
+			Description: "expense",
+			Payer:       e.payer,
+			Category:    e.category,
+			Amount:      "10.00",
+			Currency:    "PLN",
+			CreatedAt:   base.AddDate(0, 0, i),
+		}.Build()
+		require.NoError(t, err)
+		require.NoError(t, pf.Insert(1, exp))
+	}
+
+	t.Run("should_list_expenses_newest_first", func(t *testing.T) {
+		rr := serveAPI(t, srv, "GET", "/api/v1/expenses", nil)
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+		var page struct {
+			Items  []apiExpense `json:"items"`
+			Total  int          `json:"total"`
+			Limit  int          `json:"limit"`
+			Offset int          `json:"offset"`
+		}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &page))
+		require.Equal(t, 4, page.Total)
+		require.Equal(t, 50, page.Limit)
+		require.Len(t, page.Items, 4)
+		require.True(t, page.Items[0].CreatedAt.Equal(base.AddDate(0, 0, 3)))
+	})
+
+	t.Run("should_filter_and_paginate", func(t *testing.T) {
+		tcs := []struct {
+			name  string
+			query string
+			total int
+			items int
+		}{
+			{name: "payer", query: "payer=mat", total: 3, items: 3},
+			{name: "category", query: "category=travel", total: 1, items: 1},
+			{name: "time_range", query: "from=2024-05-02&to=2024-05-04", total: 2, items: 2},
+			{name: "rfc3339_from", query: "from=" + base.AddDate(0, 0, 3).Format(time.RFC3339), total: 1, items: 1},
+			{name: "limit", query: "limit=3", total: 4, items: 3},
+			{name: "offset", query: "limit=3&offset=3", total: 4, items: 1},
+			{name: "combined", query: "payer=mat&category=food&limit=1", total: 2, items: 1},
+		}
+		for _, tc := range tcs {
+			t.Run(tc.name, func(t *testing.T) {
+				rr := serveAPI(t, srv, "GET", "/api/v1/expenses?"+tc.query, nil)
+				require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+				var page struct {
+					Items []apiExpense `json:"items"`
+					Total int          `json:"total"`
+				}
+				require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &page))
+				require.Equal(t, tc.total, page.Total)
+				require.Len(t, page.Items, tc.items)
+			})
+		}
+	})
+
+	t.Run("should_return_400_for_invalid_query", func(t *testing.T) {
+		for _, query := range []string{"limit=0", "limit=501", "limit=x", "offset=-1", "from=yesterday", "to=2024-13-01"} {
+			t.Run(query, func(t *testing.T) {
+				rr := serveAPI(t, srv, "GET", "/api/v1/expenses?"+query, nil)
+				requireAPIError(t, rr, http.StatusBadRequest, "invalid_request")
+			})
+		}
+	})
+
+	t.Run("should_create_get_update_and_delete_expense", func(t *testing.T) {
+		rr := serveAPI(t, srv, "POST", "/api/v1/expenses", map[string]any{
+			"description": "tickets",
+			"payer":       "paulka",
+			"category":    "travel",
+			"amount":      "120.50",
+			"currency":    "EUR",
+		})
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+		var created apiExpense
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+		require.Equal(t, "/api/v1/expenses/"+created.ID, rr.Header().Get("Location"))
+		require.Equal(t, "120.50", created.Amount)
+		require.False(t, created.CreatedAt.IsZero())
+
+		rr = serveAPI(t, srv, "GET", "/api/v1/expenses/"+created.ID, nil)
+		require.Equal(t, http.StatusOK, rr.Code)
+		var got apiExpense
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+		require.Equal(t, created.ID, got.ID)
+		require.Equal(t, "tickets", got.Description)
+
+		rr = serveAPI(t, srv, "PUT", "/api/v1/expenses/"+created.ID, map[string]any{
+			"description": "train tickets",
+			"payer":       "mat",
+			"category":    "travel",
+			"amount":      "99",
+			"currency":    "EUR",
+		})
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		stored, err := pf.GetExpense(1, created.ID)
+		require.NoError(t, err)
+		require.Equal(t, "train tickets", stored.Description())
+		require.Equal(t, "mat", stored.Payer())
+		require.True(t, stored.CreatedAt().Equal(created.CreatedAt))
+
+		is.photos[created.ID+".pdf"] = []byte("%PDF-1.4")
+		rr = serveAPI(t, srv, "DELETE", "/api/v1/expenses/"+created.ID, nil)
+		require.Equal(t, http.StatusNoContent, rr.Code)
+		_, err = pf.GetExpense(1, created.ID)
+		require.ErrorIs(t, err, model.ErrNotFound)
+		require.Nil(t, is.getPhoto(stored, ".pdf"))
+
+		rr = serveAPI(t, srv, "GET", "/api/v1/expenses/"+created.ID, nil)
+		requireAPIError(t, rr, http.StatusNotFound, "not_found")
+	})
+
+	t.Run("should_return_404_for_missing_expense", func(t *testing.T) {
+		for _, method := range []string{"GET", "PUT", "DELETE"} {
+			t.Run(method, func(t *testing.T) {
+				rr := serveAPI(t, srv, method, "/api/v1/expenses/00000000-0000-0000-0000-000000000000", map[string]any{})
+				requireAPIError(t, rr, http.StatusNotFound, "not_found")
+			})
+		}
+	})
+
+	t.Run("should_return_400_for_invalid_expenses", func(t *testing.T) {
+		valid := func() map[string]any {
+			return map[string]any{
+				"description": "d",
+				"payer":       "mat",
+				"category":    "food",
+				"amount":      "1.50",
+				"currency":    "PLN",
+			}
+		}
+		tcs := []struct {
+			name   string
+			modify func(map[string]any)
+		}{
+			{name: "no_description", modify: func(m map[string]any) { delete(m, "description") }},
+			{name: "negative_amount", modify: func(m map[string]any) { m["amount"] = "-1" }},
+			{name: "amount_not_a_number", modify: func(m map[string]any) { m["amount"] = "1,50" }},
+			{name: "unknown_payer", modify: func(m map[string]any) { m["payer"] = "nobody" }},
+			{name: "unknown_category", modify: func(m map[string]any) { m["category"] = "nothing" }},
+			{name: "unknown_field", modify: func(m map[string]any) { m["tip"] = "5" }},
+		}
+		for _, tc := range tcs {
+			t.Run(tc.name, func(t *testing.T) {
+				body := valid()
+				tc.modify(body)
+				rr := serveAPI(t, srv, "POST", "/api/v1/expenses", body)
+				requireAPIError(t, rr, http.StatusBadRequest, "invalid_request")
+			})
+		}
+
+		t.Run("not_json", func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/v1/expenses", strings.NewReader("description=d"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := serveAPIRequest(t, srv, req)
+			requireAPIError(t, rr, http.StatusUnsupportedMediaType, "unsupported_media_type")
+		})
+	})
+
+	t.Run("should_create_expense_with_photo", func(t *testing.T) {
+		body, contentType := multipartBody(t, map[string]string{
+			"description": "receipt",
+			"payer":       "mat",
+			"category":    "food",
+			"amount":      "3.20",
+			"currency":    "PLN",
+			"created_at":  "2024-06-01T10:00:00Z",
+		}, []byte("%PDF-1.4\nreceipt"))
+		req := httptest.NewRequest("POST", "/api/v1/expenses", body)
+		req.Header.Set("Content-Type", contentType)
+		rr := serveAPIRequest(t, srv, req)
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+
+		var created apiExpense
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+		require.True(t, created.CreatedAt.Equal(time.Date(2024, time.June, 1, 10, 0, 0, 0, time.UTC)))
+
+		rr = serveAPI(t, srv, "GET", "/api/v1/expenses/"+created.ID+"/photo", nil)
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Equal(t, "%PDF-1.4\nreceipt", rr.Body.String())
+	})
+
+	t.Run("should_replace_photo", func(t *testing.T) {
+		exp := pf.expenses[0]
+		is.photos[exp.ID()+".pdf"] = []byte("%PDF-1.4\nold")
+
+		body, contentType := multipartBody(t, nil, []byte("GIF89a new"))
+		req := httptest.NewRequest("PUT", "/api/v1/expenses/"+exp.ID()+"/photo", body)
+		req.Header.Set("Content-Type", contentType)
+		rr := serveAPIRequest(t, srv, req)
+		require.Equal(t, http.StatusNoContent, rr.Code, rr.Body.String())
+		require.Nil(t, is.getPhoto(exp, ".pdf"))
+		require.Equal(t, []byte("GIF89a new"), is.getPhoto(exp, ".gif"))
+	})
+
+	t.Run("should_reject_unsupported_photo", func(t *testing.T) {
+		exp := pf.expenses[0]
+		body, contentType := multipartBody(t, nil, []byte("#!/bin/sh"))
+		req := httptest.NewRequest("PUT", "/api/v1/expenses/"+exp.ID()+"/photo", body)
+		req.Header.Set("Content-Type", contentType)
+		rr := serveAPIRequest(t, srv, req)
+		requireAPIError(t, rr, http.StatusUnsupportedMediaType, "unsupported_media_type")
+	})
+
+	t.Run("should_fail_for_corrupted_photo", func(t *testing.T) {
+		exp := pf.expenses[0]
+		is.loadErr = model.ErrPhotoCorrupted
+		defer func() { is.loadErr = nil }()
+		rr := serveAPI(t, srv, "GET", "/api/v1/expenses/"+exp.ID()+"/photo", nil)
+		requireAPIError(t, rr, http.StatusInternalServerError, "internal")
+	})
+
+	t.Run("should_return_404_for_missing_photo", func(t *testing.T) {
+		exp := pf.expenses[1]
+		rr := serveAPI(t, srv, "GET", "/api/v1/expenses/"+exp.ID()+"/photo", nil)
+		requireAPIError(t, rr, http.StatusNotFound, "not_found")
+	})
+}
+
+func TestAPINames(t *testing.T) {
+	pf := newPersistenceFake()
+	h, err := handler.NewHandler(pf, newImagestoreFake())
+	require.NoError(t, err)
+
+	srv := loggedIn(t, h, pf, false)
+
+	for _, kind := range []string{"payers", "categories"} {
+		t.Run(kind, func(t *testing.T) {
+			rr := serveAPI(t, srv, "GET", "/api/v1/"+kind, nil)
+			require.Equal(t, http.StatusOK, rr.Code)
+			require.JSONEq(t, `{"items":[]}`, rr.Body.String())
+
+			rr = serveAPI(t, srv, "POST", "/api/v1/"+kind, map[string]any{"name": "  new  "})
+			require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+			require.JSONEq(t, `{"name":"new"}`, rr.Body.String())
+
+			rr = serveAPI(t, srv, "POST", "/api/v1/"+kind, map[string]any{"name": "new"})
+			requireAPIError(t, rr, http.StatusConflict, "conflict")
+
+			rr = serveAPI(t, srv, "POST", "/api/v1/"+kind, map[string]any{"name": ""})
+			requireAPIError(t, rr, http.StatusBadRequest, "invalid_request")
+
+			rr = serveAPI(t, srv, "GET", "/api/v1/"+kind, nil)
+			require.JSONEq(t, `{"items":["new"]}`, rr.Body.String())
+
+			rr = serveAPI(t, srv, "DELETE", "/api/v1/"+kind+"/new", nil)
+			require.Equal(t, http.StatusNoContent, rr.Code)
+
+			rr = serveAPI(t, srv, "DELETE", "/api/v1/"+kind+"/new", nil)
+			requireAPIError(t, rr, http.StatusNotFound, "not_found")
+		})
+	}
+
+	t.Run("should_not_remove_used_names", func(t *testing.T) {
+		pf.payers = []string{"mat"}
+		pf.categories = []string{"food"}
+		exp, err := model.ExpenseBuilder{
+			Description: "d",
+			Payer:       "mat",
+			Category:    "food",
+			Amount:      "1",
+			Currency:    "PLN",
+			CreatedAt:   time.Now(),
+		}.Build()
+		require.NoError(t, err)
+		require.NoError(t, pf.Insert(1, exp))
+
+		rr := serveAPI(t, srv, "DELETE", "/api/v1/payers/mat", nil)
+		requireAPIError(t, rr, http.StatusConflict, "conflict")
+		rr = serveAPI(t, srv, "DELETE", "/api/v1/categories/food", nil)
+		requireAPIError(t, rr, http.StatusConflict, "conflict")
+	})
+}
+
+// serveAPI sends body, when not nil, encoded as JSON.
+func serveAPI(t *testing.T, srv http.Handler, method, target string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		require.NoError(t, err)
+		r = bytes.NewReader(encoded)
+	}
+	req := httptest.NewRequest(method, target, r)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return serveAPIRequest(t, srv, req)
+}
+
+// serveAPIRequest serves req and requires the exchange to match the
+// OpenAPI document.
+func serveAPIRequest(t *testing.T, srv http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	rr, err := handler.ServeAPI(srv, req)
+	require.NoError(t, err)
+	return rr
+}
+
+func multipartBody(t *testing.T, fields map[string]string, photo []byte) (io.Reader, string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for k, v := range fields {
+		require.NoError(t, writer.WriteField(k, v))
+	}
+	fw, err := writer.CreateFormFile("photo", "photo")
+	require.NoError(t, err)
+	_, err = fw.Write(photo)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return body, writer.FormDataContentType()
+}
+
+func requireAPIError(t *testing.T, rr *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	require.Equal(t, status, rr.Code, rr.Body.String())
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	var body apiError
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	require.Equal(t, code, body.Error.Code)
+	require.NotEmpty(t, body.Error.Message)
+}
@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matmazurk/acc2/model"
+)
+
+const (
+	sessionCookie = "acc2_session"
+	sessionTTL    = 30 * 24 * time.Hour
+)
+
+// dummyPasswordHash is checked against when a user does not exist, so
+// failed logins take the same time whether or not the user exists.
+var dummyPasswordHash = func() string {
+	u, err := model.NewUser("dummy", "dummy password", false)
+	if err != nil {
+		panic(err)
+	}
+	return u.PasswordHash
+}()
+
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	csrfKey
+	ledgerKey
+	tokenKey
+)
+
+// currentUser returns the user authenticated by the session or the api
+// token of r.
+func currentUser(r *http.Request) (model.User, bool) {
+	u, ok := r.Context().Value(userKey).(model.User)
+	return u, ok
+}
+
+// userName returns the name of the user of r, empty when there is none.
+func userName(r *http.Request) string {
+	u, _ := currentUser(r)
+	return u.Name
+}
+
+// authenticated lets through requests with a valid session cookie, and
+// api requests with a valid api token. Other requests to the api get 401,
+// page requests are sent to the login page.
+func (h handler) authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if raw, ok := bearerToken(r); ok {
+			h.tokenAuthenticated(w, r, raw, next)
+			return
+		}
+
+		s, err := h.session(r)
+		if err != nil {
+			if !errors.Is(err, model.ErrNotFound) {
+				h.logger.Error().Err(err).Msg("could not get session")
+			}
+			h.unauthenticated(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, s.User)))
+	})
+}
+
+func (h handler) session(r *http.Request) (model.Session, error) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return model.Session{}, model.ErrNotFound
+	}
+	return h.pers.GetSession(hashToken(c.Value))
+}
+
+func (h handler) unauthenticated(w http.ResponseWriter, r *http.Request) {
+	login := "/login?next=" + url.QueryEscape(r.URL.RequestURI())
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api/"):
+		writeAPIError(w, http.StatusUnauthorized, codeUnauthorized, "login required")
+	case r.Header.Get("HX-Request") == "true":
+		// htmx swaps responses into the page, so make it load the login page
+		w.Header().Set("HX-Redirect", login)
+		w.WriteHeader(http.StatusUnauthorized)
+	default:
+		http.Redirect(w, r, login, http.StatusSeeOther)
+	}
+}
+
+// forbidden tells the user why the request was rejected.
+func (h handler) forbidden(w http.ResponseWriter, r *http.Request, reason error) {
+	type data struct {
+		Reason string
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeAPIError(w, http.StatusForbidden, codeForbidden, reason.Error())
+		return
+	}
+	w.WriteHeader(http.StatusForbidden)
+	h.templates.ExecuteTemplate(w, "forbidden.html", data{Reason: reason.Error()})
+}
+
+func (h handler) GetLogin() http.HandlerFunc {
+	type data struct {
+		Next      string
+		Error     string
+		CSRFToken string
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.templates.ExecuteTemplate(w, "login.html", data{Next: r.URL.Query().Get("next"), CSRFToken: csrfToken(r)})
+	})
+}
+
+func (h handler) Login() http.HandlerFunc {
+	type data struct {
+		Next      string
+		Error     string
+		CSRFToken string
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		name := r.PostFormValue("name")
+		password := r.PostFormValue("password")
+		next := r.PostFormValue("next")
+
+		u, err := h.pers.GetUser(name)
+		if err != nil && !errors.Is(err, model.ErrNotFound) {
+			h.logger.Error().Err(err).Msg("could not get user")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			u = model.User{PasswordHash: dummyPasswordHash}
+		}
+		if !u.CheckPassword(password) || err != nil {
+			h.logger.Warn().Str("user", name).Msg("failed login")
+			w.WriteHeader(http.StatusUnauthorized)
+			h.templates.ExecuteTemplate(w, "login.html", data{Next: next, Error: "invalid name or password", CSRFToken: csrfToken(r)})
+			return
+		}
+
+		token, err := newToken()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		now := time.Now()
+		err = h.pers.CreateSession(model.Session{
+			TokenHash: hashToken(token),
+			User:      u,
+			CreatedAt: now,
+			ExpiresAt: now.Add(sessionTTL),
+		})
+		if err != nil {
+			h.logger.Error().Err(err).Msg("could not create session")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		http.SetCookie(w, h.sessionCookie(token, int(sessionTTL.Seconds())))
+		http.Redirect(w, r, localRedirect(next), http.StatusSeeOther)
+	})
+}
+
+func (h handler) Logout() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			err := h.pers.RemoveSession(hashToken(c.Value))
+			if err != nil {
+				h.logger.Error().Err(err).Msg("could not remove session")
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+		}
+
+		http.SetCookie(w, h.sessionCookie("", -1))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	})
+}
+
+func (h handler) sessionCookie(token string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   !h.insecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// localRedirect returns next when it is a path of this server, so the
+// login form can not be used to redirect elsewhere.
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,159 @@
+package handler_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matmazurk/acc2/http/handler"
+	"github.com/matmazurk/acc2/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuth(t *testing.T) {
+	pf := newPersistenceFake()
+	h, err := handler.NewHandler(pf, newImagestoreFake())
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	h.Routes(mux)
+
+	u, err := model.NewUser("mat", testPassword, false)
+	require.NoError(t, err)
+	pf.addUser(u)
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("should_redirect_pages_to_login", func(t *testing.T) {
+		for _, path := range []string{"/", "/expenses/add", "/categories/add"} {
+			rr := serve(httptest.NewRequest("GET", path, nil))
+			require.Equal(t, http.StatusSeeOther, rr.Code, path)
+			require.Equal(t, "/login?next="+url.QueryEscape(path), rr.Header().Get("Location"))
+		}
+	})
+
+	t.Run("should_not_run_mutations_without_session", func(t *testing.T) {
+		rr := serve(httptest.NewRequest("POST", "/categories", strings.NewReader("category=new")))
+		require.Equal(t, http.StatusSeeOther, rr.Code)
+		require.Empty(t, pf.categories)
+	})
+
+	t.Run("should_make_htmx_load_login_page", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/expenses/add", nil)
+		req.Header.Set("HX-Request", "true")
+		rr := serve(req)
+		require.Equal(t, http.StatusUnauthorized, rr.Code)
+		require.Equal(t, "/login?next=%2Fexpenses%2Fadd", rr.Header().Get("HX-Redirect"))
+	})
+
+	t.Run("should_return_401_for_api", func(t *testing.T) {
+		rr := serveAPIRequest(t, mux, httptest.NewRequest("GET", "/api/v1/expenses", nil))
+		requireAPIError(t, rr, http.StatusUnauthorized, "unauthorized")
+	})
+
+	t.Run("should_serve_login_page_and_assets_without_session", func(t *testing.T) {
+		rr := serve(httptest.NewRequest("GET", "/login?next=/expenses/add", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Contains(t, rr.Body.String(), `name="next" value="/expenses/add"`)
+
+		rr = serve(httptest.NewRequest("GET", "/src/output.css", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+	})
+
+	t.Run("should_reject_invalid_credentials", func(t *testing.T) {
+		for _, tc := range []struct{ name, password string }{
+			{"mat", "wrong password"},
+			{"nobody", testPassword},
+			{"", ""},
+		} {
+			require.Nil(t, login(t, mux, tc.name, tc.password))
+		}
+		require.Empty(t, pf.sessions)
+
+		rr := postLogin(t, mux, url.Values{"name": {"mat"}, "password": {"wrong"}})
+		require.Equal(t, http.StatusUnauthorized, rr.Code)
+		require.Contains(t, rr.Body.String(), "invalid name or password")
+	})
+
+	t.Run("should_log_in_with_secure_cookie", func(t *testing.T) {
+		rr := postLogin(t, mux, url.Values{"name": {"mat"}, "password": {testPassword}, "next": {"/expenses/add"}})
+		require.Equal(t, http.StatusSeeOther, rr.Code)
+		require.Equal(t, "/expenses/add", rr.Header().Get("Location"))
+
+		cookies := rr.Result().Cookies()
+		require.Len(t, cookies, 1)
+		c := cookies[0]
+		require.True(t, c.HttpOnly)
+		require.True(t, c.Secure)
+		require.Equal(t, http.SameSiteLaxMode, c.SameSite)
+		require.Positive(t, c.MaxAge)
+
+		// only the hash of the token is stored
+		require.Len(t, pf.sessions, 1)
+		for hash, s := range pf.sessions {
+			require.NotEqual(t, c.Value, hash)
+			require.Equal(t, "mat", s.User.Name)
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(c)
+		require.Equal(t, http.StatusOK, serve(req).Code)
+	})
+
+	t.Run("should_only_redirect_to_local_paths", func(t *testing.T) {
+		for _, next := range []string{"https://example.com/", "//example.com/", "/\\example.com", ""} {
+			rr := postLogin(t, mux, url.Values{"name": {"mat"}, "password": {testPassword}, "next": {next}})
+			require.Equal(t, "/", rr.Header().Get("Location"), next)
+		}
+	})
+
+	t.Run("should_reject_expired_session", func(t *testing.T) {
+		c := login(t, mux, "mat", testPassword)
+		for hash, s := range pf.sessions {
+			s.ExpiresAt = time.Now().Add(-time.Minute)
+			pf.sessions[hash] = s
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(c)
+		require.Equal(t, http.StatusSeeOther, serve(req).Code)
+	})
+
+	t.Run("should_log_out", func(t *testing.T) {
+		c := login(t, mux, "mat", testPassword)
+		sessions := len(pf.sessions)
+
+		req := withCSRF(httptest.NewRequest("POST", "/logout", nil), csrfCookie(t, mux))
+		req.AddCookie(c)
+		rr := serve(req)
+		require.Equal(t, http.StatusSeeOther, rr.Code)
+		require.Equal(t, "/login", rr.Header().Get("Location"))
+		require.Len(t, pf.sessions, sessions-1)
+		cookies := rr.Result().Cookies()
+		require.Len(t, cookies, 1)
+		require.Negative(t, cookies[0].MaxAge)
+
+		req = httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(c)
+		require.Equal(t, http.StatusSeeOther, serve(req).Code)
+	})
+
+	t.Run("should_drop_secure_attribute_for_insecure_cookies", func(t *testing.T) {
+		h, err := handler.NewHandler(pf, newImagestoreFake(), handler.WithInsecureCookies())
+		require.NoError(t, err)
+		mux := http.NewServeMux()
+		h.Routes(mux)
+
+		c := login(t, mux, "mat", testPassword)
+		require.NotNil(t, c)
+		require.False(t, c.Secure)
+		require.True(t, c.HttpOnly)
+	})
+}
@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CSRF protection uses double-submit cookies: every browser gets a random
+// token in csrfCookie, and requests changing state must send the same
+// token back in csrfHeader or, for html forms, in the csrfField form value.
+// Other sites can make browsers send the cookie but can not read it.
+const (
+	csrfCookie = "acc2_csrf"
+	csrfHeader = "X-CSRF-Token"
+	csrfField  = "csrf_token"
+)
+
+var (
+	errCrossOrigin  = errors.New("request comes from another site")
+	errInvalidToken = errors.New("missing or invalid csrf token, reload the page and try again")
+)
+
+// csrfToken returns the token forms rendered for r must submit.
+func csrfToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfKey).(string)
+	return token
+}
+
+// csrfProtected makes sure the browser has a csrf token and rejects
+// requests changing state which do not come from our pages.
+func (h handler) csrfProtected(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// browsers never send api tokens on their own, so requests
+		// authenticated by them can not be forged
+		if _, ok := currentToken(r); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var token string
+		if c, err := r.Cookie(csrfCookie); err == nil {
+			token = c.Value
+		}
+		if token == "" {
+			var err error
+			token, err = newToken()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			http.SetCookie(w, h.csrfCookie(token))
+		}
+
+		if !safeMethod(r.Method) {
+			err := checkCSRF(w, r, token)
+			if err != nil {
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					h.logger.Warn().Err(err).Msg("received too large request")
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+					w.Write([]byte(err.Error()))
+					return
+				}
+				h.logger.Warn().Err(err).Str("method", r.Method).Str("path", r.URL.Path).Msg("rejected request")
+				h.forbidden(w, r, err)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfKey, token)))
+	})
+}
+
+// checkCSRF checks the origin of r and the token it submitted. Api
+// requests must send the token in a header, so their bodies are left to
+// the handlers.
+func checkCSRF(w http.ResponseWriter, r *http.Request, token string) error {
+	err := checkOrigin(r)
+	if err != nil {
+		return err
+	}
+
+	submitted := r.Header.Get(csrfHeader)
+	if submitted == "" && !strings.HasPrefix(r.URL.Path, "/api/") {
+		submitted, err = formToken(w, r)
+		if err != nil {
+			return err
+		}
+	}
+	if submitted == "" || subtle.ConstantTimeCompare([]byte(submitted), []byte(token)) != 1 {
+		return errInvalidToken
+	}
+
+	return nil
+}
+
+// checkOrigin rejects requests whose Origin, or Referer when there is no
+// Origin, is not this server. Requests with neither are left to the token
+// check, as some browsers and proxies strip both.
+func checkOrigin(r *http.Request) error {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return nil
+	}
+
+	u, err := url.Parse(source)
+	if err != nil || u.Host != r.Host {
+		return fmt.Errorf("%w: %s", errCrossOrigin, source)
+	}
+	return nil
+}
+
+// formToken parses the form of r, within the body limit of its route, and
+// returns its csrf token.
+func formToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		err := r.ParseMultipartForm(10 << 20)
+		if err != nil {
+			return "", err
+		}
+	}
+	err := r.ParseForm()
+	if err != nil {
+		return "", err
+	}
+
+	return r.PostFormValue(csrfField), nil
+}
+
+// csrfCookie is readable by scripts, so api clients in the browser can
+// send the token in csrfHeader.
+func (h handler) csrfCookie(token string) *http.Cookie {
+	return &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(sessionTTL.Seconds()),
+		Secure:   !h.insecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
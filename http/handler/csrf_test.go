@@ -0,0 +1,160 @@
+package handler_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/matmazurk/acc2/http/handler"
+	"github.com/matmazurk/acc2/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCSRF(t *testing.T) {
+	pf := newPersistenceFake()
+	h, err := handler.NewHandler(pf, newImagestoreFake())
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	h.Routes(mux)
+
+	u, err := model.NewUser("mat", testPassword, false)
+	require.NoError(t, err)
+	pf.addUser(u)
+	session := login(t, mux, "mat", testPassword)
+	require.NotNil(t, session)
+	csrf := csrfCookie(t, mux)
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		req.AddCookie(session)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	postCategory := func(form url.Values) *http.Request {
+		req := httptest.NewRequest("POST", "/categories", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+
+	t.Run("should_set_token_cookie", func(t *testing.T) {
+		require.NotEmpty(t, csrf.Value)
+		require.False(t, csrf.HttpOnly)
+		require.True(t, csrf.Secure)
+		require.Equal(t, http.SameSiteLaxMode, csrf.SameSite)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(csrf)
+		rr := serve(req)
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Empty(t, rr.Result().Cookies())
+	})
+
+	t.Run("should_put_token_into_pages", func(t *testing.T) {
+		for _, path := range []string{"/", "/expenses/add", "/categories/add", "/login"} {
+			req := httptest.NewRequest("GET", path, nil)
+			req.AddCookie(csrf)
+			rr := serve(req)
+			require.Equal(t, http.StatusOK, rr.Code, path)
+			require.Contains(t, rr.Body.String(), `name="csrf_token" value="`+csrf.Value+`"`, path)
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(csrf)
+		require.Contains(t, serve(req).Body.String(), `hx-headers='{"X-CSRF-Token": "`+csrf.Value+`"}'`)
+	})
+
+	t.Run("should_reject_form_without_token", func(t *testing.T) {
+		req := postCategory(url.Values{"category": {"groceries"}})
+		req.AddCookie(csrf)
+		rr := serve(req)
+		require.Equal(t, http.StatusForbidden, rr.Code)
+		require.Contains(t, rr.Body.String(), "missing or invalid csrf token")
+		require.Empty(t, pf.categories)
+	})
+
+	t.Run("should_reject_form_with_other_token", func(t *testing.T) {
+		req := postCategory(url.Values{"category": {"groceries"}, "csrf_token": {"other"}})
+		req.AddCookie(csrf)
+		require.Equal(t, http.StatusForbidden, serve(req).Code)
+
+		// a token without its cookie is no good either
+		req = postCategory(url.Values{"category": {"groceries"}, "csrf_token": {csrf.Value}})
+		require.Equal(t, http.StatusForbidden, serve(req).Code)
+		require.Empty(t, pf.categories)
+	})
+
+	t.Run("should_accept_token_in_form", func(t *testing.T) {
+		req := postCategory(url.Values{"category": {"groceries"}, "csrf_token": {csrf.Value}})
+		req.AddCookie(csrf)
+		require.Equal(t, http.StatusFound, serve(req).Code)
+		require.Equal(t, []string{"groceries"}, pf.categories)
+	})
+
+	t.Run("should_accept_token_in_multipart_form", func(t *testing.T) {
+		body, contentType := multipartBody(t, map[string]string{
+			"description": "bread",
+			"amount":      "4.5",
+			"currency":    "zł",
+			"author":      "mat",
+			"category":    "groceries",
+			"csrf_token":  csrf.Value,
+		}, []byte("%PDF-1.4"))
+		req := httptest.NewRequest("POST", "/expenses", body)
+		req.Header.Set("Content-Type", contentType)
+		req.AddCookie(csrf)
+		require.Equal(t, http.StatusFound, serve(req).Code)
+		require.Len(t, pf.expenses, 1)
+	})
+
+	t.Run("should_check_origin", func(t *testing.T) {
+		for _, tc := range []struct {
+			name   string
+			header string
+			value  string
+			status int
+		}{
+			{"same_origin", "Origin", "http://example.com", http.StatusFound},
+			{"other_origin", "Origin", "https://evil.example", http.StatusForbidden},
+			{"opaque_origin", "Origin", "null", http.StatusForbidden},
+			{"same_referer", "Referer", "http://example.com/categories/add", http.StatusFound},
+			{"other_referer", "Referer", "https://evil.example/form", http.StatusForbidden},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				req := withCSRF(postCategory(url.Values{"category": {tc.name}}), csrf)
+				req.Header.Set(tc.header, tc.value)
+				rr := serve(req)
+				require.Equal(t, tc.status, rr.Code)
+				if tc.status == http.StatusForbidden {
+					require.Contains(t, rr.Body.String(), "request comes from another site")
+				}
+			})
+		}
+	})
+
+	t.Run("should_reject_login_without_token", func(t *testing.T) {
+		form := url.Values{"name": {"mat"}, "password": {testPassword}}
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusForbidden, rr.Code)
+	})
+
+	t.Run("should_require_header_for_api", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/api/v1/categories", strings.NewReader(`{"name":"bills"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(session)
+		req.AddCookie(csrf)
+		rr := serveAPIRequest(t, mux, req)
+		requireAPIError(t, rr, http.StatusForbidden, "forbidden")
+
+		req = withCSRF(httptest.NewRequest("POST", "/api/v1/categories", strings.NewReader(`{"name":"bills"}`)), csrf)
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(session)
+		rr = serveAPIRequest(t, mux, req)
+		require.Equal(t, http.StatusCreated, rr.Code)
+	})
+}
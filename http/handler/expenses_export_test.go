@@ -0,0 +1,46 @@
+package handler_test
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matmazurk/acc2/http/handler"
+	"github.com/matmazurk/acc2/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportExpenses(t *testing.T) {
+	pf := newPersistenceFake()
+	h, err := handler.NewHandler(pf, newImagestoreFake())
+	require.NoError(t, err)
+	srv := loggedIn(t, h, pf, false)
+	pf.grant(1, "user", model.RoleViewer)
+
+	exp, err := model.ExpenseBuilder{
+		Description: "groceries, weekly",
+		Payer:       "mat",
+		Category:    "food",
+		Amount:      "10.50",
+		Currency:    "PLN",
+		CreatedAt:   time.Date(2024, time.April, 10, 11, 40, 0, 0, time.UTC),
+		CreatedBy:   "user",
+	}.Build()
+	require.NoError(t, err)
+	require.NoError(t, pf.Insert(1, exp))
+
+	rr := httptest.NewRecorder()
+	srv.ServeHTTP(rr, httptest.NewRequest("GET", "/expenses/export", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "text/csv; charset=utf-8", rr.Header().Get("Content-Type"))
+	require.Contains(t, rr.Header().Get("Content-Disposition"), `attachment; filename=default-expenses-`)
+
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, [][]string{
+		{"id", "created_at", "description", "payer", "category", "amount", "currency", "created_by"},
+		{exp.ID(), "2024-04-10T13:40:00+02:00", "groceries, weekly", "mat", "food", "10.50", "PLN", "user"},
+	}, records)
+}
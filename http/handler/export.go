@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"encoding/csv"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// ExportExpenses serves the expenses of the current ledger as a CSV file.
+func (h handler) ExportExpenses() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := currentLedger(r)
+		exps, err := h.pers.SelectExpenses(l.ID)
+		if err != nil {
+			h.logger.Error().Err(err).Msg("could not select expenses to export")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		filename := l.Name + "-expenses-" + time.Now().In(h.location).Format(time.DateOnly) + ".csv"
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"id", "created_at", "description", "payer", "category", "amount", "currency", "created_by"})
+		for _, e := range exps {
+			cw.Write([]string{
+				e.ID(),
+				e.CreatedAt().In(h.location).Format(time.RFC3339),
+				e.Description(),
+				e.Payer(),
+				e.Category(),
+				e.Amount(),
+				e.Currency(),
+				e.CreatedBy(),
+			})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			h.logger.Error().Err(err).Msg("could not write expenses export")
+		}
+	})
+}
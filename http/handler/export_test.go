@@ -0,0 +1,15 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+)
+
+// ServeAPI serves req with srv and checks the exchange against the
+// OpenAPI document.
+func ServeAPI(srv http.Handler, req *http.Request) (*httptest.ResponseRecorder, error) {
+	body := readBody(req)
+	rr := httptest.NewRecorder()
+	srv.ServeHTTP(rr, req)
+	return rr, validateAPIExchange(req, body, rr)
+}
@@ -4,8 +4,10 @@ import (
 	"embed"
 	"html/template"
 	"io"
+	"io/fs"
 	"time"
 
+	"github.com/matmazurk/acc2/backup"
 	"github.com/matmazurk/acc2/model"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
@@ -14,32 +16,129 @@ import (
 //go:embed templates/*.html
 var content embed.FS
 
+// Persistence stores expenses, payers and categories of ledgers, and the
+// users who are their members. Methods taking a ledgerID never return
+// or change rows of other ledgers.
 type Persistence interface {
-	Insert(e model.Expense) error
-	RemoveExpense(e model.Expense) error
-	SelectExpenses() ([]model.Expense, error)
-	CreatePayer(name string) error
-	CreateCategory(name string) error
-	ListPayers() ([]string, error)
-	ListCategories() ([]string, error)
+	Insert(ledgerID int64, e model.Expense) error
+	RemoveExpense(ledgerID int64, e model.Expense) error
+	SelectExpenses(ledgerID int64) ([]model.Expense, error)
+	GetExpense(ledgerID int64, id string) (model.Expense, error)
+	QueryExpenses(ledgerID int64, q model.ExpenseQuery) ([]model.Expense, int, error)
+	UpdateExpense(ledgerID int64, e model.Expense) error
+	CreatePayer(ledgerID int64, name string) error
+	CreateCategory(ledgerID int64, name string) error
+	ListPayers(ledgerID int64) ([]string, error)
+	ListCategories(ledgerID int64) ([]string, error)
+	RemovePayer(ledgerID int64, name string) error
+	RemoveCategory(ledgerID int64, name string) error
+	// ListPayerLinks returns payers with the users they are linked to
+	ListPayerLinks(ledgerID int64) ([]model.Payer, error)
+	// CreateLinkedPayer creates a payer linked to a user in one step
+	CreateLinkedPayer(ledgerID int64, payer, user string) error
+	// LinkPayer links a payer to a user, or unlinks it when user is empty
+	LinkPayer(ledgerID int64, payer, user string) error
+	// UserLedgers returns the ledgers the user is a member of
+	UserLedgers(userID int64) ([]model.Ledger, error)
+	GetUser(name string) (model.User, error)
+	ListUsers() ([]model.User, error)
+	CreateSession(s model.Session) error
+	// GetSession returns unexpired sessions only
+	GetSession(tokenHash string) (model.Session, error)
+	RemoveSession(tokenHash string) error
+	CreateAPIToken(t model.APIToken) error
+	GetAPIToken(tokenHash string) (model.APIToken, error)
+	ListAPITokens(userID int64) ([]model.APIToken, error)
+	RevokeAPIToken(userID int64, name string) error
+	// TouchAPIToken records the token was used at
+	TouchAPIToken(id int64, at time.Time) error
 }
 
 type Imagestore interface {
 	SaveExpensePhoto(e model.Expense, fileExtension string, r io.ReadCloser) error
-	LoadExpensePhoto(e model.Expense) (io.ReadCloser, error)
+	LoadExpensePhoto(e model.Expense) (model.Photo, error)
+	RemoveExpensePhoto(e model.Expense) error
+}
+
+// Backups makes and gives access to backup archives.
+type Backups interface {
+	// WriteBackup streams a new archive to w
+	WriteBackup(w io.Writer) error
+	List() ([]fs.FileInfo, error)
+	Open(name string) (io.ReadSeekCloser, fs.FileInfo, error)
+}
+
+// BackupVerifier reports the outcome of the last backup verification.
+type BackupVerifier interface {
+	LastReport() (backup.VerifyReport, bool)
 }
 
 type handler struct {
 	pers      Persistence
 	store     Imagestore
+	backups   Backups
+	verifier  BackupVerifier
 	templates *template.Template
 	location  *time.Location
 	logger    zerolog.Logger
+	// insecureCookies drops the Secure attribute of session cookies
+	insecureCookies bool
+	rateLimits      RateLimits
+	limiters        limiters
+	bodyLimits      BodyLimits
+}
+
+type Option func(*handler)
+
+// WithBackups enables the admin backup pages.
+func WithBackups(b Backups) Option {
+	return func(h *handler) {
+		h.backups = b
+	}
+}
+
+// WithBackupVerifier shows the last backup verification on the admin
+// backup page.
+func WithBackupVerifier(v BackupVerifier) Option {
+	return func(h *handler) {
+		h.verifier = v
+	}
+}
+
+// WithInsecureCookies lets session cookies be sent over plain http, for
+// servers reached without TLS.
+func WithInsecureCookies() Option {
+	return func(h *handler) {
+		h.insecureCookies = true
+	}
+}
+
+// WithLogger logs handled requests and failures to l, nothing is logged
+// by default.
+func WithLogger(l zerolog.Logger) Option {
+	return func(h *handler) {
+		h.logger = l
+	}
+}
+
+// WithRateLimits limits request rates, nothing is limited by default.
+func WithRateLimits(l RateLimits) Option {
+	return func(h *handler) {
+		h.rateLimits = l
+	}
+}
+
+// WithBodyLimits replaces DefaultBodyLimits.
+func WithBodyLimits(l BodyLimits) Option {
+	return func(h *handler) {
+		h.bodyLimits = l
+	}
 }
 
 func NewHandler(
 	p Persistence,
 	is Imagestore,
+	opts ...Option,
 ) (handler, error) {
 	templates, err := template.ParseFS(content, "templates/*.html")
 	if err != nil {
@@ -49,10 +148,17 @@ func NewHandler(
 	if err != nil {
 		return handler{}, errors.Wrap(err, "could not load Europe/Warsaw location")
 	}
-	return handler{
-		pers:      p,
-		store:     is,
-		templates: templates,
-		location:  loc,
-	}, nil
+	h := handler{
+		pers:       p,
+		store:      is,
+		templates:  templates,
+		location:   loc,
+		bodyLimits: DefaultBodyLimits,
+	}
+	for _, opt := range opts {
+		opt(&h)
+	}
+	h.limiters = newLimiters(h.rateLimits)
+
+	return h, nil
 }
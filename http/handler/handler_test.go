@@ -2,12 +2,28 @@ package handler_test
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
 	"io"
+	"io/fs"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/matmazurk/acc2/backup"
 	"github.com/matmazurk/acc2/http/handler"
 	"github.com/matmazurk/acc2/model"
 	"github.com/stretchr/testify/require"
@@ -19,8 +35,7 @@ func TestExpenses(t *testing.T) {
 	h, err := handler.NewHandler(pf, is)
 	require.NoError(t, err)
 
-	mux := http.NewServeMux()
-	h.Routes(mux)
+	srv := loggedIn(t, h, pf, false)
 
 	t.Run("should_return_400_for_invalid_forms", func(t *testing.T) {
 		tcs := []struct {
@@ -88,7 +103,7 @@ func TestExpenses(t *testing.T) {
 
 				rr := httptest.NewRecorder()
 
-				mux.ServeHTTP(rr, req)
+				srv.ServeHTTP(rr, req)
 				if rr.Result().StatusCode != http.StatusBadRequest {
 					t.Logf("body:'%s'", rr.Body.String())
 					t.Fatalf("received status code different than expected:\n%d != %d", rr.Result().StatusCode, http.StatusBadRequest)
@@ -117,7 +132,7 @@ func TestExpenses(t *testing.T) {
 		req.Header.Set("Content-Type", writer.FormDataContentType())
 
 		rr := httptest.NewRecorder()
-		mux.ServeHTTP(rr, req)
+		srv.ServeHTTP(rr, req)
 
 		if rr.Result().StatusCode != http.StatusFound {
 			t.Logf("body:'%s'", rr.Body.String())
@@ -131,58 +146,692 @@ func TestExpenses(t *testing.T) {
 	})
 }
 
+func TestAddExpensePhoto(t *testing.T) {
+	pf := newPersistenceFake()
+	is := newImagestoreFake()
+	h, err := handler.NewHandler(pf, is)
+	require.NoError(t, err)
+
+	srv := loggedIn(t, h, pf, false)
+
+	postExpense := func(t *testing.T, photo []byte) *httptest.ResponseRecorder {
+		t.Helper()
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for k, v := range map[string]string{
+			"description": "receipt",
+			"author":      "some payer",
+			"category":    "some category",
+			"amount":      "10.00",
+			"currency":    "EUR",
+		} {
+			writer.WriteField(k, v)
+		}
+		fw, err := writer.CreateFormFile("photo", "receipt.png")
+		require.NoError(t, err)
+		_, err = fw.Write(photo)
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		req := httptest.NewRequest("POST", "/expenses", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("should_reject_unsupported_type", func(t *testing.T) {
+		rr := postExpense(t, []byte("#!/bin/sh\necho definitely not an image"))
+		require.Equal(t, http.StatusUnsupportedMediaType, rr.Code)
+		require.Empty(t, pf.expenses)
+	})
+
+	t.Run("should_reject_too_large_photo", func(t *testing.T) {
+		photo := append([]byte("%PDF-1.4\n"), make([]byte, 11<<20)...)
+		rr := postExpense(t, photo)
+		require.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+		require.Empty(t, pf.expenses)
+	})
+
+	t.Run("should_reject_too_large_request", func(t *testing.T) {
+		photo := append([]byte("%PDF-1.4\n"), make([]byte, 30<<20)...)
+		rr := postExpense(t, photo)
+		require.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+		require.Empty(t, pf.expenses)
+	})
+
+	t.Run("should_store_pdf_by_sniffed_type", func(t *testing.T) {
+		photo := []byte("%PDF-1.4\nsome receipt")
+		rr := postExpense(t, photo)
+		require.Equal(t, http.StatusFound, rr.Code)
+
+		require.Len(t, pf.expenses, 1)
+		require.Equal(t, photo, is.getPhoto(pf.expenses[0], ".pdf"))
+		pf.expenses = nil
+	})
+
+	t.Run("should_reject_jpeg_of_too_many_pixels", func(t *testing.T) {
+		encoded := &bytes.Buffer{}
+		require.NoError(t, jpeg.Encode(encoded, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil))
+		photo := encoded.Bytes()
+		// the frame header declares 65535x65535 pixels
+		sof := bytes.Index(photo, []byte{0xff, 0xc0})
+		require.NotEqual(t, -1, sof)
+		copy(photo[sof+5:], []byte{0xff, 0xff, 0xff, 0xff})
+
+		rr := postExpense(t, photo)
+		require.Equal(t, http.StatusUnsupportedMediaType, rr.Code)
+		require.Contains(t, rr.Body.String(), "65535x65535")
+		require.Empty(t, pf.expenses)
+	})
+
+	t.Run("should_strip_exif_and_apply_orientation", func(t *testing.T) {
+		// left half red, so it ends up as the top half after rotating clockwise
+		img := image.NewRGBA(image.Rect(0, 0, 32, 16))
+		draw.Draw(img, image.Rect(0, 0, 16, 16), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+		encoded := &bytes.Buffer{}
+		require.NoError(t, jpeg.Encode(encoded, img, nil))
+		photo := withEXIFOrientation(encoded.Bytes(), 6)
+
+		rr := postExpense(t, photo)
+		require.Equal(t, http.StatusFound, rr.Code)
+
+		require.Len(t, pf.expenses, 1)
+		stored := is.getPhoto(pf.expenses[0], ".jpeg")
+		require.NotNil(t, stored)
+		require.NotContains(t, string(stored), "Exif")
+		decoded, err := jpeg.Decode(bytes.NewReader(stored))
+		require.NoError(t, err)
+		require.Equal(t, 16, decoded.Bounds().Dx())
+		require.Equal(t, 32, decoded.Bounds().Dy())
+		top, _, _, _ := decoded.At(8, 8).RGBA()
+		bottom, _, _, _ := decoded.At(8, 24).RGBA()
+		require.Greater(t, top, uint32(0xf000))
+		require.Less(t, bottom, uint32(0x1000))
+	})
+}
+
+// withEXIFOrientation inserts a minimal big endian EXIF segment holding
+// only the orientation tag right after the JPEG SOI marker.
+func withEXIFOrientation(jpg []byte, orientation uint16) []byte {
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1, 0x01, 0x12, 0, 3, 0, 0, 0, 1, byte(orientation >> 8), byte(orientation), 0, 0, 0, 0, 0, 0}
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	length := len(payload) + 2
+	segment := append([]byte{0xFF, 0xE1, byte(length >> 8), byte(length)}, payload...)
+
+	out := append([]byte{}, jpg[:2]...)
+	out = append(out, segment...)
+	return append(out, jpg[2:]...)
+}
+
+func TestGetPhoto(t *testing.T) {
+	pf := newPersistenceFake()
+	is := newImagestoreFake()
+	h, err := handler.NewHandler(pf, is)
+	require.NoError(t, err)
+
+	srv := loggedIn(t, h, pf, false)
+
+	exp, err := model.ExpenseBuilder{
+		Description: "some expense",
+		Payer:       "some payer",
+		Category:    "some category",
+		Amount:      "22.22",
+		Currency:    "EUR",
+		CreatedAt:   time.Now(),
+	}.Build()
+	require.NoError(t, err)
+	require.NoError(t, pf.Insert(1, exp))
+	photo := []byte("\xff\xd8\xff\xe0 some jpeg contents")
+	is.photos[exp.ID()+".jpeg"] = photo
+	path := "/expenses/" + exp.ID() + "/photo"
+
+	t.Run("should_serve_photo_with_caching_headers", func(t *testing.T) {
+		req := httptest.NewRequest("GET", path, nil)
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Equal(t, "image/jpeg", rr.Header().Get("Content-Type"))
+		require.Equal(t, `"`+exp.ID()+`.jpeg"`, rr.Header().Get("ETag"))
+		require.Equal(t, is.modTime.Format(http.TimeFormat), rr.Header().Get("Last-Modified"))
+		require.NotEmpty(t, rr.Header().Get("Cache-Control"))
+		require.Equal(t, photo, rr.Body.Bytes())
+	})
+
+	t.Run("should_return_304_for_matching_etag", func(t *testing.T) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("If-None-Match", `"`+exp.ID()+`.jpeg"`)
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusNotModified, rr.Code)
+		require.Empty(t, rr.Body.Bytes())
+	})
+
+	t.Run("should_return_304_when_not_modified_since", func(t *testing.T) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("If-Modified-Since", is.modTime.Add(time.Hour).Format(http.TimeFormat))
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusNotModified, rr.Code)
+	})
+
+	t.Run("should_serve_range_requests", func(t *testing.T) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Range", "bytes=0-3")
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusPartialContent, rr.Code)
+		require.Equal(t, photo[:4], rr.Body.Bytes())
+		require.Equal(t, "bytes 0-3/"+strconv.Itoa(len(photo)), rr.Header().Get("Content-Range"))
+	})
+
+	t.Run("should_return_404_for_expense_without_photo", func(t *testing.T) {
+		other, err := model.ExpenseBuilder{
+			Description: "other expense",
+			Payer:       "some payer",
+			Category:    "some category",
+			Amount:      "1.00",
+			Currency:    "EUR",
+			CreatedAt:   time.Now(),
+		}.Build()
+		require.NoError(t, err)
+		require.NoError(t, pf.Insert(1, other))
+
+		req := httptest.NewRequest("GET", "/expenses/"+other.ID()+"/photo", nil)
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("should_remove_photo_with_expense", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/expenses/"+exp.ID()+"/delete", nil)
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusFound, rr.Code)
+		require.Nil(t, is.getPhoto(exp, ".jpeg"))
+	})
+}
+
+func TestBackups(t *testing.T) {
+	bf := &backupsFake{
+		archives: fstest.MapFS{
+			"acc-backup-2024-06-30_03-00-00.zip": {Data: []byte("scheduled archive"), ModTime: time.Now()},
+		},
+		fresh: []byte("fresh archive"),
+	}
+	vf := verifierFake{report: backup.VerifyReport{
+		Archive:      "acc-backup-2024-06-30_03-00-00.zip",
+		CheckedAt:    time.Now(),
+		Files:        3,
+		LiveExpenses: -1,
+		Problems:     []string{"'photos/photo.jpeg' in acc-backup-2024-06-30_03-00-00.zip: checksum mismatch"},
+	}}
+	pf := newPersistenceFake()
+	h, err := handler.NewHandler(pf, newImagestoreFake(),
+		handler.WithBackups(bf),
+		handler.WithBackupVerifier(vf),
+	)
+	require.NoError(t, err)
+
+	srv := loggedIn(t, h, pf, true)
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+
+	t.Run("should_require_admin", func(t *testing.T) {
+		userSrv := loggedIn(t, h, pf, false)
+		for _, path := range []string{"/admin/backups", "/admin/backup", "/admin/backups/acc-backup-2024-06-30_03-00-00.zip"} {
+			rr := httptest.NewRecorder()
+			userSrv.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+			require.Equal(t, http.StatusForbidden, rr.Code, path)
+		}
+	})
+
+	t.Run("should_list_archives", func(t *testing.T) {
+		rr := get("/admin/backups")
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Contains(t, rr.Body.String(), `href="/admin/backups/acc-backup-2024-06-30_03-00-00.zip"`)
+		require.Contains(t, rr.Body.String(), "17 B")
+	})
+
+	t.Run("should_show_last_verification", func(t *testing.T) {
+		rr := get("/admin/backups")
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Contains(t, rr.Body.String(), "failed verification")
+		require.Contains(t, rr.Body.String(), "checksum mismatch")
+	})
+
+	t.Run("should_download_archive", func(t *testing.T) {
+		rr := get("/admin/backups/acc-backup-2024-06-30_03-00-00.zip")
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Equal(t, "application/zip", rr.Header().Get("Content-Type"))
+		require.Contains(t, rr.Header().Get("Content-Disposition"), "attachment")
+		require.Equal(t, "scheduled archive", rr.Body.String())
+
+		require.Equal(t, http.StatusNotFound, get("/admin/backups/missing.zip").Code)
+	})
+
+	t.Run("should_stream_fresh_backup", func(t *testing.T) {
+		rr := get("/admin/backup")
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Contains(t, rr.Header().Get("Content-Disposition"), "attachment")
+		require.Equal(t, "fresh archive", rr.Body.String())
+	})
+
+	t.Run("should_return_500_when_backup_fails_before_streaming", func(t *testing.T) {
+		bf.err = errors.New("snapshot failed")
+		defer func() { bf.err = nil }()
+
+		rr := get("/admin/backup")
+		require.Equal(t, http.StatusInternalServerError, rr.Code)
+		require.Empty(t, rr.Header().Get("Content-Disposition"))
+	})
+}
+
+const testPassword = "correct horse battery"
+
+// loggedIn routes h and returns a handler serving requests without a
+// session cookie as a user logged in through the login form.
+func loggedIn(t *testing.T, h interface{ Routes(*http.ServeMux) }, pf *persistenceFake, admin bool) http.Handler {
+	t.Helper()
+	mux := http.NewServeMux()
+	h.Routes(mux)
+
+	name := "user"
+	if admin {
+		name = "admin"
+	}
+	if _, ok := pf.users[name]; !ok {
+		u, err := model.NewUser(name, testPassword, admin)
+		require.NoError(t, err)
+		pf.addUser(u)
+	}
+	cookie := login(t, mux, name, testPassword)
+	require.NotNil(t, cookie)
+	csrf := csrfCookie(t, mux)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie(cookie.Name); err != nil {
+			r.AddCookie(cookie)
+		}
+		if _, err := r.Cookie(csrf.Name); err != nil {
+			withCSRF(r, csrf)
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// login posts the login form and returns the session cookie, nil when
+// login failed.
+func login(t *testing.T, srv http.Handler, name, password string) *http.Cookie {
+	t.Helper()
+	rr := postLogin(t, srv, url.Values{"name": {name}, "password": {password}})
+
+	for _, c := range rr.Result().Cookies() {
+		if c.Name != "acc2_csrf" && c.Value != "" {
+			return c
+		}
+	}
+	return nil
+}
+
+// postLogin posts form to the login page the way a browser which loaded
+// it does.
+func postLogin(t *testing.T, srv http.Handler, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	withCSRF(req, csrfCookie(t, srv))
+	rr := httptest.NewRecorder()
+	srv.ServeHTTP(rr, req)
+	return rr
+}
+
+// csrfCookie loads the login page and returns the csrf cookie it sets.
+func csrfCookie(t *testing.T, srv http.Handler) *http.Cookie {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	srv.ServeHTTP(rr, httptest.NewRequest("GET", "/login", nil))
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "acc2_csrf" {
+			return c
+		}
+	}
+	require.Fail(t, "login page did not set csrf cookie")
+	return nil
+}
+
+// withCSRF adds the csrf cookie to req and sends its token in the header.
+func withCSRF(req *http.Request, c *http.Cookie) *http.Request {
+	req.AddCookie(c)
+	req.Header.Set("X-CSRF-Token", c.Value)
+	return req
+}
+
+// persistenceFake keeps ledgers in memory. The embedded ledgerFake is the
+// default ledger, which every added user is an owner of.
 type persistenceFake struct {
+	*ledgerFake
+	ledgers map[int64]*ledgerFake
+	names   map[int64]string
+	// members are roles of users by user id and ledger id
+	members  map[int64]map[int64]model.Role
+	users    map[string]model.User
+	sessions map[string]model.Session
+	tokens   []model.APIToken
+}
+
+type ledgerFake struct {
 	expenses   []model.Expense
 	payers     []string
 	categories []string
+	payerUsers map[string]string
 }
 
-func newPersistenceFake() *persistenceFake {
-	return &persistenceFake{
+func newLedgerFake() *ledgerFake {
+	return &ledgerFake{
 		expenses:   []model.Expense{},
 		payers:     []string{},
 		categories: []string{},
+		payerUsers: map[string]string{},
+	}
+}
+
+func newPersistenceFake() *persistenceFake {
+	l := newLedgerFake()
+	return &persistenceFake{
+		ledgerFake: l,
+		ledgers:    map[int64]*ledgerFake{1: l},
+		names:      map[int64]string{1: "default"},
+		members:    map[int64]map[int64]model.Role{},
+		users:      map[string]model.User{},
+		sessions:   map[string]model.Session{},
+	}
+}
+
+// addLedger creates a ledger with the users of names as owners.
+func (pf *persistenceFake) addLedger(name string, users ...string) (model.Ledger, *ledgerFake) {
+	id := int64(len(pf.ledgers) + 1)
+	pf.ledgers[id] = newLedgerFake()
+	pf.names[id] = name
+	for _, u := range users {
+		pf.grant(id, u, model.RoleOwner)
+	}
+	return model.Ledger{ID: id, Name: name}, pf.ledgers[id]
+}
+
+// grant makes the user with name a member of the ledger with id.
+func (pf *persistenceFake) grant(id int64, name string, role model.Role) {
+	userID := pf.users[name].ID
+	if pf.members[userID] == nil {
+		pf.members[userID] = map[int64]model.Role{}
+	}
+	pf.members[userID][id] = role
+}
+
+// ledger returns the ledger with id, an empty one when there is none.
+func (pf *persistenceFake) ledger(id int64) *ledgerFake {
+	l, ok := pf.ledgers[id]
+	if !ok {
+		return newLedgerFake()
+	}
+	return l
+}
+
+func (pf *persistenceFake) UserLedgers(userID int64) ([]model.Ledger, error) {
+	var ledgers []model.Ledger
+	for id, role := range pf.members[userID] {
+		ledgers = append(ledgers, model.Ledger{ID: id, Name: pf.names[id], Role: role})
+	}
+	slices.SortFunc(ledgers, func(a, b model.Ledger) int { return strings.Compare(a.Name, b.Name) })
+	return ledgers, nil
+}
+
+func (pf *persistenceFake) addUser(u model.User) {
+	u.ID = int64(len(pf.users) + 1)
+	pf.users[u.Name] = u
+	pf.grant(1, u.Name, model.RoleOwner)
+}
+
+func (pf *persistenceFake) ListUsers() ([]model.User, error) {
+	users := make([]model.User, 0, len(pf.users))
+	for _, u := range pf.users {
+		users = append(users, u)
+	}
+	slices.SortFunc(users, func(a, b model.User) int { return strings.Compare(a.Name, b.Name) })
+	return users, nil
+}
+
+func (pf *persistenceFake) GetUser(name string) (model.User, error) {
+	u, ok := pf.users[name]
+	if !ok {
+		return model.User{}, fmt.Errorf("user '%s': %w", name, model.ErrNotFound)
+	}
+	return u, nil
+}
+
+func (pf *persistenceFake) CreateSession(s model.Session) error {
+	pf.sessions[s.TokenHash] = s
+	return nil
+}
+
+func (pf *persistenceFake) GetSession(tokenHash string) (model.Session, error) {
+	s, ok := pf.sessions[tokenHash]
+	if !ok || !s.ExpiresAt.After(time.Now()) {
+		return model.Session{}, fmt.Errorf("session: %w", model.ErrNotFound)
+	}
+	return s, nil
+}
+
+func (pf *persistenceFake) RemoveSession(tokenHash string) error {
+	delete(pf.sessions, tokenHash)
+	return nil
+}
+
+func (pf *persistenceFake) CreateAPIToken(t model.APIToken) error {
+	t.ID = int64(len(pf.tokens) + 1)
+	pf.tokens = append(pf.tokens, t)
+	return nil
+}
+
+func (pf *persistenceFake) GetAPIToken(tokenHash string) (model.APIToken, error) {
+	idx := slices.IndexFunc(pf.tokens, func(t model.APIToken) bool { return t.TokenHash == tokenHash })
+	if idx == -1 {
+		return model.APIToken{}, fmt.Errorf("api token: %w", model.ErrNotFound)
+	}
+	return pf.tokens[idx], nil
+}
+
+func (pf *persistenceFake) ListAPITokens(userID int64) ([]model.APIToken, error) {
+	var tokens []model.APIToken
+	for _, t := range pf.tokens {
+		if t.User.ID == userID {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens, nil
+}
+
+func (pf *persistenceFake) RevokeAPIToken(userID int64, name string) error {
+	n := len(pf.tokens)
+	pf.tokens = slices.DeleteFunc(pf.tokens, func(t model.APIToken) bool { return t.User.ID == userID && t.Name == name })
+	if len(pf.tokens) == n {
+		return fmt.Errorf("api token '%s': %w", name, model.ErrNotFound)
+	}
+	return nil
+}
+
+func (pf *persistenceFake) TouchAPIToken(id int64, at time.Time) error {
+	for i := range pf.tokens {
+		if pf.tokens[i].ID == id {
+			pf.tokens[i].LastUsedAt = at
+		}
+	}
+	return nil
+}
+
+func (pf *persistenceFake) Insert(ledgerID int64, e model.Expense) error {
+	l := pf.ledger(ledgerID)
+	l.expenses = append(l.expenses, e)
+	return nil
+}
+
+func (pf *persistenceFake) SelectExpenses(ledgerID int64) ([]model.Expense, error) {
+	return pf.ledger(ledgerID).expenses, nil
+}
+
+func (pf *persistenceFake) GetExpense(ledgerID int64, id string) (model.Expense, error) {
+	l := pf.ledger(ledgerID)
+	idx := slices.IndexFunc(l.expenses, func(e model.Expense) bool { return e.ID() == id })
+	if idx == -1 {
+		return model.Expense{}, fmt.Errorf("expense '%s': %w", id, model.ErrNotFound)
 	}
+	return l.expenses[idx], nil
 }
 
-func (pf *persistenceFake) Insert(e model.Expense) error {
-	pf.expenses = append(pf.expenses, e)
+func (pf *persistenceFake) QueryExpenses(ledgerID int64, q model.ExpenseQuery) ([]model.Expense, int, error) {
+	var matching []model.Expense
+	for _, e := range pf.ledger(ledgerID).expenses {
+		if (q.Payer != "" && e.Payer() != q.Payer) ||
+			(q.Category != "" && e.Category() != q.Category) ||
+			(!q.From.IsZero() && e.CreatedAt().Before(q.From)) ||
+			(!q.To.IsZero() && !e.CreatedAt().Before(q.To)) {
+			continue
+		}
+		matching = append(matching, e)
+	}
+	slices.SortFunc(matching, func(a, b model.Expense) int { return b.CreatedAt().Compare(a.CreatedAt()) })
+
+	total := len(matching)
+	matching = matching[min(q.Offset, total):]
+	if q.Limit > 0 {
+		matching = matching[:min(q.Limit, len(matching))]
+	}
+	return matching, total, nil
+}
+
+func (pf *persistenceFake) UpdateExpense(ledgerID int64, e model.Expense) error {
+	l := pf.ledger(ledgerID)
+	idx := slices.IndexFunc(l.expenses, func(other model.Expense) bool { return other.ID() == e.ID() })
+	if idx == -1 {
+		return fmt.Errorf("expense '%s': %w", e.ID(), model.ErrNotFound)
+	}
+	l.expenses[idx] = e
 	return nil
 }
 
-func (pf *persistenceFake) SelectExpenses() ([]model.Expense, error) {
-	return pf.expenses, nil
+func (pf *persistenceFake) CreatePayer(ledgerID int64, name string) error {
+	l := pf.ledger(ledgerID)
+	if slices.Contains(l.payers, name) {
+		return fmt.Errorf("payer '%s' already exists: %w", name, model.ErrInUse)
+	}
+	l.payers = append(l.payers, name)
+	return nil
 }
 
-func (pf *persistenceFake) CreatePayer(name string) error {
-	pf.payers = append(pf.payers, name)
+func (pf *persistenceFake) CreateLinkedPayer(ledgerID int64, payer, user string) error {
+	if _, ok := pf.users[user]; !ok {
+		return fmt.Errorf("user '%s': %w", user, model.ErrNotFound)
+	}
+	l := pf.ledger(ledgerID)
+	for p, u := range l.payerUsers {
+		if u == user {
+			return fmt.Errorf("user '%s' is linked to payer '%s': %w", user, p, model.ErrInUse)
+		}
+	}
+	return errors.Join(pf.CreatePayer(ledgerID, payer), pf.LinkPayer(ledgerID, payer, user))
+}
+
+func (pf *persistenceFake) ListPayerLinks(ledgerID int64) ([]model.Payer, error) {
+	l := pf.ledger(ledgerID)
+	payers := make([]model.Payer, len(l.payers))
+	for i, name := range l.payers {
+		payers[i] = model.Payer{Name: name, User: l.payerUsers[name]}
+	}
+	return payers, nil
+}
+
+func (pf *persistenceFake) LinkPayer(ledgerID int64, payer, user string) error {
+	l := pf.ledger(ledgerID)
+	if !slices.Contains(l.payers, payer) {
+		return fmt.Errorf("payer '%s': %w", payer, model.ErrNotFound)
+	}
+	if user == "" {
+		delete(l.payerUsers, payer)
+		return nil
+	}
+	if _, ok := pf.users[user]; !ok {
+		return fmt.Errorf("user '%s': %w", user, model.ErrNotFound)
+	}
+	for p, u := range l.payerUsers {
+		if u == user && p != payer {
+			return fmt.Errorf("user '%s': %w", user, model.ErrInUse)
+		}
+	}
+	l.payerUsers[payer] = user
 	return nil
 }
 
-func (pf *persistenceFake) CreateCategory(name string) error {
-	pf.categories = append(pf.categories, name)
+func (pf *persistenceFake) CreateCategory(ledgerID int64, name string) error {
+	l := pf.ledger(ledgerID)
+	l.categories = append(l.categories, name)
 	return nil
 }
 
-func (pf *persistenceFake) ListPayers() ([]string, error) {
-	return pf.payers, nil
+func (pf *persistenceFake) ListPayers(ledgerID int64) ([]string, error) {
+	return pf.ledger(ledgerID).payers, nil
+}
+
+func (pf *persistenceFake) ListCategories(ledgerID int64) ([]string, error) {
+	return pf.ledger(ledgerID).categories, nil
+}
+
+func (pf *persistenceFake) RemovePayer(ledgerID int64, name string) error {
+	l := pf.ledger(ledgerID)
+	return l.removeUnused(&l.payers, name, model.Expense.Payer)
 }
 
-func (pf *persistenceFake) ListCategories() ([]string, error) {
-	return pf.categories, nil
+func (pf *persistenceFake) RemoveCategory(ledgerID int64, name string) error {
+	l := pf.ledger(ledgerID)
+	return l.removeUnused(&l.categories, name, model.Expense.Category)
 }
 
-func (pf *persistenceFake) RemoveExpense(_ model.Expense) error {
+func (l *ledgerFake) removeUnused(names *[]string, name string, of func(model.Expense) string) error {
+	if !slices.Contains(*names, name) {
+		return fmt.Errorf("'%s': %w", name, model.ErrNotFound)
+	}
+	if slices.ContainsFunc(l.expenses, func(e model.Expense) bool { return of(e) == name }) {
+		return fmt.Errorf("'%s': %w", name, model.ErrInUse)
+	}
+	*names = slices.DeleteFunc(*names, func(n string) bool { return n == name })
+	return nil
+}
+
+func (pf *persistenceFake) RemoveExpense(ledgerID int64, e model.Expense) error {
+	l := pf.ledger(ledgerID)
+	l.expenses = slices.DeleteFunc(l.expenses, func(other model.Expense) bool { return other.ID() == e.ID() })
 	return nil
 }
 
 type imagestoreFake struct {
-	photos map[string][]byte
+	photos  map[string][]byte
+	modTime time.Time
+	// loadErr fails loading photos when set
+	loadErr error
 }
 
 func newImagestoreFake() *imagestoreFake {
 	return &imagestoreFake{
-		photos: map[string][]byte{},
+		photos:  map[string][]byte{},
+		modTime: time.Date(2024, time.April, 10, 13, 40, 0, 0, time.UTC),
 	}
 }
 
@@ -195,10 +844,85 @@ func (isf *imagestoreFake) SaveExpensePhoto(e model.Expense, fileExtension strin
 	return nil
 }
 
-func (isf *imagestoreFake) LoadExpensePhoto(e model.Expense) (io.ReadCloser, error) {
-	return nil, nil
+func (isf *imagestoreFake) LoadExpensePhoto(e model.Expense) (model.Photo, error) {
+	if isf.loadErr != nil {
+		return model.Photo{}, isf.loadErr
+	}
+	for name, contents := range isf.photos {
+		if !strings.HasPrefix(name, e.ID()) {
+			continue
+		}
+		return model.Photo{
+			ReadSeekCloser: nopSeekCloser{bytes.NewReader(contents)},
+			ContentType:    mime.TypeByExtension(strings.TrimPrefix(name, e.ID())),
+			ModTime:        isf.modTime,
+			ETag:           `"` + name + `"`,
+		}, nil
+	}
+	return model.Photo{}, os.ErrNotExist
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+func (isf *imagestoreFake) RemoveExpensePhoto(e model.Expense) error {
+	for name := range isf.photos {
+		if strings.HasPrefix(name, e.ID()) {
+			delete(isf.photos, name)
+		}
+	}
+	return nil
 }
 
 func (isf *imagestoreFake) getPhoto(e model.Expense, fileExtension string) []byte {
 	return isf.photos[e.ID()+fileExtension]
 }
+
+type backupsFake struct {
+	archives fstest.MapFS
+	fresh    []byte
+	err      error
+}
+
+func (bf *backupsFake) WriteBackup(w io.Writer) error {
+	if bf.err != nil {
+		return bf.err
+	}
+	_, err := w.Write(bf.fresh)
+	return err
+}
+
+func (bf *backupsFake) List() ([]fs.FileInfo, error) {
+	var infos []fs.FileInfo
+	for name := range bf.archives {
+		fi, err := bf.archives.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, fi)
+	}
+	return infos, nil
+}
+
+func (bf *backupsFake) Open(name string) (io.ReadSeekCloser, fs.FileInfo, error) {
+	f, err := bf.archives.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	return f.(io.ReadSeekCloser), fi, nil
+}
+
+type verifierFake struct {
+	report backup.VerifyReport
+}
+
+func (vf verifierFake) LastReport() (backup.VerifyReport, bool) {
+	return vf.report, true
+}
@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/matmazurk/acc2/model"
+)
+
+const (
+	// ledgerCookie keeps the ledger picked with the switcher
+	ledgerCookie = "acc2_ledger"
+	// ledgerHeader picks the ledger of api requests, it takes precedence
+	// over ledgerCookie
+	ledgerHeader = "X-Ledger"
+)
+
+var (
+	errNoLedger  = errors.New("you are not a member of any ledger, ask an admin to grant you one")
+	errNotMember = errors.New("you are not a member of the requested ledger")
+	errNotOwn    = errors.New("only owners of the ledger can change expenses added by others")
+)
+
+// ledgers are the ledgers of the current user and the one the request
+// works on.
+type ledgers struct {
+	current model.Ledger
+	all     []model.Ledger
+}
+
+// currentLedger returns the ledger the request works on, it expects the
+// request to be served by inLedger.
+func currentLedger(r *http.Request) model.Ledger {
+	l, _ := r.Context().Value(ledgerKey).(ledgers)
+	return l.current
+}
+
+func userLedgers(r *http.Request) []model.Ledger {
+	l, _ := r.Context().Value(ledgerKey).(ledgers)
+	return l.all
+}
+
+// inLedger picks the ledger of the request out of the ledgers the user is
+// a member of: the one of ledgerHeader, of ledgerCookie or the first one.
+// It expects to be wrapped by authenticated.
+func (h handler) inLedger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, _ := currentUser(r)
+		all, err := h.pers.UserLedgers(u.ID)
+		if err != nil {
+			h.logger.Error().Err(err).Msg("could not list ledgers of user")
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				writeAPIError(w, http.StatusInternalServerError, codeInternal, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if len(all) == 0 {
+			h.forbidden(w, r, errNoLedger)
+			return
+		}
+
+		current := all[0]
+		if id := r.Header.Get(ledgerHeader); id != "" {
+			i := slices.IndexFunc(all, ledgerWithID(id))
+			if i < 0 {
+				h.forbidden(w, r, errNotMember)
+				return
+			}
+			current = all[i]
+		} else if c, err := r.Cookie(ledgerCookie); err == nil {
+			// the user may have lost access to the ledger picked before
+			if i := slices.IndexFunc(all, ledgerWithID(c.Value)); i >= 0 {
+				current = all[i]
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), ledgerKey, ledgers{current: current, all: all})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireRole lets through requests of users whose role in the current
+// ledger allows role, it expects to be wrapped by inLedger.
+func (h handler) requireRole(role model.Role, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := currentLedger(r)
+		if !l.Role.Allows(role) {
+			h.forbidden(w, r, fmt.Errorf("your role in ledger '%s' is %s, this requires %s", l.Name, l.Role, role))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// canEdit reports whether the user of r may change exp: owners change every
+// expense of the ledger, editors the ones they added.
+func canEdit(r *http.Request, exp model.Expense) bool {
+	role := currentLedger(r).Role
+	if role.Allows(model.RoleOwner) {
+		return true
+	}
+	return role.Allows(model.RoleEditor) && exp.CreatedBy() != "" && exp.CreatedBy() == userName(r)
+}
+
+func ledgerWithID(id string) func(model.Ledger) bool {
+	return func(l model.Ledger) bool {
+		return strconv.FormatInt(l.ID, 10) == id
+	}
+}
+
+// SwitchLedger makes the ledger of the ledger form value the current one.
+func (h handler) SwitchLedger() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		id := r.PostFormValue("ledger")
+		if !slices.ContainsFunc(userLedgers(r), ledgerWithID(id)) {
+			h.forbidden(w, r, errNotMember)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     ledgerCookie,
+			Value:    id,
+			Path:     "/",
+			MaxAge:   int(sessionTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   !h.insecureCookies,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+}
+
+func (h handler) APIListLedgers() http.HandlerFunc {
+	type ledger struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+	}
+	type data struct {
+		Items []ledger `json:"items"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, _ := currentUser(r)
+		all, err := h.pers.UserLedgers(u.ID)
+		if err != nil {
+			h.writePersistenceError(w, err)
+			return
+		}
+
+		d := data{Items: make([]ledger, len(all))}
+		for i, l := range all {
+			d.Items[i] = ledger{ID: l.ID, Name: l.Name}
+		}
+		writeJSON(w, http.StatusOK, d)
+	})
+}
@@ -0,0 +1,303 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matmazurk/acc2/http/handler"
+	"github.com/matmazurk/acc2/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLedgers(t *testing.T) {
+	pf := newPersistenceFake()
+	h, err := handler.NewHandler(pf, newImagestoreFake())
+	require.NoError(t, err)
+
+	srv := loggedIn(t, h, pf, false)
+	adminSrv := loggedIn(t, h, pf, true)
+	house, houseFake := pf.addLedger("house", "user")
+	houseID := strconv.FormatInt(house.ID, 10)
+
+	newExpense := func(description string) model.Expense {
+		exp, err := model.ExpenseBuilder{
+			Description: description,
+			Payer:       "mat",
+			Category:    "food",
+			Amount:      "12.50",
+			Currency:    "PLN",
+			CreatedAt:   time.Now(),
+		}.Build()
+		require.NoError(t, err)
+		return exp
+	}
+	defaultExp := newExpense("default expense")
+	require.NoError(t, pf.Insert(1, defaultExp))
+	houseExp := newExpense("house expense")
+	require.NoError(t, pf.Insert(house.ID, houseExp))
+
+	get := func(srv http.Handler, path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		return rr
+	}
+	switchLedger := func(id string) *httptest.ResponseRecorder {
+		form := url.Values{"ledger": {id}}
+		req := httptest.NewRequest("POST", "/ledger", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		return rr
+	}
+	inLedger := func(method, target, id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("X-Ledger", id)
+		return serveAPIRequest(t, srv, req)
+	}
+
+	t.Run("should_show_switcher_only_with_many_ledgers", func(t *testing.T) {
+		body := get(srv, "/").Body.String()
+		require.Contains(t, body, `action="/ledger"`)
+		require.Contains(t, body, `<option value="`+houseID+`">house</option>`)
+		require.Contains(t, body, `<option value="1" selected>default</option>`)
+
+		require.NotContains(t, get(adminSrv, "/").Body.String(), `action="/ledger"`)
+	})
+
+	t.Run("should_show_expenses_of_switched_ledger", func(t *testing.T) {
+		body := get(srv, "/").Body.String()
+		require.Contains(t, body, "default expense")
+		require.NotContains(t, body, "house expense")
+
+		rr := switchLedger(houseID)
+		require.Equal(t, http.StatusSeeOther, rr.Code)
+		var cookie *http.Cookie
+		for _, c := range rr.Result().Cookies() {
+			if c.Name == "acc2_ledger" {
+				cookie = c
+			}
+		}
+		require.NotNil(t, cookie)
+		require.True(t, cookie.HttpOnly)
+
+		body = get(srv, "/", cookie).Body.String()
+		require.Contains(t, body, "house expense")
+		require.NotContains(t, body, "default expense")
+		require.Contains(t, body, `<option value="`+houseID+`" selected>house</option>`)
+	})
+
+	t.Run("should_reject_switching_to_ledger_of_others", func(t *testing.T) {
+		other, _ := pf.addLedger("other", "admin")
+		rr := switchLedger(strconv.FormatInt(other.ID, 10))
+		require.Equal(t, http.StatusForbidden, rr.Code)
+		require.Empty(t, rr.Result().Cookies())
+	})
+
+	t.Run("should_fall_back_to_first_ledger_for_stale_cookie", func(t *testing.T) {
+		stale := &http.Cookie{Name: "acc2_ledger", Value: "999"}
+		rr := get(srv, "/", stale)
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Contains(t, rr.Body.String(), "default expense")
+	})
+
+	t.Run("should_list_ledgers_of_user", func(t *testing.T) {
+		rr := serveAPI(t, srv, "GET", "/api/v1/ledgers", nil)
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.JSONEq(t, `{"items":[{"id":1,"name":"default"},{"id":`+houseID+`,"name":"house"}]}`, rr.Body.String())
+	})
+
+	t.Run("should_pick_ledger_of_header", func(t *testing.T) {
+		rr := inLedger("GET", "/api/v1/expenses", houseID)
+		require.Equal(t, http.StatusOK, rr.Code)
+		var page struct {
+			Items []struct {
+				ID string `json:"id"`
+			} `json:"items"`
+		}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &page))
+		require.Len(t, page.Items, 1)
+		require.Equal(t, houseExp.ID(), page.Items[0].ID)
+
+		rr = inLedger("GET", "/api/v1/expenses", "999")
+		requireAPIError(t, rr, http.StatusForbidden, "forbidden")
+	})
+
+	t.Run("should_not_leak_expenses_across_ledgers", func(t *testing.T) {
+		rr := serveAPI(t, srv, "GET", "/api/v1/expenses/"+houseExp.ID(), nil)
+		requireAPIError(t, rr, http.StatusNotFound, "not_found")
+		rr = inLedger("DELETE", "/api/v1/expenses/"+defaultExp.ID(), houseID)
+		requireAPIError(t, rr, http.StatusNotFound, "not_found")
+
+		require.Equal(t, http.StatusNotFound, get(srv, "/expenses/"+houseExp.ID()+"/photo").Code)
+		req := httptest.NewRequest("POST", "/expenses/"+houseExp.ID()+"/delete", nil)
+		rr = httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusNotFound, rr.Code)
+		require.Len(t, houseFake.expenses, 1)
+	})
+
+	t.Run("should_forbid_users_without_ledgers", func(t *testing.T) {
+		pf.members[pf.users["user"].ID] = nil
+
+		rr := get(srv, "/")
+		require.Equal(t, http.StatusForbidden, rr.Code)
+		require.Contains(t, rr.Body.String(), "not a member of any ledger")
+
+		rr = serveAPI(t, srv, "GET", "/api/v1/payers", nil)
+		requireAPIError(t, rr, http.StatusForbidden, "forbidden")
+		rr = serveAPI(t, srv, "GET", "/api/v1/ledgers", nil)
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.JSONEq(t, `{"items":[]}`, rr.Body.String())
+	})
+}
+
+func TestRoles(t *testing.T) {
+	pf := newPersistenceFake()
+	pf.payers = []string{"mat"}
+	pf.categories = []string{"food"}
+	is := newImagestoreFake()
+	h, err := handler.NewHandler(pf, is)
+	require.NoError(t, err)
+
+	srv := loggedIn(t, h, pf, false)
+	ownerSrv := loggedIn(t, h, pf, true)
+	as := func(role model.Role) { pf.grant(1, "user", role) }
+
+	input := map[string]any{
+		"description": "groceries",
+		"payer":       "mat",
+		"category":    "food",
+		"amount":      "10.00",
+		"currency":    "PLN",
+	}
+	create := func(srv http.Handler) string {
+		rr := serveAPI(t, srv, "POST", "/api/v1/expenses", input)
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+		var created struct {
+			ID string `json:"id"`
+		}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+		return created.ID
+	}
+	putPhoto := func(id string) *httptest.ResponseRecorder {
+		body, contentType := multipartBody(t, nil, []byte("GIF89a photo"))
+		req := httptest.NewRequest("PUT", "/api/v1/expenses/"+id+"/photo", body)
+		req.Header.Set("Content-Type", contentType)
+		return serveAPIRequest(t, srv, req)
+	}
+	post := func(path string) int {
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, httptest.NewRequest("POST", path, nil))
+		return rr.Code
+	}
+	postForm := func(path string, form url.Values) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	index := func() string {
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+		return rr.Body.String()
+	}
+	ownersExpense := create(ownerSrv)
+
+	t.Run("should_let_viewers_only_browse", func(t *testing.T) {
+		as(model.RoleViewer)
+
+		body := index()
+		require.Contains(t, body, "groceries")
+		require.NotContains(t, body, `hx-get="/expenses/add"`)
+		require.NotContains(t, body, `hx-get="/categories/add"`)
+		require.NotContains(t, body, `/delete"`)
+		require.NotContains(t, body, `href="/admin/payers"`)
+		require.Contains(t, body, `href="/expenses/export"`)
+		require.NotContains(t, body, `/edit"`)
+
+		require.Equal(t, http.StatusOK, serveAPI(t, srv, "GET", "/api/v1/expenses", nil).Code)
+		requireAPIError(t, serveAPI(t, srv, "POST", "/api/v1/expenses", input), http.StatusForbidden, "forbidden")
+		requireAPIError(t, serveAPI(t, srv, "PUT", "/api/v1/expenses/"+ownersExpense, input), http.StatusForbidden, "forbidden")
+		requireAPIError(t, serveAPI(t, srv, "POST", "/api/v1/categories", map[string]string{"name": "fun"}), http.StatusForbidden, "forbidden")
+		require.Equal(t, http.StatusForbidden, post("/expenses"))
+		require.Equal(t, http.StatusForbidden, post("/expenses/"+ownersExpense+"/delete"))
+		require.Len(t, pf.expenses, 1)
+	})
+
+	t.Run("should_let_editors_change_own_expenses", func(t *testing.T) {
+		as(model.RoleEditor)
+
+		body := index()
+		require.Contains(t, body, `hx-get="/expenses/add"`)
+		require.NotContains(t, body, `hx-get="/categories/add"`)
+		require.NotContains(t, body, `/delete"`)
+
+		own := create(srv)
+		stored, err := pf.GetExpense(1, own)
+		require.NoError(t, err)
+		require.Equal(t, "user", stored.CreatedBy())
+
+		input := map[string]any{"description": "more groceries", "payer": "mat", "category": "food", "amount": "12.00", "currency": "PLN"}
+		rr := serveAPI(t, srv, "PUT", "/api/v1/expenses/"+own, input)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		require.Contains(t, rr.Body.String(), `"created_by":"user"`)
+		require.Equal(t, http.StatusNoContent, putPhoto(own).Code)
+
+		body = index()
+		require.Contains(t, body, `hx-get="/expenses/`+own+`/edit"`)
+		require.NotContains(t, body, `hx-get="/expenses/`+ownersExpense+`/edit"`)
+		rr = httptest.NewRecorder()
+		srv.ServeHTTP(rr, httptest.NewRequest("GET", "/expenses/"+own+"/edit", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Contains(t, rr.Body.String(), `value="more groceries"`)
+		form := url.Values{"description": {"even more groceries"}, "author": {"mat"}, "category": {"food"}, "amount": {"14.00"}, "currency": {"PLN"}}
+		require.Equal(t, http.StatusFound, postForm("/expenses/"+own, form))
+		edited, err := pf.GetExpense(1, own)
+		require.NoError(t, err)
+		require.Equal(t, "even more groceries", edited.Description())
+		require.Equal(t, "user", edited.CreatedBy())
+
+		requireAPIError(t, serveAPI(t, srv, "PUT", "/api/v1/expenses/"+ownersExpense, input), http.StatusForbidden, "forbidden")
+		requireAPIError(t, putPhoto(ownersExpense), http.StatusForbidden, "forbidden")
+		rr = httptest.NewRecorder()
+		srv.ServeHTTP(rr, httptest.NewRequest("GET", "/expenses/"+ownersExpense+"/edit", nil))
+		require.Equal(t, http.StatusForbidden, rr.Code)
+		require.Equal(t, http.StatusForbidden, postForm("/expenses/"+ownersExpense, form))
+		requireAPIError(t, serveAPI(t, srv, "DELETE", "/api/v1/expenses/"+own, nil), http.StatusForbidden, "forbidden")
+		require.Equal(t, http.StatusForbidden, post("/admin/payers"))
+	})
+
+	t.Run("should_let_owners_change_everything", func(t *testing.T) {
+		as(model.RoleOwner)
+
+		body := index()
+		require.Contains(t, body, `hx-get="/categories/add"`)
+		require.Contains(t, body, `action="/expenses/`+ownersExpense+`/delete"`)
+		require.Contains(t, body, `hx-get="/expenses/`+ownersExpense+`/edit"`)
+		require.Contains(t, body, `href="/admin/payers"`)
+
+		stored, err := pf.GetExpense(1, ownersExpense)
+		require.NoError(t, err)
+		rr := serveAPI(t, srv, "PUT", "/api/v1/expenses/"+ownersExpense, input)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		// the expense stays the one of the user who added it
+		updated, err := pf.GetExpense(1, ownersExpense)
+		require.NoError(t, err)
+		require.Equal(t, stored.CreatedBy(), updated.CreatedBy())
+
+		rr = serveAPI(t, srv, "DELETE", "/api/v1/expenses/"+ownersExpense, nil)
+		require.Equal(t, http.StatusNoContent, rr.Code)
+	})
+}
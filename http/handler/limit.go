@@ -0,0 +1,274 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket holding Requests tokens, refilled at Requests
+// per Per; every request takes a token. The zero Limit lets every request
+// through.
+type Limit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (l Limit) enabled() bool {
+	return l.Requests > 0 && l.Per > 0
+}
+
+// MarshalText formats l as requests/period, e.g. 10/15m0s, or off.
+func (l Limit) MarshalText() ([]byte, error) {
+	if !l.enabled() {
+		return []byte("off"), nil
+	}
+	return []byte(strconv.Itoa(l.Requests) + "/" + l.Per.String()), nil
+}
+
+// UnmarshalText parses requests/period, e.g. 10/15m, off or 0 disable the
+// limit.
+func (l *Limit) UnmarshalText(text []byte) error {
+	s := string(text)
+	if s == "off" || s == "0" {
+		*l = Limit{}
+		return nil
+	}
+
+	requests, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return fmt.Errorf("invalid limit '%s', expected requests/period", s)
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("invalid number of requests '%s'", requests)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid period '%s'", per)
+	}
+
+	*l = Limit{Requests: n, Per: d}
+	return nil
+}
+
+// RateLimits are the limits of request rates. Requests are limited by the
+// address they come from before they are authenticated, and by their user
+// after.
+type RateLimits struct {
+	// IP limits every request of a client address
+	IP Limit
+	// User limits every request of a user, whatever address or api token
+	// it comes with
+	User Limit
+	// Login limits login attempts of a client address
+	Login Limit
+	// Upload limits requests of a user uploading photos
+	Upload Limit
+}
+
+// BodyLimits are the largest request bodies accepted, in bytes.
+type BodyLimits struct {
+	// Form limits bodies of html forms
+	Form int64
+	// JSON limits bodies of api requests
+	JSON int64
+	// Upload limits multipart bodies of requests uploading photos
+	Upload int64
+}
+
+// DefaultBodyLimits are used unless WithBodyLimits is given.
+var DefaultBodyLimits = BodyLimits{
+	Form:   maxFormSize,
+	JSON:   maxJSONSize,
+	Upload: maxUploadSize,
+}
+
+// maxFormSize is the default limit of html form bodies
+const maxFormSize = 1 << 20
+
+// uploadRoutes take photos in multipart bodies, which get the upload body
+// limit and the upload rate limit
+var uploadRoutes = []string{
+	"POST /expenses",
+	"POST " + apiPrefix + "/expenses",
+	"PUT " + apiPrefix + "/expenses/{id}/photo",
+}
+
+// limiter keeps a token bucket per key. A bucket is stored as the time it
+// is full again, buckets full by now are forgotten.
+type limiter struct {
+	limit     Limit
+	mu        *sync.Mutex
+	full      map[string]time.Time
+	lastSweep time.Time
+}
+
+// newLimiter returns nil for disabled limits, which lets every request
+// through.
+func newLimiter(l Limit) *limiter {
+	if !l.enabled() {
+		return nil
+	}
+	return &limiter{limit: l, mu: &sync.Mutex{}, full: map[string]time.Time{}}
+}
+
+// take takes a token from the bucket of key, or returns how long it takes
+// until there is one.
+func (l *limiter) take(key string, now time.Time) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	interval := l.limit.Per / time.Duration(l.limit.Requests)
+	full := l.full[key]
+	if full.Before(now) {
+		full = now
+	}
+	// fewer than one token left
+	if wait := full.Sub(now) - (l.limit.Per - interval); wait > 0 {
+		return wait, false
+	}
+	l.full[key] = full.Add(interval)
+
+	return 0, true
+}
+
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.limit.Per {
+		return
+	}
+	for key, full := range l.full {
+		if !full.After(now) {
+			delete(l.full, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+type limiters struct {
+	ip     *limiter
+	user   *limiter
+	login  *limiter
+	upload *limiter
+}
+
+func newLimiters(l RateLimits) limiters {
+	return limiters{
+		ip:     newLimiter(l.IP),
+		user:   newLimiter(l.User),
+		login:  newLimiter(l.Login),
+		upload: newLimiter(l.Upload),
+	}
+}
+
+// clientIP returns the address r comes from.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// userID returns the id of the user of r, the rate limits of users are
+// kept by it.
+func userID(r *http.Request) string {
+	u, _ := currentUser(r)
+	return strconv.FormatInt(u.ID, 10)
+}
+
+// rateLimited rejects requests once the bucket of their key in l is empty.
+func (h handler) rateLimited(l *limiter, name string, key func(*http.Request) string, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wait, ok := l.take(key(r), time.Now())
+		if !ok {
+			h.logger.Warn().Str("limit", name).Str("path", r.URL.Path).Str("ip", clientIP(r)).Msg("rate limited request")
+			h.tooManyRequests(w, r, wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// uploadLimited applies the upload rate limit to multipart requests of
+// upload routes.
+func (h handler) uploadLimited(pattern string, next http.Handler) http.Handler {
+	if !slices.Contains(uploadRoutes, pattern) {
+		return next
+	}
+	limited := h.rateLimited(h.limiters.upload, "upload", userID, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if multipartRequest(r) {
+			limited.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tooManyRequests tells the client when to retry, in whole seconds.
+func (h handler) tooManyRequests(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	seconds := strconv.Itoa(max(1, int(math.Ceil(wait.Seconds()))))
+	w.Header().Set("Retry-After", seconds)
+	message := "too many requests, retry in " + seconds + "s"
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeAPIError(w, http.StatusTooManyRequests, codeTooManyRequests, message)
+		return
+	}
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(message))
+}
+
+// bodyLimited limits the body of requests to pattern: multipart bodies of
+// upload routes get the upload limit, other api bodies the JSON limit and
+// the rest the form limit. Handlers report reading beyond it with 413.
+func (h handler) bodyLimited(pattern string, next http.Handler) http.Handler {
+	upload := slices.Contains(uploadRoutes, pattern)
+	api := strings.Contains(pattern, " "+apiPrefix+"/")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := h.bodyLimits.Form
+		switch {
+		case upload && multipartRequest(r):
+			limit = h.bodyLimits.Upload
+		case api:
+			limit = h.bodyLimits.JSON
+		}
+		// no need to read bodies known to be too large
+		if r.ContentLength > limit {
+			h.logger.Warn().Str("path", r.URL.Path).Int64("content_length", r.ContentLength).Msg("received too large request")
+			h.tooLarge(w, r, &http.MaxBytesError{Limit: limit})
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h handler) tooLarge(w http.ResponseWriter, r *http.Request, err error) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	w.Write([]byte(err.Error()))
+}
+
+func multipartRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "multipart/form-data"
+}
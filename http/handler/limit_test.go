@@ -0,0 +1,196 @@
+package handler_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matmazurk/acc2/http/handler"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimits(t *testing.T) {
+	newServer := func(t *testing.T, limits handler.RateLimits) (http.Handler, *persistenceFake) {
+		pf := newPersistenceFake()
+		pf.payers = []string{"mat"}
+		pf.categories = []string{"food"}
+		h, err := handler.NewHandler(pf, newImagestoreFake(), handler.WithRateLimits(limits))
+		require.NoError(t, err)
+		return loggedIn(t, h, pf, false), pf
+	}
+	from := func(req *http.Request, ip string) *http.Request {
+		req.RemoteAddr = ip + ":1234"
+		return req
+	}
+
+	t.Run("should_limit_logins_of_address", func(t *testing.T) {
+		pf := newPersistenceFake()
+		h, err := handler.NewHandler(pf, newImagestoreFake(), handler.WithRateLimits(handler.RateLimits{
+			Login: handler.Limit{Requests: 2, Per: time.Hour},
+		}))
+		require.NoError(t, err)
+		mux := http.NewServeMux()
+		h.Routes(mux)
+
+		form := url.Values{"name": {"nobody"}, "password": {"wrong"}}
+		require.Equal(t, http.StatusUnauthorized, postLogin(t, mux, form).Code)
+		require.Equal(t, http.StatusUnauthorized, postLogin(t, mux, form).Code)
+		rr := postLogin(t, mux, form)
+		require.Equal(t, http.StatusTooManyRequests, rr.Code)
+		require.Equal(t, "1800", rr.Header().Get("Retry-After"))
+		require.Contains(t, rr.Body.String(), "too many requests")
+
+		// the login page itself is not a login attempt
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/login", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		csrf := csrfCookie(t, mux)
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, from(withCSRF(req, csrf), "192.0.2.2"))
+		require.Equal(t, http.StatusUnauthorized, rr.Code)
+	})
+
+	t.Run("should_limit_requests_of_address", func(t *testing.T) {
+		// logging in takes three requests
+		srv, _ := newServer(t, handler.RateLimits{IP: handler.Limit{Requests: 5, Per: time.Minute}})
+
+		require.Equal(t, http.StatusOK, serveAPI(t, srv, "GET", "/api/v1/expenses", nil).Code)
+		require.Equal(t, http.StatusOK, serveAPI(t, srv, "GET", "/api/v1/expenses", nil).Code)
+		rr := serveAPI(t, srv, "GET", "/api/v1/expenses", nil)
+		requireAPIError(t, rr, http.StatusTooManyRequests, "too_many_requests")
+		require.Equal(t, "12", rr.Header().Get("Retry-After"))
+
+		req := from(httptest.NewRequest("GET", "/api/v1/expenses", nil), "192.0.2.2")
+		require.Equal(t, http.StatusOK, serveAPIRequest(t, srv, req).Code)
+	})
+
+	t.Run("should_limit_requests_of_user_from_any_address", func(t *testing.T) {
+		srv, _ := newServer(t, handler.RateLimits{User: handler.Limit{Requests: 2, Per: time.Minute}})
+
+		for _, ip := range []string{"192.0.2.2", "192.0.2.3"} {
+			req := from(httptest.NewRequest("GET", "/api/v1/expenses", nil), ip)
+			require.Equal(t, http.StatusOK, serveAPIRequest(t, srv, req).Code)
+		}
+		req := from(httptest.NewRequest("GET", "/api/v1/expenses", nil), "192.0.2.4")
+		requireAPIError(t, serveAPIRequest(t, srv, req), http.StatusTooManyRequests, "too_many_requests")
+
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		require.Equal(t, http.StatusTooManyRequests, rr.Code)
+		require.NotEmpty(t, rr.Header().Get("Retry-After"))
+	})
+
+	t.Run("should_limit_uploads_of_user", func(t *testing.T) {
+		srv, pf := newServer(t, handler.RateLimits{Upload: handler.Limit{Requests: 1, Per: time.Hour}})
+		fields := map[string]string{"description": "groceries", "payer": "mat", "category": "food", "amount": "10.00", "currency": "PLN"}
+		upload := func() *httptest.ResponseRecorder {
+			body, contentType := multipartBody(t, fields, []byte("GIF89a photo"))
+			req := httptest.NewRequest("POST", "/api/v1/expenses", body)
+			req.Header.Set("Content-Type", contentType)
+			return serveAPIRequest(t, srv, req)
+		}
+
+		require.Equal(t, http.StatusCreated, upload().Code)
+		rr := upload()
+		requireAPIError(t, rr, http.StatusTooManyRequests, "too_many_requests")
+		require.Equal(t, "3600", rr.Header().Get("Retry-After"))
+
+		// expenses without photos are not uploads
+		input := map[string]any{"description": "bread", "payer": "mat", "category": "food", "amount": "3.00", "currency": "PLN"}
+		require.Equal(t, http.StatusCreated, serveAPI(t, srv, "POST", "/api/v1/expenses", input).Code)
+		require.Len(t, pf.expenses, 2)
+	})
+}
+
+func TestBodyLimits(t *testing.T) {
+	pf := newPersistenceFake()
+	pf.payers = []string{"mat"}
+	pf.categories = []string{"food"}
+	h, err := handler.NewHandler(pf, newImagestoreFake(), handler.WithBodyLimits(handler.BodyLimits{
+		Form:   256,
+		JSON:   128,
+		Upload: 2048,
+	}))
+	require.NoError(t, err)
+	srv := loggedIn(t, h, pf, false)
+
+	fields := map[string]string{"description": "groceries", "payer": "mat", "category": "food", "amount": "10.00", "currency": "PLN"}
+	upload := func(photo []byte) *httptest.ResponseRecorder {
+		body, contentType := multipartBody(t, fields, photo)
+		req := httptest.NewRequest("POST", "/api/v1/expenses", body)
+		req.Header.Set("Content-Type", contentType)
+		return serveAPIRequest(t, srv, req)
+	}
+
+	t.Run("should_reject_large_forms", func(t *testing.T) {
+		form := url.Values{"category": {strings.Repeat("a", 300)}}
+		req := httptest.NewRequest("POST", "/categories", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+		require.Len(t, pf.categories, 1)
+	})
+
+	t.Run("should_reject_large_json", func(t *testing.T) {
+		rr := serveAPI(t, srv, "POST", "/api/v1/categories", map[string]string{"name": strings.Repeat("a", 200)})
+		requireAPIError(t, rr, http.StatusRequestEntityTooLarge, "payload_too_large")
+	})
+
+	t.Run("should_reject_large_bodies_of_unknown_length", func(t *testing.T) {
+		body := io.MultiReader(strings.NewReader(`{"name":"` + strings.Repeat("a", 200) + `"}`))
+		req := httptest.NewRequest("POST", "/api/v1/categories", body)
+		req.Header.Set("Content-Type", "application/json")
+		require.EqualValues(t, -1, req.ContentLength)
+		requireAPIError(t, serveAPIRequest(t, srv, req), http.StatusRequestEntityTooLarge, "payload_too_large")
+	})
+
+	t.Run("should_accept_uploads_up_to_upload_limit", func(t *testing.T) {
+		photo := append([]byte("GIF89a"), make([]byte, 1024)...)
+		require.Equal(t, http.StatusCreated, upload(photo).Code)
+
+		photo = append([]byte("GIF89a"), make([]byte, 4096)...)
+		requireAPIError(t, upload(photo), http.StatusRequestEntityTooLarge, "payload_too_large")
+		require.Len(t, pf.expenses, 1)
+	})
+}
+
+func TestLimit(t *testing.T) {
+	tcs := []struct {
+		text  string
+		limit handler.Limit
+		err   bool
+	}{
+		{text: "10/15m", limit: handler.Limit{Requests: 10, Per: 15 * time.Minute}},
+		{text: "off"},
+		{text: "0"},
+		{text: "10", err: true},
+		{text: "-1/1m", err: true},
+		{text: "10/soon", err: true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.text, func(t *testing.T) {
+			var l handler.Limit
+			err := l.UnmarshalText([]byte(tc.text))
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.limit, l)
+
+			text, err := l.MarshalText()
+			require.NoError(t, err)
+			var again handler.Limit
+			require.NoError(t, again.UnmarshalText(text))
+			require.Equal(t, l, again)
+		})
+	}
+}
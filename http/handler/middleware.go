@@ -17,7 +17,15 @@ func logh(next http.Handler, logger zerolog.Logger) http.Handler {
 		}
 		next.ServeHTTP(cw, r)
 
-		logger.Info().Str("path", r.URL.Path).Str("duration", time.Since(start).String()).Int("response_code", cw.statusCode).Msg("request handled")
+		e := logger.Info().Str("path", r.URL.Path).Str("duration", time.Since(start).String()).Int("response_code", cw.statusCode)
+		if u, ok := currentUser(r); ok {
+			e = e.Str("user", u.Name)
+		}
+		// requests of scripts are told apart by the token they use
+		if t, ok := currentToken(r); ok {
+			e = e.Str("token", t.Name).Str("token_scope", string(t.Scope))
+		}
+		e.Msg("request handled")
 	})
 }
 
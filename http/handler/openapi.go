@@ -0,0 +1,156 @@
+package handler
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// openAPI documents the /api/v1 endpoints, handler tests check every api
+// request and response against it.
+//
+//go:embed openapi.json
+var openAPI []byte
+
+func (h handler) GetOpenAPI() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPI)
+	})
+}
+
+// GetAPIDocs renders the operations of the OpenAPI document.
+func (h handler) GetAPIDocs() http.HandlerFunc {
+	type parameter struct {
+		Name        string
+		In          string
+		Description string
+	}
+	type operation struct {
+		Method      string
+		Path        string
+		Summary     string
+		Description string
+		Parameters  []parameter
+		Statuses    []string
+	}
+	type data struct {
+		Title       string
+		Version     string
+		Description string
+		BasePath    string
+		Operations  []operation
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var doc openAPIDocument
+		err := json.Unmarshal(openAPI, &doc)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		d := data{
+			Title:       doc.Info.Title,
+			Version:     doc.Info.Version,
+			Description: doc.Info.Description,
+			BasePath:    apiPrefix,
+		}
+		paths := make([]string, 0, len(doc.Paths))
+		for p := range doc.Paths {
+			paths = append(paths, p)
+		}
+		slices.Sort(paths)
+		for _, p := range paths {
+			item := doc.Paths[p]
+			for _, method := range []string{"get", "post", "put", "delete"} {
+				op, ok := item.operation(method)
+				if !ok {
+					continue
+				}
+				o := operation{
+					Method:      strings.ToUpper(method),
+					Path:        p,
+					Summary:     op.Summary,
+					Description: op.Description,
+				}
+				for _, param := range append(item.Parameters, op.Parameters...) {
+					param = doc.parameter(param)
+					o.Parameters = append(o.Parameters, parameter{Name: param.Name, In: param.In, Description: param.Description})
+				}
+				for status := range op.Responses {
+					o.Statuses = append(o.Statuses, status)
+				}
+				slices.Sort(o.Statuses)
+				d.Operations = append(d.Operations, o)
+			}
+		}
+
+		h.templates.ExecuteTemplate(w, "apidocs.html", d)
+	})
+}
+
+// openAPIDocument holds the parts of the OpenAPI document rendered by the
+// docs page.
+type openAPIDocument struct {
+	Info struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		Version     string `json:"version"`
+	} `json:"info"`
+	Paths      map[string]openAPIPathItem `json:"paths"`
+	Components struct {
+		Parameters map[string]openAPIParameter `json:"parameters"`
+	} `json:"components"`
+}
+
+type openAPIPathItem struct {
+	Parameters []openAPIParameter `json:"parameters"`
+	Get        *openAPIOperation  `json:"get"`
+	Post       *openAPIOperation  `json:"post"`
+	Put        *openAPIOperation  `json:"put"`
+	Delete     *openAPIOperation  `json:"delete"`
+}
+
+func (p openAPIPathItem) operation(method string) (openAPIOperation, bool) {
+	var op *openAPIOperation
+	switch method {
+	case "get":
+		op = p.Get
+	case "post":
+		op = p.Post
+	case "put":
+		op = p.Put
+	case "delete":
+		op = p.Delete
+	}
+	if op == nil {
+		return openAPIOperation{}, false
+	}
+	return *op, true
+}
+
+type openAPIOperation struct {
+	Summary     string                     `json:"summary"`
+	Description string                     `json:"description"`
+	Parameters  []openAPIParameter         `json:"parameters"`
+	Responses   map[string]json.RawMessage `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Ref         string `json:"$ref"`
+	Name        string `json:"name"`
+	In          string `json:"in"`
+	Description string `json:"description"`
+}
+
+// parameter resolves references to components of the document.
+func (d openAPIDocument) parameter(p openAPIParameter) openAPIParameter {
+	name, ok := strings.CutPrefix(p.Ref, "#/components/parameters/")
+	if !ok {
+		return p
+	}
+	return d.Components.Parameters[name]
+}
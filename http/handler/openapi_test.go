@@ -0,0 +1,478 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAPI(t *testing.T) {
+	// routes are only walked, never served
+	h, err := NewHandler(struct{ Persistence }{}, nil)
+	require.NoError(t, err)
+
+	spec, err := loadOpenAPISpec()
+	require.NoError(t, err)
+
+	t.Run("should_document_every_api_route", func(t *testing.T) {
+		routes := map[string]bool{}
+		for _, e := range h.apiEndpoints() {
+			routes[e.method+" "+e.path] = true
+		}
+
+		documented := map[string]bool{}
+		for p, item := range object(spec.doc["paths"]) {
+			for method := range object(item) {
+				if method == "parameters" {
+					continue
+				}
+				documented[strings.ToUpper(method)+" "+p] = true
+			}
+		}
+
+		require.Equal(t, routes, documented)
+	})
+
+	t.Run("should_serve_document", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.GetOpenAPI().ServeHTTP(rr, httptest.NewRequest("GET", "/api/openapi.json", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+		require.True(t, json.Valid(rr.Body.Bytes()))
+	})
+
+	t.Run("should_render_docs_of_every_operation", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.GetAPIDocs().ServeHTTP(rr, httptest.NewRequest("GET", "/api/docs", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+		for _, e := range h.apiEndpoints() {
+			require.Contains(t, rr.Body.String(), e.method+" "+e.path)
+		}
+	})
+
+	t.Run("should_reject_exchanges_not_matching_document", func(t *testing.T) {
+		tcs := []struct {
+			name   string
+			method string
+			target string
+			body   string
+			status int
+			resp   string
+			ledger string
+		}{
+			{name: "unknown_path", method: "GET", target: "/api/v1/nothing", status: 200, resp: `{}`},
+			{name: "undocumented_status", method: "GET", target: "/api/v1/payers", status: 418, resp: `{}`},
+			{name: "invalid_response", method: "GET", target: "/api/v1/payers", status: 200, resp: `{"items":[1]}`},
+			{name: "undocumented_property", method: "GET", target: "/api/v1/payers", status: 200, resp: `{"items":[],"next":2}`},
+			{name: "invalid_query", method: "GET", target: "/api/v1/expenses?limit=0", status: 200, resp: `{"items":[],"total":0,"limit":1,"offset":0}`},
+			{name: "undocumented_query", method: "GET", target: "/api/v1/expenses?sort=asc", status: 200, resp: `{"items":[],"total":0,"limit":1,"offset":0}`},
+			{name: "invalid_path_parameter", method: "DELETE", target: "/api/v1/expenses/1", status: 204},
+			{name: "invalid_request_body", method: "POST", target: "/api/v1/payers", body: `{"name":""}`, status: 201, resp: `{"name":"x"}`},
+			{name: "invalid_error_code", method: "DELETE", target: "/api/v1/payers/x", status: 404, resp: `{"error":{"code":"gone","message":"m"}}`},
+			{name: "invalid_header", method: "GET", target: "/api/v1/payers", status: 200, resp: `{"items":[]}`, ledger: "first"},
+		}
+		for _, tc := range tcs {
+			t.Run(tc.name, func(t *testing.T) {
+				req := httptest.NewRequest(tc.method, tc.target, nil)
+				req.Header.Set(csrfHeader, "token")
+				if tc.ledger != "" {
+					req.Header.Set(ledgerHeader, tc.ledger)
+				}
+				if tc.body != "" {
+					req.Header.Set("Content-Type", "application/json")
+				}
+				rr := httptest.NewRecorder()
+				if tc.resp != "" {
+					rr.Header().Set("Content-Type", "application/json")
+				}
+				rr.WriteHeader(tc.status)
+				rr.WriteString(tc.resp)
+
+				require.Error(t, spec.validate(req, []byte(tc.body), rr))
+			})
+		}
+	})
+}
+
+// validateAPIExchange checks req, sent with body, and its response rr
+// against the OpenAPI document. Requests are checked only when they
+// succeeded, as tests send invalid requests on purpose.
+func validateAPIExchange(req *http.Request, body []byte, rr *httptest.ResponseRecorder) error {
+	spec, err := loadOpenAPISpec()
+	if err != nil {
+		return err
+	}
+	return spec.validate(req, body, rr)
+}
+
+// openAPISpec is a minimal validator of the subset of OpenAPI 3 and JSON
+// schema used by openapi.json.
+type openAPISpec struct {
+	doc map[string]any
+}
+
+func loadOpenAPISpec() (openAPISpec, error) {
+	var doc map[string]any
+	err := json.Unmarshal(openAPI, &doc)
+	if err != nil {
+		return openAPISpec{}, fmt.Errorf("invalid openapi.json: %w", err)
+	}
+	return openAPISpec{doc: doc}, nil
+}
+
+func (s openAPISpec) validate(req *http.Request, body []byte, rr *httptest.ResponseRecorder) error {
+	path, ok := strings.CutPrefix(req.URL.Path, apiPrefix)
+	if !ok {
+		return fmt.Errorf("'%s' is not an api path", req.URL.Path)
+	}
+	template, item, pathParams, ok := s.findPath(path)
+	if !ok {
+		return fmt.Errorf("'%s' is not documented", path)
+	}
+	op := object(item[strings.ToLower(req.Method)])
+	if op == nil {
+		return fmt.Errorf("%s %s is not documented", req.Method, template)
+	}
+	where := req.Method + " " + template
+
+	resp := object(object(op["responses"])[strconv.Itoa(rr.Code)])
+	if resp == nil {
+		return fmt.Errorf("%s: status %d is not documented", where, rr.Code)
+	}
+
+	if rr.Code < 300 {
+		err := s.validateParameters(req, pathParams, append(list(item["parameters"]), list(op["parameters"])...))
+		if err != nil {
+			return fmt.Errorf("%s: request: %w", where, err)
+		}
+		err = s.validateRequestBody(req.Header.Get("Content-Type"), body, s.resolve(op["requestBody"]))
+		if err != nil {
+			return fmt.Errorf("%s: request: %w", where, err)
+		}
+	}
+
+	err := s.validateResponse(rr, s.resolve(resp))
+	if err != nil {
+		return fmt.Errorf("%s: response %d: %w", where, rr.Code, err)
+	}
+
+	return nil
+}
+
+// findPath matches path against the path templates of the document.
+func (s openAPISpec) findPath(path string) (string, map[string]any, map[string]string, bool) {
+	segments := strings.Split(path, "/")
+	for template, item := range object(s.doc["paths"]) {
+		templateSegments := strings.Split(template, "/")
+		if len(templateSegments) != len(segments) {
+			continue
+		}
+		params := map[string]string{}
+		matches := true
+		for i, ts := range templateSegments {
+			if strings.HasPrefix(ts, "{") && strings.HasSuffix(ts, "}") && segments[i] != "" {
+				params[strings.Trim(ts, "{}")] = segments[i]
+				continue
+			}
+			if ts != segments[i] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return template, object(item), params, true
+		}
+	}
+	return "", nil, nil, false
+}
+
+func (s openAPISpec) validateParameters(req *http.Request, pathParams map[string]string, params []any) error {
+	query := req.URL.Query()
+	documented := map[string]bool{}
+	for _, p := range params {
+		p := s.resolve(p)
+		name, _ := p["name"].(string)
+		required, _ := p["required"].(bool)
+
+		var (
+			value   string
+			present bool
+		)
+		switch p["in"] {
+		case "path":
+			value, present = pathParams[name]
+		case "query":
+			documented[name] = true
+			present = query.Has(name)
+			value = query.Get(name)
+		case "header":
+			value = req.Header.Get(name)
+			present = value != ""
+		default:
+			continue
+		}
+		if !present {
+			if required {
+				return fmt.Errorf("missing %s parameter '%s'", p["in"], name)
+			}
+			continue
+		}
+
+		err := s.validateString(value, p["schema"], name)
+		if err != nil {
+			return err
+		}
+	}
+
+	for name := range query {
+		if !documented[name] {
+			return fmt.Errorf("query parameter '%s' is not documented", name)
+		}
+	}
+	return nil
+}
+
+func (s openAPISpec) validateRequestBody(contentType string, body []byte, requestBody map[string]any) error {
+	if requestBody == nil {
+		if len(body) > 0 {
+			return fmt.Errorf("body is not documented")
+		}
+		return nil
+	}
+	if len(body) == 0 {
+		if required, _ := requestBody["required"].(bool); required {
+			return fmt.Errorf("missing body")
+		}
+		return nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid content type '%s'", contentType)
+	}
+	media := object(object(requestBody["content"])[mediaType])
+	if media == nil {
+		return fmt.Errorf("content type '%s' is not documented", mediaType)
+	}
+
+	switch mediaType {
+	case "application/json":
+		var v any
+		err := json.Unmarshal(body, &v)
+		if err != nil {
+			return fmt.Errorf("invalid json: %w", err)
+		}
+		return s.validateValue(v, media["schema"], "body")
+	case "multipart/form-data":
+		form, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).ReadForm(32 << 20)
+		if err != nil {
+			return fmt.Errorf("invalid multipart form: %w", err)
+		}
+		defer form.RemoveAll()
+
+		// fields are strings and files binary strings, so both validate
+		// as strings of the form schema
+		v := map[string]any{}
+		for name, values := range form.Value {
+			v[name] = values[0]
+		}
+		for name := range form.File {
+			v[name] = ""
+		}
+		return s.validateValue(v, media["schema"], "form")
+	}
+
+	return nil
+}
+
+func (s openAPISpec) validateResponse(rr *httptest.ResponseRecorder, resp map[string]any) error {
+	content := object(resp["content"])
+	if content == nil {
+		if rr.Body.Len() > 0 {
+			return fmt.Errorf("body is not documented")
+		}
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(rr.Header().Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("invalid content type '%s'", rr.Header().Get("Content-Type"))
+	}
+	for documented, media := range content {
+		mainType, _, _ := strings.Cut(mediaType, "/")
+		if documented != mediaType && documented != mainType+"/*" {
+			continue
+		}
+		if mediaType != "application/json" {
+			return nil
+		}
+
+		var v any
+		err := json.Unmarshal(rr.Body.Bytes(), &v)
+		if err != nil {
+			return fmt.Errorf("invalid json: %w", err)
+		}
+		return s.validateValue(v, object(media)["schema"], "body")
+	}
+
+	return fmt.Errorf("content type '%s' is not documented", mediaType)
+}
+
+// validateString validates a parameter value, converted to the type of
+// schema.
+func (s openAPISpec) validateString(value string, schema any, at string) error {
+	sch := s.resolve(schema)
+	switch sch["type"] {
+	case "integer", "number":
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%s: '%s' is not a number", at, value)
+		}
+		return s.validateValue(n, sch, at)
+	case "boolean":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: '%s' is not a boolean", at, value)
+		}
+		return s.validateValue(b, sch, at)
+	}
+	return s.validateValue(value, sch, at)
+}
+
+func (s openAPISpec) validateValue(v any, schema any, at string) error {
+	sch := s.resolve(schema)
+
+	if enum := list(sch["enum"]); enum != nil && !slices.Contains(enum, v) {
+		return fmt.Errorf("%s: %v is not one of %v", at, v, enum)
+	}
+
+	switch sch["type"] {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected object", at)
+		}
+		for _, name := range list(sch["required"]) {
+			if _, ok := obj[name.(string)]; !ok {
+				return fmt.Errorf("%s: missing property '%s'", at, name)
+			}
+		}
+		props := object(sch["properties"])
+		for name, value := range obj {
+			prop, ok := props[name]
+			if !ok {
+				if additional, ok := sch["additionalProperties"].(bool); ok && !additional {
+					return fmt.Errorf("%s: property '%s' is not documented", at, name)
+				}
+				continue
+			}
+			err := s.validateValue(value, prop, at+"."+name)
+			if err != nil {
+				return err
+			}
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			return fmt.Errorf("%s: expected array", at)
+		}
+		for i, item := range arr {
+			err := s.validateValue(item, sch["items"], fmt.Sprintf("%s[%d]", at, i))
+			if err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected string", at)
+		}
+		if minLength, ok := sch["minLength"].(float64); ok && float64(len(str)) < minLength {
+			return fmt.Errorf("%s: shorter than %v", at, minLength)
+		}
+		if pattern, ok := sch["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(str) {
+			return fmt.Errorf("%s: '%s' does not match '%s'", at, str, pattern)
+		}
+		switch sch["format"] {
+		case "date-time":
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				return fmt.Errorf("%s: '%s' is not a date-time", at, str)
+			}
+		case "uuid":
+			if _, err := uuid.Parse(str); err != nil {
+				return fmt.Errorf("%s: '%s' is not a uuid", at, str)
+			}
+		}
+	case "integer", "number":
+		n, ok := v.(float64)
+		if !ok {
+			return fmt.Errorf("%s: expected %s", at, sch["type"])
+		}
+		if sch["type"] == "integer" && n != float64(int64(n)) {
+			return fmt.Errorf("%s: %v is not an integer", at, n)
+		}
+		if minimum, ok := sch["minimum"].(float64); ok && n < minimum {
+			return fmt.Errorf("%s: %v is less than %v", at, n, minimum)
+		}
+		if maximum, ok := sch["maximum"].(float64); ok && n > maximum {
+			return fmt.Errorf("%s: %v is greater than %v", at, n, maximum)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: expected boolean", at)
+		}
+	}
+
+	return nil
+}
+
+// resolve follows local references of v.
+func (s openAPISpec) resolve(v any) map[string]any {
+	obj := object(v)
+	for obj != nil {
+		ref, ok := obj["$ref"].(string)
+		if !ok {
+			return obj
+		}
+		var target any = s.doc
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			target = object(target)[part]
+		}
+		obj = object(target)
+	}
+	return nil
+}
+
+func object(v any) map[string]any {
+	obj, _ := v.(map[string]any)
+	return obj
+}
+
+func list(v any) []any {
+	l, _ := v.([]any)
+	return l
+}
+
+// readBody returns the body of req and makes it readable again.
+func readBody(req *http.Request) []byte {
+	if req.Body == nil {
+		return nil
+	}
+	body, _ := io.ReadAll(req.Body)
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body
+}
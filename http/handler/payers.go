@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/matmazurk/acc2/model"
+)
+
+func (h handler) GetPayers() http.HandlerFunc {
+	type data struct {
+		Payers    []model.Payer
+		Users     []string
+		CSRFToken string
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payers, err := h.pers.ListPayerLinks(currentLedger(r).ID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		users, err := h.pers.ListUsers()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		d := data{Payers: payers, CSRFToken: csrfToken(r)}
+		for _, u := range users {
+			d.Users = append(d.Users, u.Name)
+		}
+		h.templates.ExecuteTemplate(w, "payers.html", d)
+	})
+}
+
+// AddPayer creates a payer, linked to the user of the user form value
+// when it is set.
+func (h handler) AddPayer() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		name := strings.TrimSpace(r.PostFormValue("name"))
+		user := r.PostFormValue("user")
+		if name == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("payer name cannot be empty"))
+			return
+		}
+
+		if user != "" {
+			err = h.pers.CreateLinkedPayer(currentLedger(r).ID, name, user)
+		} else {
+			err = h.pers.CreatePayer(currentLedger(r).ID, name)
+		}
+		if err != nil {
+			h.writePayerError(w, err)
+			return
+		}
+
+		http.Redirect(w, r, "/admin/payers", http.StatusFound)
+	})
+}
+
+// LinkPayer links the payer to the user of the user form value, or
+// unlinks it when the value is empty.
+func (h handler) LinkPayer() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		err = h.pers.LinkPayer(currentLedger(r).ID, r.PathValue("name"), r.PostFormValue("user"))
+		if err != nil {
+			h.writePayerError(w, err)
+			return
+		}
+
+		http.Redirect(w, r, "/admin/payers", http.StatusFound)
+	})
+}
+
+func (h handler) writePayerError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, model.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, model.ErrInUse):
+		w.WriteHeader(http.StatusConflict)
+	default:
+		h.logger.Error().Err(err).Msg("could not save payer")
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.Write([]byte(err.Error()))
+}
+
+// defaultPayer returns the payer linked to the user of r, empty when there
+// is none.
+func defaultPayer(r *http.Request, payers []model.Payer) string {
+	u, ok := currentUser(r)
+	if !ok {
+		return ""
+	}
+	for _, p := range payers {
+		if p.User == u.Name {
+			return p.Name
+		}
+	}
+	return ""
+}
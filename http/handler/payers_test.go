@@ -0,0 +1,97 @@
+package handler_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/matmazurk/acc2/http/handler"
+	"github.com/matmazurk/acc2/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayers(t *testing.T) {
+	pf := newPersistenceFake()
+	h, err := handler.NewHandler(pf, newImagestoreFake())
+	require.NoError(t, err)
+
+	srv := loggedIn(t, h, pf, true)
+	userSrv := loggedIn(t, h, pf, false)
+	pf.grant(1, "user", model.RoleEditor)
+	post := func(srv http.Handler, path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		return rr
+	}
+	get := func(srv http.Handler, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+
+	t.Run("should_require_owner", func(t *testing.T) {
+		require.Equal(t, http.StatusForbidden, get(userSrv, "/admin/payers").Code)
+		require.Equal(t, http.StatusForbidden, post(userSrv, "/admin/payers", url.Values{"name": {"mat"}}).Code)
+		require.Equal(t, http.StatusForbidden, post(userSrv, "/admin/payers/mat/user", url.Values{"user": {"user"}}).Code)
+		require.Empty(t, pf.payers)
+
+		require.NotContains(t, get(userSrv, "/").Body.String(), `href="/admin/payers"`)
+		require.Contains(t, get(srv, "/").Body.String(), `href="/admin/payers"`)
+	})
+
+	t.Run("should_add_payers", func(t *testing.T) {
+		rr := post(srv, "/admin/payers", url.Values{"name": {" mat "}, "user": {"user"}})
+		require.Equal(t, http.StatusFound, rr.Code)
+		rr = post(srv, "/admin/payers", url.Values{"name": {"paulka"}})
+		require.Equal(t, http.StatusFound, rr.Code)
+		require.Equal(t, []string{"mat", "paulka"}, pf.payers)
+		require.Equal(t, map[string]string{"mat": "user"}, pf.payerUsers)
+
+		rr = get(srv, "/admin/payers")
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Contains(t, rr.Body.String(), `action="/admin/payers/mat/user"`)
+		require.Contains(t, rr.Body.String(), `<option value="user" selected>user</option>`)
+	})
+
+	t.Run("should_reject_invalid_payers", func(t *testing.T) {
+		rr := post(srv, "/admin/payers", url.Values{"name": {" "}})
+		require.Equal(t, http.StatusBadRequest, rr.Code)
+		rr = post(srv, "/admin/payers", url.Values{"name": {"other"}, "user": {"nobody"}})
+		require.Equal(t, http.StatusNotFound, rr.Code)
+		rr = post(srv, "/admin/payers", url.Values{"name": {"mat"}})
+		require.Equal(t, http.StatusConflict, rr.Code)
+		// the user is linked to mat already
+		rr = post(srv, "/admin/payers", url.Values{"name": {"other"}, "user": {"user"}})
+		require.Equal(t, http.StatusConflict, rr.Code)
+		require.Equal(t, []string{"mat", "paulka"}, pf.payers)
+	})
+
+	t.Run("should_link_and_unlink_payers", func(t *testing.T) {
+		rr := post(srv, "/admin/payers/paulka/user", url.Values{"user": {"user"}})
+		require.Equal(t, http.StatusConflict, rr.Code)
+
+		rr = post(srv, "/admin/payers/paulka/user", url.Values{"user": {"admin"}})
+		require.Equal(t, http.StatusFound, rr.Code)
+		require.Equal(t, "admin", pf.payerUsers["paulka"])
+
+		rr = post(srv, "/admin/payers/nobody/user", url.Values{"user": {"admin"}})
+		require.Equal(t, http.StatusNotFound, rr.Code)
+
+		rr = post(srv, "/admin/payers/paulka/user", url.Values{"user": {""}})
+		require.Equal(t, http.StatusFound, rr.Code)
+		require.NotContains(t, pf.payerUsers, "paulka")
+	})
+
+	t.Run("should_select_payer_of_current_user", func(t *testing.T) {
+		body := get(userSrv, "/expenses/add").Body.String()
+		require.Contains(t, body, `<option value="mat" selected>mat</option>`)
+		require.Contains(t, body, `<option value="paulka">paulka</option>`)
+
+		// admin is not linked to any payer
+		require.NotContains(t, get(srv, "/expenses/add").Body.String(), "selected")
+	})
+}
@@ -1,14 +1,13 @@
 package handler
 
 import (
+	"bytes"
 	"embed"
 	"errors"
 	"io"
-	"mime"
 	"net/http"
 	"os"
 	"slices"
-	"strings"
 	"time"
 
 	"github.com/matmazurk/acc2/model"
@@ -19,15 +18,56 @@ var src embed.FS
 
 func (h handler) Routes(m *http.ServeMux) {
 	m.Handle("GET /src/", h.MountSrc())
-	m.HandleFunc("GET /", h.GetIndex())
 
-	m.HandleFunc("GET /categories/add", h.GetCategories())
-	m.Handle("POST /categories", logh(h.AddCategory(), h.logger))
+	// every request is limited by the address it comes from and by the
+	// body limit of its route
+	public := func(pattern string, next http.Handler) {
+		m.Handle(pattern, h.rateLimited(h.limiters.ip, "ip", clientIP, h.bodyLimited(pattern, next)))
+	}
+	public("GET /login", h.csrfProtected(h.GetLogin()))
+	public("POST /login", h.rateLimited(h.limiters.login, "login", clientIP, h.csrfProtected(logh(h.Login(), h.logger))))
+
+	// every other route requires a logged in user
+	handle := func(pattern string, next http.Handler) {
+		public(pattern, h.authenticated(h.rateLimited(h.limiters.user, "user", userID, h.uploadLimited(pattern, h.csrfProtected(next)))))
+	}
+
+	// pages of expenses, payers and categories work on the current ledger,
+	// as long as the role of the user in it allows
+	inLedger := func(pattern string, role model.Role, next http.Handler) {
+		handle(pattern, h.inLedger(h.requireRole(role, next)))
+	}
+
+	handle("POST /logout", logh(h.Logout(), h.logger))
+	handle("GET /tokens", h.GetTokens())
+	handle("POST /tokens", logh(h.AddToken(), h.logger))
+	handle("POST /tokens/{name}/revoke", logh(h.RevokeToken(), h.logger))
+	inLedger("GET /", model.RoleViewer, h.GetIndex())
+	inLedger("POST /ledger", model.RoleViewer, logh(h.SwitchLedger(), h.logger))
+
+	inLedger("GET /categories/add", model.RoleOwner, h.GetCategories())
+	inLedger("POST /categories", model.RoleOwner, logh(h.AddCategory(), h.logger))
+
+	inLedger("GET /expenses/add", model.RoleEditor, h.GetAddExpense())
+	inLedger("POST /expenses", model.RoleEditor, logh(h.AddExpense(), h.logger))
+	inLedger("GET /expenses/{id}/edit", model.RoleEditor, h.GetEditExpense())
+	inLedger("POST /expenses/{id}", model.RoleEditor, logh(h.EditExpense(), h.logger))
+	inLedger("POST /expenses/{id}/delete", model.RoleOwner, logh(h.DeleteExpense(), h.logger))
+	inLedger("GET /expenses/{id}/photo", model.RoleViewer, h.GetPhoto())
+	inLedger("GET /expenses/export", model.RoleViewer, logh(h.ExportExpenses(), h.logger))
+
+	inLedger("GET /admin/payers", model.RoleOwner, h.GetPayers())
+	inLedger("POST /admin/payers", model.RoleOwner, logh(h.AddPayer(), h.logger))
+	inLedger("POST /admin/payers/{name}/user", model.RoleOwner, logh(h.LinkPayer(), h.logger))
+
+	// backups hold every ledger, so they are left to admins
+	if h.backups != nil {
+		handle("GET /admin/backups", h.adminOnly(h.GetBackups()))
+		handle("GET /admin/backups/{name}", logh(h.adminOnly(h.GetBackupArchive()), h.logger))
+		handle("GET /admin/backup", logh(h.adminOnly(h.DownloadBackup()), h.logger))
+	}
 
-	m.HandleFunc("GET /expenses/add", h.GetAddExpense())
-	m.Handle("POST /expenses", logh(h.AddExpense(), h.logger))
-	m.Handle("POST /expenses/{id}/delete", logh(h.DeleteExpense(), h.logger))
-	m.Handle("GET /expenses/{id}/photo", h.GetPhoto())
+	h.apiRoutes(handle)
 }
 
 func (h handler) MountSrc() http.HandlerFunc {
@@ -47,20 +87,36 @@ func (h handler) GetIndex() http.HandlerFunc {
 		Category    string
 		Currency    string
 		Time        string
+		// CanEdit shows the button editing the expense
+		CanEdit bool
 	}
 	type data struct {
 		Expenses []expense
+		// CanAdd shows the button adding expenses
+		CanAdd bool
+		// CanManage shows the buttons deleting expenses and managing
+		// payers and categories
+		CanManage bool
+		Ledger    model.Ledger
+		Ledgers   []model.Ledger
+		CSRFToken string
 	}
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			exps, err := h.pers.SelectExpenses()
+			exps, err := h.pers.SelectExpenses(currentLedger(r).ID)
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				w.Write([]byte(err.Error()))
 				return
 			}
+			l := currentLedger(r)
 			d := data{
-				Expenses: make([]expense, len(exps)),
+				Expenses:  make([]expense, len(exps)),
+				CanAdd:    l.Role.Allows(model.RoleEditor),
+				CanManage: l.Role.Allows(model.RoleOwner),
+				Ledger:    l,
+				Ledgers:   userLedgers(r),
+				CSRFToken: csrfToken(r),
 			}
 			for i, e := range exps {
 				d.Expenses[i] = expense{
@@ -71,6 +127,7 @@ func (h handler) GetIndex() http.HandlerFunc {
 					Category:    e.Category(),
 					Currency:    e.Currency(),
 					Time:        e.CreatedAt().In(h.location).Format("02 Jan 06 15:04"),
+					CanEdit:     canEdit(r, e),
 				}
 			}
 			h.templates.ExecuteTemplate(w, "index.html", d)
@@ -80,15 +137,16 @@ func (h handler) GetIndex() http.HandlerFunc {
 func (h handler) GetCategories() http.HandlerFunc {
 	type data struct {
 		Categories []string
+		CSRFToken  string
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		categories, err := h.pers.ListCategories()
+		categories, err := h.pers.ListCategories(currentLedger(r).ID)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
 			return
 		}
-		data := data{Categories: categories}
+		data := data{Categories: categories, CSRFToken: csrfToken(r)}
 		h.templates.ExecuteTemplate(w, "categories.html", data)
 	})
 }
@@ -97,15 +155,18 @@ func (h handler) GetAddExpense() http.HandlerFunc {
 	type data struct {
 		Users      []string
 		Categories []string
+		// Payer is selected by default, it is the payer of the current user
+		Payer     string
+		CSRFToken string
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		payers, err := h.pers.ListPayers()
+		payers, err := h.pers.ListPayerLinks(currentLedger(r).ID)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
 			return
 		}
-		categories, err := h.pers.ListCategories()
+		categories, err := h.pers.ListCategories(currentLedger(r).ID)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
@@ -113,8 +174,12 @@ func (h handler) GetAddExpense() http.HandlerFunc {
 		}
 
 		data := data{
-			Users:      payers,
 			Categories: categories,
+			Payer:      defaultPayer(r, payers),
+			CSRFToken:  csrfToken(r),
+		}
+		for _, p := range payers {
+			data.Users = append(data.Users, p.Name)
 		}
 		h.templates.ExecuteTemplate(w, "add.html", data)
 	})
@@ -124,6 +189,13 @@ func (h handler) AddExpense() http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		err := r.ParseMultipartForm(10 << 20)
 		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				h.logger.Warn().Err(err).Msg("received too large request")
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				w.Write([]byte(err.Error()))
+				return
+			}
 			if errors.Is(err, http.ErrNotMultipart) {
 				h.logger.Warn().Err(err).Msg("received request with invalid content type")
 				w.WriteHeader(http.StatusBadRequest)
@@ -149,6 +221,7 @@ func (h handler) AddExpense() http.HandlerFunc {
 			Amount:      amount,
 			Currency:    currency,
 			CreatedAt:   time.Now().In(h.location),
+			CreatedBy:   userName(r),
 		}.Build()
 		if err != nil {
 			h.logger.Warn().Err(err).Msg("invalid request for adding new expense")
@@ -159,13 +232,25 @@ func (h handler) AddExpense() http.HandlerFunc {
 
 		err = h.savePhoto(r, exp)
 		if err != nil {
+			if errors.Is(err, errPhotoTooLarge) {
+				h.logger.Warn().Err(err).Msg("received too large photo")
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			if errors.Is(err, errUnsupportedFileType) {
+				h.logger.Warn().Err(err).Msg("received photo of unsupported type")
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				w.Write([]byte(err.Error()))
+				return
+			}
 			h.logger.Error().Err(err).Msg("could not save photo")
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
 			return
 		}
 
-		err = h.pers.Insert(exp)
+		err = h.pers.Insert(currentLedger(r).ID, exp)
 		if err != nil {
 			h.logger.Error().Err(err).Msg("could not insert new expense")
 			w.WriteHeader(http.StatusInternalServerError)
@@ -177,6 +262,138 @@ func (h handler) AddExpense() http.HandlerFunc {
 	})
 }
 
+// formCurrencies are the currencies offered by the edit form
+var formCurrencies = []string{"zł", "€"}
+
+func (h handler) GetEditExpense() http.HandlerFunc {
+	type data struct {
+		ID          string
+		Description string
+		Amount      string
+		Currency    string
+		Payer       string
+		Category    string
+		Currencies  []string
+		Users       []string
+		Categories  []string
+		CSRFToken   string
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exp, ok := h.editedExpense(w, r)
+		if !ok {
+			return
+		}
+
+		payers, err := h.pers.ListPayers(currentLedger(r).ID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		categories, err := h.pers.ListCategories(currentLedger(r).ID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		data := data{
+			ID:          exp.ID(),
+			Description: exp.Description(),
+			Amount:      exp.Amount(),
+			Currency:    exp.Currency(),
+			Payer:       exp.Payer(),
+			Category:    exp.Category(),
+			Currencies:  formCurrencies,
+			Users:       payers,
+			Categories:  categories,
+			CSRFToken:   csrfToken(r),
+		}
+		// expenses added through the api may use other currencies
+		if !slices.Contains(formCurrencies, exp.Currency()) {
+			data.Currencies = append([]string{exp.Currency()}, formCurrencies...)
+		}
+		h.templates.ExecuteTemplate(w, "edit.html", data)
+	})
+}
+
+// EditExpense changes the expense to the submitted form, it stays the
+// expense of the user who added it.
+func (h handler) EditExpense() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current, ok := h.editedExpense(w, r)
+		if !ok {
+			return
+		}
+
+		err := r.ParseForm()
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				h.logger.Warn().Err(err).Msg("received too large request")
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		exp, err := model.ExpenseBuilder{
+			Id:          current.ID(),
+			Description: r.FormValue("description"),
+			Payer:       r.FormValue("author"),
+			Category:    r.FormValue("category"),
+			Amount:      r.FormValue("amount"),
+			Currency:    r.FormValue("currency"),
+			CreatedAt:   current.CreatedAt(),
+			CreatedBy:   current.CreatedBy(),
+		}.Build()
+		if err != nil {
+			h.logger.Warn().Err(err).Msg("invalid request for editing expense")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		err = h.pers.UpdateExpense(currentLedger(r).ID, exp)
+		if err != nil {
+			h.logger.Error().Err(err).Msg("could not update expense")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+}
+
+// editedExpense returns the expense of the id path value when the user may
+// change it, writing the error response otherwise.
+func (h handler) editedExpense(w http.ResponseWriter, r *http.Request) (model.Expense, bool) {
+	idString := r.PathValue("id")
+
+	exps, err := h.pers.SelectExpenses(currentLedger(r).ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return model.Expense{}, false
+	}
+	idx := slices.IndexFunc(exps, func(e model.Expense) bool { return e.ID() == idString })
+	if idx == -1 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("expense '" + idString + "' not found"))
+		return model.Expense{}, false
+	}
+	if !canEdit(r, exps[idx]) {
+		h.forbidden(w, r, errNotOwn)
+		return model.Expense{}, false
+	}
+
+	return exps[idx], true
+}
+
 func (h handler) savePhoto(r *http.Request, e model.Expense) error {
 	file, header, err := r.FormFile("photo")
 	if err != nil {
@@ -187,32 +404,13 @@ func (h handler) savePhoto(r *http.Request, e model.Expense) error {
 		return err
 	}
 	defer file.Close()
-	contentType := header.Header.Get("Content-Type")
 
-	// Extract file extension from content type
-	exts, err := mime.ExtensionsByType(contentType)
+	contents, ext, err := readUpload(file, header)
 	if err != nil {
 		return err
 	}
 
-	var ext string
-	if slices.Contains(exts, ".jpeg") {
-		ext = ".jpeg"
-	} else if len(exts) > 0 {
-		ext = exts[0]
-	} else {
-		ext = extractExtension(header.Filename)
-	}
-
-	return h.store.SaveExpensePhoto(e, ext, file)
-}
-
-func extractExtension(filename string) string {
-	parts := strings.Split(filename, ".")
-	if len(parts) > 1 {
-		return "." + parts[len(parts)-1]
-	}
-	return ""
+	return h.store.SaveExpensePhoto(e, ext, io.NopCloser(bytes.NewReader(contents)))
 }
 
 func (h handler) AddCategory() http.HandlerFunc {
@@ -225,7 +423,7 @@ func (h handler) AddCategory() http.HandlerFunc {
 		}
 		category := r.FormValue("category")
 
-		err = h.pers.CreateCategory(category)
+		err = h.pers.CreateCategory(currentLedger(r).ID, category)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
@@ -240,7 +438,7 @@ func (h handler) DeleteExpense() http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		idString := r.PathValue("id")
 
-		exps, err := h.pers.SelectExpenses()
+		exps, err := h.pers.SelectExpenses(currentLedger(r).ID)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
@@ -253,13 +451,21 @@ func (h handler) DeleteExpense() http.HandlerFunc {
 			return
 		}
 
-		err = h.pers.RemoveExpense(exps[idx])
+		exp := exps[idx]
+
+		err = h.pers.RemoveExpense(currentLedger(r).ID, exp)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
 			return
 		}
 
+		// a photo left behind is quarantined by the imagestore garbage collector
+		err = h.store.RemoveExpensePhoto(exp)
+		if err != nil {
+			h.logger.Error().Err(err).Str("expense_id", idString).Msg("could not remove expense photo")
+		}
+
 		http.Redirect(w, r, "/", http.StatusFound)
 	})
 }
@@ -268,7 +474,7 @@ func (h handler) GetPhoto() http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		idString := r.PathValue("id")
 
-		exps, err := h.pers.SelectExpenses()
+		exps, err := h.pers.SelectExpenses(currentLedger(r).ID)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
@@ -281,20 +487,40 @@ func (h handler) GetPhoto() http.HandlerFunc {
 			return
 		}
 
-		photo, err := h.store.LoadExpensePhoto(exps[idx])
+		err = h.servePhoto(w, r, exps[idx])
 		if err != nil {
 			if os.IsNotExist(err) {
 				w.WriteHeader(http.StatusNotFound)
 				w.Write([]byte("expense '" + idString + "' has no photo"))
 				return
 			}
+			if errors.Is(err, model.ErrPhotoCorrupted) {
+				h.logger.Error().Err(err).Str("expense_id", idString).Msg("expense photo is corrupted")
+			}
 
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
 			return
 		}
-		defer photo.Close()
-
-		io.Copy(w, photo)
 	})
 }
+
+// servePhoto serves the photo of e, nothing is written when the photo
+// could not be loaded.
+func (h handler) servePhoto(w http.ResponseWriter, r *http.Request, e model.Expense) error {
+	photo, err := h.store.LoadExpensePhoto(e)
+	if err != nil {
+		return err
+	}
+	defer photo.Close()
+
+	if photo.ContentType != "" {
+		w.Header().Set("Content-Type", photo.ContentType)
+	}
+	if photo.ETag != "" {
+		w.Header().Set("ETag", photo.ETag)
+	}
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeContent(w, r, "", photo.ModTime, photo)
+	return nil
+}
@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/matmazurk/acc2/model"
+)
+
+var errReadOnlyToken = errors.New("the api token is read only")
+
+// currentToken returns the api token r is authenticated by, if any.
+func currentToken(r *http.Request) (model.APIToken, bool) {
+	t, ok := r.Context().Value(tokenKey).(model.APIToken)
+	return t, ok
+}
+
+// bearerToken returns the token of the Authorization header of r.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// tokenAuthenticated serves api requests authenticated by the api token
+// raw as its user. Read only tokens are let through for safe methods only.
+func (h handler) tokenAuthenticated(w http.ResponseWriter, r *http.Request, raw string, next http.Handler) {
+	// pages are for browsers, which log in
+	if !strings.HasPrefix(r.URL.Path, "/api/") {
+		h.unauthenticated(w, r)
+		return
+	}
+
+	t, err := h.pers.GetAPIToken(hashToken(raw))
+	if err != nil {
+		if !errors.Is(err, model.ErrNotFound) {
+			h.logger.Error().Err(err).Msg("could not get api token")
+			writeAPIError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		writeAPIError(w, http.StatusUnauthorized, codeUnauthorized, "invalid api token")
+		return
+	}
+	if t.Scope != model.ScopeWrite && !safeMethod(r.Method) {
+		writeAPIError(w, http.StatusForbidden, codeForbidden, errReadOnlyToken.Error())
+		return
+	}
+
+	err = h.pers.TouchAPIToken(t.ID, time.Now())
+	if err != nil {
+		h.logger.Error().Err(err).Str("token", t.Name).Msg("could not record api token use")
+	}
+
+	ctx := context.WithValue(r.Context(), userKey, t.User)
+	ctx = context.WithValue(ctx, tokenKey, t)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func (h handler) GetTokens() http.HandlerFunc {
+	return h.tokensPage(http.StatusOK, "")
+}
+
+// tokensPage lists api tokens of the user, along with newToken when it was
+// just created, as it is shown only once.
+func (h handler) tokensPage(status int, newToken string) http.HandlerFunc {
+	type token struct {
+		Name     string
+		Scope    model.TokenScope
+		Created  string
+		LastUsed string
+	}
+	type data struct {
+		Tokens    []token
+		NewToken  string
+		CSRFToken string
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, _ := currentUser(r)
+		tokens, err := h.pers.ListAPITokens(u.ID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		d := data{NewToken: newToken, CSRFToken: csrfToken(r)}
+		for _, t := range tokens {
+			lastUsed := "never"
+			if !t.LastUsedAt.IsZero() {
+				lastUsed = t.LastUsedAt.In(h.location).Format("02 Jan 06 15:04")
+			}
+			d.Tokens = append(d.Tokens, token{
+				Name:     t.Name,
+				Scope:    t.Scope,
+				Created:  t.CreatedAt.In(h.location).Format("02 Jan 06 15:04"),
+				LastUsed: lastUsed,
+			})
+		}
+		w.WriteHeader(status)
+		h.templates.ExecuteTemplate(w, "tokens.html", d)
+	})
+}
+
+// AddToken creates an api token of the user named by the name form value
+// with the scope form value, and shows it.
+func (h handler) AddToken() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		scope, err := model.ParseTokenScope(r.PostFormValue("scope"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		raw, err := newToken()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		u, _ := currentUser(r)
+		t, err := model.NewAPIToken(u, strings.TrimSpace(r.PostFormValue("name")), scope, hashToken(raw))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		tokens, err := h.pers.ListAPITokens(u.ID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if slices.ContainsFunc(tokens, func(other model.APIToken) bool { return other.Name == t.Name }) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("api token '" + t.Name + "' already exists"))
+			return
+		}
+
+		err = h.pers.CreateAPIToken(t)
+		if err != nil {
+			h.logger.Error().Err(err).Msg("could not create api token")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		h.tokensPage(http.StatusCreated, raw).ServeHTTP(w, r)
+	})
+}
+
+func (h handler) RevokeToken() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, _ := currentUser(r)
+		err := h.pers.RevokeAPIToken(u.ID, r.PathValue("name"))
+		if err != nil {
+			if errors.Is(err, model.ErrNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			h.logger.Error().Err(err).Msg("could not revoke api token")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		http.Redirect(w, r, "/tokens", http.StatusFound)
+	})
+}
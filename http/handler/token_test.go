@@ -0,0 +1,145 @@
+package handler_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/matmazurk/acc2/http/handler"
+	"github.com/matmazurk/acc2/model"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPITokens(t *testing.T) {
+	pf := newPersistenceFake()
+	pf.payers = []string{"mat"}
+	pf.categories = []string{"food"}
+	logs := &bytes.Buffer{}
+	h, err := handler.NewHandler(pf, newImagestoreFake(), handler.WithLogger(zerolog.New(logs)))
+	require.NoError(t, err)
+
+	srv := loggedIn(t, h, pf, false)
+	// requests of scripts carry no cookies
+	mux := http.NewServeMux()
+	h.Routes(mux)
+
+	newTokenRe := regexp.MustCompile(`<code class="p-2 border rounded-lg">([^<]+)</code>`)
+	createToken := func(name, scope string) *httptest.ResponseRecorder {
+		form := url.Values{"name": {name}, "scope": {scope}}
+		req := httptest.NewRequest("POST", "/tokens", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		return rr
+	}
+	create := func(name, scope string) string {
+		rr := createToken(name, scope)
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+		m := newTokenRe.FindStringSubmatch(rr.Body.String())
+		require.Len(t, m, 2)
+		return m[1]
+	}
+	withToken := func(method, target, token string, body any) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, nil)
+		if body != nil {
+			req = httptest.NewRequest(method, target, strings.NewReader(body.(string)))
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return serveAPIRequest(t, mux, req)
+	}
+	writeToken := create("phone shortcut", "write")
+	readToken := create("script", "read")
+	expense := `{"description":"groceries","payer":"mat","category":"food","amount":"10.00","currency":"PLN"}`
+
+	t.Run("should_store_only_hashes", func(t *testing.T) {
+		require.Len(t, pf.tokens, 2)
+		for _, tok := range pf.tokens {
+			require.NotEqual(t, writeToken, tok.TokenHash)
+			require.NotEqual(t, readToken, tok.TokenHash)
+			require.Equal(t, "user", tok.User.Name)
+		}
+	})
+
+	t.Run("should_reject_invalid_tokens_to_create", func(t *testing.T) {
+		require.Equal(t, http.StatusConflict, createToken("script", "read").Code)
+		require.Equal(t, http.StatusBadRequest, createToken("other", "admin").Code)
+		require.Equal(t, http.StatusBadRequest, createToken(" ", "read").Code)
+	})
+
+	t.Run("should_write_without_csrf_token", func(t *testing.T) {
+		rr := withToken("POST", "/api/v1/expenses", writeToken, expense)
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+		require.Contains(t, rr.Body.String(), `"created_by":"user"`)
+		require.Empty(t, rr.Result().Cookies())
+	})
+
+	t.Run("should_only_read_with_read_token", func(t *testing.T) {
+		rr := withToken("GET", "/api/v1/expenses", readToken, nil)
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		rr = withToken("POST", "/api/v1/expenses", readToken, expense)
+		requireAPIError(t, rr, http.StatusForbidden, "forbidden")
+		require.Len(t, pf.expenses, 1)
+	})
+
+	t.Run("should_track_last_use", func(t *testing.T) {
+		for _, tok := range pf.tokens {
+			require.False(t, tok.LastUsedAt.IsZero(), tok.Name)
+		}
+
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, httptest.NewRequest("GET", "/tokens", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Contains(t, rr.Body.String(), "script (read)")
+		require.NotContains(t, rr.Body.String(), "last used never")
+		require.NotContains(t, rr.Body.String(), readToken)
+	})
+
+	t.Run("should_log_requests_with_token", func(t *testing.T) {
+		require.Contains(t, logs.String(), `"user":"user","token":"phone shortcut","token_scope":"write"`)
+		require.Contains(t, logs.String(), `"token":"script","token_scope":"read"`)
+	})
+
+	t.Run("should_reject_unknown_tokens", func(t *testing.T) {
+		rr := withToken("GET", "/api/v1/expenses", "not a token", nil)
+		requireAPIError(t, rr, http.StatusUnauthorized, "unauthorized")
+	})
+
+	t.Run("should_not_open_pages", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+writeToken)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusSeeOther, rr.Code)
+	})
+
+	t.Run("should_keep_roles_of_user", func(t *testing.T) {
+		pf.grant(1, "user", model.RoleViewer)
+		defer pf.grant(1, "user", model.RoleOwner)
+
+		rr := withToken("POST", "/api/v1/expenses", writeToken, expense)
+		requireAPIError(t, rr, http.StatusForbidden, "forbidden")
+	})
+
+	t.Run("should_revoke_tokens", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/tokens/script/revoke", nil)
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusFound, rr.Code)
+
+		rr = withToken("GET", "/api/v1/expenses", readToken, nil)
+		requireAPIError(t, rr, http.StatusUnauthorized, "unauthorized")
+
+		req = httptest.NewRequest("POST", "/tokens/script/revoke", nil)
+		rr = httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusNotFound, rr.Code)
+	})
+}
@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxUploadSize is the default limit of whole request bodies uploading
+	// photos
+	maxUploadSize = 25 << 20
+	// maxPhotoSize limits a single uploaded photo
+	maxPhotoSize = 10 << 20
+	// maxPhotoPixels limits the dimensions of decoded photos, small files
+	// may declare huge images
+	maxPhotoPixels = 50_000_000
+
+	jpegQuality = 90
+)
+
+var (
+	errPhotoTooLarge       = errors.New("photo exceeds size limit")
+	errUnsupportedFileType = errors.New("unsupported file type")
+)
+
+// allowedPhotoTypes maps sniffed content types of accepted uploads
+// to the extension they are stored with
+var allowedPhotoTypes = map[string]string{
+	"image/jpeg":      ".jpeg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+}
+
+// readUpload reads an uploaded file enforcing maxPhotoSize and returns its
+// contents together with the extension matching its sniffed content type.
+func readUpload(file multipart.File, header *multipart.FileHeader) ([]byte, string, error) {
+	if header.Size > maxPhotoSize {
+		return nil, "", errPhotoTooLarge
+	}
+
+	contents, err := io.ReadAll(io.LimitReader(file, maxPhotoSize+1))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "could not read uploaded file")
+	}
+	if len(contents) > maxPhotoSize {
+		return nil, "", errPhotoTooLarge
+	}
+
+	contentType := http.DetectContentType(contents)
+	ext, ok := allowedPhotoTypes[contentType]
+	if !ok {
+		return nil, "", errors.Wrapf(errUnsupportedFileType, "'%s'", contentType)
+	}
+
+	if contentType == "image/jpeg" {
+		contents, err = normalizeJPEG(contents)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	return contents, ext, nil
+}
+
+// normalizeJPEG re-encodes a JPEG, which drops all of its metadata (EXIF
+// including GPS position), and applies the EXIF orientation to the pixels
+// so the photo is displayed the right way up without it.
+func normalizeJPEG(contents []byte) ([]byte, error) {
+	orientation := exifOrientation(contents)
+
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(contents))
+	if err != nil {
+		return nil, errors.Wrapf(errUnsupportedFileType, "invalid jpeg: %s", err)
+	}
+	if cfg.Width*cfg.Height > maxPhotoPixels {
+		return nil, errors.Wrapf(errUnsupportedFileType, "jpeg of %dx%d pixels is too large", cfg.Width, cfg.Height)
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(contents))
+	if err != nil {
+		return nil, errors.Wrapf(errUnsupportedFileType, "invalid jpeg: %s", err)
+	}
+
+	out := &bytes.Buffer{}
+	err = jpeg.Encode(out, orient(img, orientation), &jpeg.Options{Quality: jpegQuality})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not encode jpeg")
+	}
+
+	return out.Bytes(), nil
+}
+
+// orient transforms img according to EXIF orientation values 2-8,
+// returning it unchanged for 1 and unknown values.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			si := src.PixOffset(x, y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+
+	return dst
+}
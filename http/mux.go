@@ -6,11 +6,9 @@ import (
 	"github.com/matmazurk/acc2/http/handler"
 )
 
-func NewMux(i handler.Persistence, s handler.Imagestore) *http.ServeMux {
+func NewMux(i handler.Persistence, s handler.Imagestore, opts ...handler.Option) *http.ServeMux {
 	mux := http.NewServeMux()
-	i.CreatePayer("mat")
-	i.CreatePayer("paulka")
-	h, err := handler.NewHandler(i, s)
+	h, err := handler.NewHandler(i, s, opts...)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,46 @@
+package http
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// WithHSTS makes browsers reach the server only over https for maxAge once
+// they visited it over https.
+func WithHSTS(next http.Handler, maxAge time.Duration) http.Handler {
+	value := "max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// browsers ignore the header over plain http
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RedirectToHTTPS redirects every request to the same url served over https
+// by the server listening on httpsAddr.
+func RedirectToHTTPS(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+		// methods other than GET and HEAD keep their method and body
+		code := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			code = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, u.String(), code)
+	})
+}
@@ -0,0 +1,75 @@
+package http_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	lhttp "github.com/matmazurk/acc2/http"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tcs := []struct {
+		name      string
+		httpsAddr string
+		method    string
+		target    string
+		location  string
+		code      int
+	}{
+		{
+			name:      "default_port",
+			httpsAddr: ":443",
+			method:    "GET",
+			target:    "http://acc2.local/expenses?page=2",
+			location:  "https://acc2.local/expenses?page=2",
+			code:      http.StatusMovedPermanently,
+		},
+		{
+			name:      "other_port",
+			httpsAddr: ":8443",
+			method:    "GET",
+			target:    "http://192.168.1.10:8080/",
+			location:  "https://192.168.1.10:8443/",
+			code:      http.StatusMovedPermanently,
+		},
+		{
+			name:      "keep_method_of_post",
+			httpsAddr: "0.0.0.0:443",
+			method:    "POST",
+			target:    "http://acc2.local/login",
+			location:  "https://acc2.local/login",
+			code:      http.StatusPermanentRedirect,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			lhttp.RedirectToHTTPS(tc.httpsAddr).ServeHTTP(rr, httptest.NewRequest(tc.method, tc.target, nil))
+			require.Equal(t, tc.code, rr.Code)
+			require.Equal(t, tc.location, rr.Header().Get("Location"))
+		})
+	}
+}
+
+func TestWithHSTS(t *testing.T) {
+	h := lhttp.WithHSTS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), 180*24*time.Hour)
+
+	t.Run("should_send_header_over_https", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.TLS = &tls.ConnectionState{}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		require.Equal(t, "max-age=15552000", rr.Header().Get("Strict-Transport-Security"))
+	})
+
+	t.Run("should_not_send_header_over_http", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		require.Empty(t, rr.Header().Get("Strict-Transport-Security"))
+	})
+}
@@ -0,0 +1,199 @@
+package imagestore
+
+import (
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Backend stores blobs under slash separated keys. Missing blobs are
+// reported with errors matching os.ErrNotExist.
+type Backend interface {
+	Put(key string, r io.Reader) error
+	Get(key string) (io.ReadCloser, BlobInfo, error)
+	List(prefix string) ([]BlobInfo, error)
+	Delete(key string) error
+}
+
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// tempFilePrefix marks files being written, they are never listed
+// and leftovers of interrupted writes are removed on startup
+const tempFilePrefix = ".tmp-"
+
+// blobDirs are the directories of root the store writes blobs to, only
+// they are searched for leftover temp files
+var blobDirs = []string{PhotosDir, strings.TrimSuffix(quarantinePrefix, "/")}
+
+type filesystemBackend struct {
+	root string
+}
+
+// NewFilesystemBackend returns a Backend keeping blobs as files under root,
+// creating root when needed and removing temp files left by interrupted writes.
+func NewFilesystemBackend(root string) (Backend, error) {
+	err := os.MkdirAll(root, 0o750)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create dir '%s'", root)
+	}
+
+	for _, dir := range blobDirs {
+		removeTempFiles(filepath.Join(root, dir))
+	}
+
+	return filesystemBackend{root: root}, nil
+}
+
+// removeTempFiles removes temp files under dir. Failing to is not fatal,
+// the files are never listed, so problems are only logged.
+func removeTempFiles(dir string) {
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if !(os.IsNotExist(err) && path == dir) {
+				slog.Warn("could not look for leftover temp files", slog.String("path", path), "error", err)
+			}
+			return nil
+		}
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			return nil
+		}
+		err = os.Remove(path)
+		if err != nil {
+			slog.Warn("could not remove leftover temp file", slog.String("path", path), "error", err)
+		}
+		return nil
+	})
+}
+
+// Put writes r to a temp file in the destination dir, syncs it and renames
+// it over the final path, so readers never see a partially written blob.
+func (b filesystemBackend) Put(key string, r io.Reader) error {
+	path := b.path(key)
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return errors.Wrapf(err, "could not create dir for '%s'", key)
+	}
+
+	file, err := os.CreateTemp(dir, tempFilePrefix+filepath.Base(path)+"-*")
+	if err != nil {
+		return errors.Wrapf(err, "could not create temp file for '%s'", path)
+	}
+	defer func() {
+		file.Close()
+		// no-op after successful rename
+		os.Remove(file.Name())
+	}()
+
+	_, err = io.Copy(file, r)
+	if err != nil {
+		return errors.Wrap(err, "could not copy file contents")
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return errors.Wrap(err, "could not sync file")
+	}
+
+	err = file.Close()
+	if err != nil {
+		return errors.Wrap(err, "could not close file")
+	}
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return errors.Wrapf(err, "could not rename temp file to '%s'", path)
+	}
+
+	return syncDir(dir)
+}
+
+func (b filesystemBackend) Get(key string) (io.ReadCloser, BlobInfo, error) {
+	f, err := os.Open(b.path(key))
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, BlobInfo{}, errors.Wrapf(err, "could not stat '%s'", key)
+	}
+
+	return f, BlobInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (b filesystemBackend) List(prefix string) ([]BlobInfo, error) {
+	dir := b.root
+	if i := strings.LastIndex(prefix, "/"); i != -1 {
+		dir = b.path(prefix[:i])
+	}
+
+	var blobs []BlobInfo
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(b.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		fi, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, BlobInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not list '%s'", prefix)
+	}
+
+	return blobs, nil
+}
+
+func (b filesystemBackend) Delete(key string) error {
+	return os.Remove(b.path(key))
+}
+
+func (b filesystemBackend) path(key string) string {
+	return filepath.Join(b.root, filepath.FromSlash(key))
+}
+
+// syncDir makes a rename within dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "could not open dir '%s'", dir)
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if err != nil {
+		return errors.Wrapf(err, "could not sync dir '%s'", dir)
+	}
+
+	return nil
+}
@@ -0,0 +1,262 @@
+package imagestore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// KeySize is the size of AES-256 keys used for blob encryption
+	KeySize = 32
+
+	encryptedMagic = "ACC2ENC1"
+	keyIDSize      = 8
+)
+
+var (
+	ErrWrongKey = errors.New("blob encrypted with a different key")
+	// ErrNotEncrypted is returned for blobs stored before encryption was
+	// enabled, RotateKey encrypts them
+	ErrNotEncrypted = errors.New("blob is not encrypted")
+	errNotBlob      = errors.New("not an encrypted blob")
+)
+
+// ParseKey parses an encryption key given as raw bytes, hex or base64.
+func ParseKey(b []byte) ([]byte, error) {
+	if len(b) == KeySize {
+		return b, nil
+	}
+
+	s := strings.TrimSpace(string(b))
+	if key, err := hex.DecodeString(s); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+
+	return nil, errors.Errorf("key must be %d bytes, raw, hex or base64 encoded", KeySize)
+}
+
+type encryptedBackend struct {
+	Backend
+	aead  cipher.AEAD
+	keyID []byte
+	// allowPlain reads blobs stored before encryption was enabled as they
+	// are
+	allowPlain bool
+}
+
+// NewEncryptedBackend returns a Backend encrypting blobs stored in b with
+// AES-GCM under key. Blobs stored before encryption was enabled fail with
+// ErrNotEncrypted until they are rewritten by RotateKey.
+func NewEncryptedBackend(b Backend, key []byte) (Backend, error) {
+	return newEncryptedBackend(b, key, false)
+}
+
+// NewMigratingBackend is NewEncryptedBackend reading blobs stored before
+// encryption was enabled as they are, to keep serving them while RotateKey
+// has not encrypted them yet.
+func NewMigratingBackend(b Backend, key []byte) (Backend, error) {
+	return newEncryptedBackend(b, key, true)
+}
+
+func newEncryptedBackend(b Backend, key []byte, allowPlain bool) (Backend, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return encryptedBackend{
+		Backend:    b,
+		aead:       aead,
+		keyID:      keyID(key),
+		allowPlain: allowPlain,
+	}, nil
+}
+
+func (b encryptedBackend) Put(key string, r io.Reader) error {
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "could not read blob")
+	}
+
+	sealed, err := seal(b.aead, b.keyID, key, plaintext)
+	if err != nil {
+		return err
+	}
+
+	return b.Backend.Put(key, bytes.NewReader(sealed))
+}
+
+func (b encryptedBackend) Get(key string) (io.ReadCloser, BlobInfo, error) {
+	r, info, err := b.Backend.Get(key)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	defer r.Close()
+
+	blob, err := io.ReadAll(r)
+	if err != nil {
+		return nil, BlobInfo{}, errors.Wrapf(err, "could not read '%s'", key)
+	}
+
+	plaintext, err := open(b.aead, b.keyID, key, blob)
+	if errors.Is(err, errNotBlob) {
+		if !b.allowPlain {
+			return nil, BlobInfo{}, errors.Wrapf(ErrNotEncrypted, "could not decrypt '%s'", key)
+		}
+		plaintext, err = blob, nil
+	}
+	if err != nil {
+		return nil, BlobInfo{}, errors.Wrapf(err, "could not decrypt '%s'", key)
+	}
+	info.Size = int64(len(plaintext))
+
+	return nopCloser{bytes.NewReader(plaintext)}, info, nil
+}
+
+// RotateKey rewrites all photo blobs of b encrypted under oldKey (or not
+// encrypted at all) under newKey. Either key may be nil, meaning plain
+// blobs, so it also enables and disables encryption of existing blobs.
+func RotateKey(b Backend, oldKey, newKey []byte, logger *slog.Logger) (int, error) {
+	var oldCipher, newCipher cipher.AEAD
+	var oldID, newID []byte
+	var err error
+	if oldKey != nil {
+		oldCipher, err = newAEAD(oldKey)
+		if err != nil {
+			return 0, errors.Wrap(err, "invalid old key")
+		}
+		oldID = keyID(oldKey)
+	}
+	if newKey != nil {
+		newCipher, err = newAEAD(newKey)
+		if err != nil {
+			return 0, errors.Wrap(err, "invalid new key")
+		}
+		newID = keyID(newKey)
+	}
+
+	var blobs []BlobInfo
+	for _, prefix := range []string{photosPrefix, quarantinePrefix} {
+		listed, err := b.List(prefix)
+		if err != nil {
+			return 0, errors.Wrapf(err, "could not list '%s'", prefix)
+		}
+		blobs = append(blobs, listed...)
+	}
+
+	rotated := 0
+	for _, info := range blobs {
+		r, _, err := b.Get(info.Key)
+		if err != nil {
+			return rotated, errors.Wrapf(err, "could not get '%s'", info.Key)
+		}
+		blob, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return rotated, errors.Wrapf(err, "could not read '%s'", info.Key)
+		}
+
+		encrypted := bytes.HasPrefix(blob, []byte(encryptedMagic)) && len(blob) >= len(encryptedMagic)+keyIDSize
+		// already rotated, e.g. by a previous interrupted run
+		if (newID == nil && !encrypted) || (newID != nil && encrypted && bytes.Equal(blobKeyID(blob), newID)) {
+			continue
+		}
+
+		plaintext := blob
+		if encrypted {
+			if oldCipher == nil {
+				return rotated, errors.Wrapf(ErrWrongKey, "'%s' is encrypted but no old key given", info.Key)
+			}
+			plaintext, err = open(oldCipher, oldID, info.Key, blob)
+			if err != nil {
+				return rotated, errors.Wrapf(err, "could not decrypt '%s'", info.Key)
+			}
+		}
+
+		rewritten := plaintext
+		if newCipher != nil {
+			rewritten, err = seal(newCipher, newID, info.Key, plaintext)
+			if err != nil {
+				return rotated, err
+			}
+		}
+
+		err = b.Put(info.Key, bytes.NewReader(rewritten))
+		if err != nil {
+			return rotated, errors.Wrapf(err, "could not put '%s'", info.Key)
+		}
+		logger.Info("rotated blob key", slog.String("key", info.Key))
+		rotated++
+	}
+
+	return rotated, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, errors.Errorf("key must be %d bytes", KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyID identifies a key without revealing it, so blobs encrypted under
+// another key are reported as such instead of failing authentication.
+func keyID(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:keyIDSize]
+}
+
+// seal encrypts plaintext into magic | key id | nonce | ciphertext,
+// authenticating the blob key so blobs cannot be swapped.
+func seal(aead cipher.AEAD, keyID []byte, key string, plaintext []byte) ([]byte, error) {
+	header := []byte(encryptedMagic)
+	header = append(header[:len(header):len(header)], keyID...)
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not generate nonce")
+	}
+
+	out := append(header[:len(header):len(header)], nonce...)
+	return aead.Seal(out, nonce, plaintext, append(header[:len(header):len(header)], key...)), nil
+}
+
+func open(aead cipher.AEAD, keyID []byte, key string, blob []byte) ([]byte, error) {
+	headerSize := len(encryptedMagic) + keyIDSize
+	if !bytes.HasPrefix(blob, []byte(encryptedMagic)) || len(blob) < headerSize+aead.NonceSize() {
+		return nil, errNotBlob
+	}
+	if !bytes.Equal(blobKeyID(blob), keyID) {
+		return nil, ErrWrongKey
+	}
+
+	header := blob[:headerSize]
+	nonce := blob[headerSize : headerSize+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, blob[headerSize+aead.NonceSize():], append(header[:headerSize:headerSize], key...))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not authenticate blob")
+	}
+
+	return plaintext, nil
+}
+
+func blobKeyID(blob []byte) []byte {
+	return blob[len(encryptedMagic) : len(encryptedMagic)+keyIDSize]
+}
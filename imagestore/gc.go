@@ -0,0 +1,162 @@
+package imagestore
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const quarantinePrefix = "quarantine/"
+
+type GCConfig struct {
+	// ExpenseIDs lists ids of all existing expenses
+	ExpenseIDs func() ([]string, error)
+	// photos younger than MinAge are never quarantined, so a photo saved
+	// right before its expense is inserted is not taken for an orphan
+	MinAge time.Duration
+	// GracePeriod is how long orphaned photos are kept in quarantine
+	// before being deleted
+	GracePeriod time.Duration
+	Logger      *slog.Logger
+}
+
+// GC finds photos not referenced by any expense, moves them to the
+// quarantine area and deletes them after the grace period.
+type GC struct {
+	backend Backend
+	cfg     GCConfig
+}
+
+func NewGC(b Backend, cfg GCConfig) GC {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	return GC{
+		backend: b,
+		cfg:     cfg,
+	}
+}
+
+// Run collects garbage every interval until ctx is done.
+func (gc GC) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			gc.cfg.Logger.Info("stopping photos garbage collector")
+			return
+		case <-ticker.C:
+			err := gc.Collect()
+			if err != nil {
+				gc.cfg.Logger.Error("could not collect photos garbage", "error", err)
+			}
+		}
+	}
+}
+
+// Collect performs a single garbage collection pass.
+func (gc GC) Collect() error {
+	ids, err := gc.cfg.ExpenseIDs()
+	if err != nil {
+		return errors.Wrap(err, "could not list expense ids")
+	}
+	referenced := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		referenced[id] = struct{}{}
+	}
+	now := time.Now()
+
+	photos, err := gc.backend.List(photosPrefix)
+	if err != nil {
+		return errors.Wrap(err, "could not list photos")
+	}
+	// photos are quarantined together with their checksums, so all blobs
+	// of an expense are handled at once
+	orphans := map[string][]BlobInfo{}
+	for _, p := range photos {
+		id := expenseIDFromName(strings.TrimPrefix(p.Key, photosPrefix))
+		if _, ok := referenced[id]; !ok {
+			orphans[id] = append(orphans[id], p)
+		}
+	}
+	quarantined := 0
+	for _, blobs := range orphans {
+		if slices.ContainsFunc(blobs, func(b BlobInfo) bool { return now.Sub(b.ModTime) < gc.cfg.MinAge }) {
+			continue
+		}
+		for _, p := range blobs {
+			err := gc.move(p.Key, quarantinePrefix+strings.TrimPrefix(p.Key, photosPrefix))
+			if err != nil {
+				return errors.Wrapf(err, "could not quarantine '%s'", p.Key)
+			}
+			gc.cfg.Logger.Info("quarantined orphaned photo", slog.String("key", p.Key))
+			quarantined++
+		}
+	}
+
+	inQuarantine, err := gc.backend.List(quarantinePrefix)
+	if err != nil {
+		return errors.Wrap(err, "could not list quarantined photos")
+	}
+	restored, removed := 0, 0
+	for _, p := range inQuarantine {
+		name := strings.TrimPrefix(p.Key, quarantinePrefix)
+		if _, ok := referenced[expenseIDFromName(name)]; ok {
+			err := gc.move(p.Key, photosPrefix+name)
+			if err != nil {
+				return errors.Wrapf(err, "could not restore '%s'", p.Key)
+			}
+			gc.cfg.Logger.Info("restored referenced photo from quarantine", slog.String("key", p.Key))
+			restored++
+			continue
+		}
+		if now.Sub(p.ModTime) < gc.cfg.GracePeriod {
+			continue
+		}
+		err := gc.backend.Delete(p.Key)
+		if err != nil {
+			return errors.Wrapf(err, "could not delete '%s'", p.Key)
+		}
+		gc.cfg.Logger.Info("removed orphaned photo", slog.String("key", p.Key), slog.Time("orphaned_at", p.ModTime))
+		removed++
+	}
+
+	gc.cfg.Logger.Info("photos garbage collected",
+		slog.Int("quarantined", quarantined),
+		slog.Int("restored", restored),
+		slog.Int("removed", removed),
+	)
+	return nil
+}
+
+func (gc GC) move(from, to string) error {
+	r, _, err := gc.backend.Get(from)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	err = gc.backend.Put(to, r)
+	if err != nil {
+		return err
+	}
+
+	return gc.backend.Delete(from)
+}
+
+// expenseIDFromName extracts the expense id from a photo filename
+// as created by providePhotoPath.
+func expenseIDFromName(name string) string {
+	const idOffset = len(filenameTimeLayout) + 1
+	const idLength = 36
+	if len(name) < idOffset+idLength {
+		return ""
+	}
+	return name[idOffset : idOffset+idLength]
+}
@@ -0,0 +1,122 @@
+package imagestore
+
+import (
+	"io"
+
+	"github.com/matmazurk/acc2/s3"
+	"github.com/pkg/errors"
+)
+
+type s3Backend struct {
+	client *s3.Client
+}
+
+// NewS3Backend returns a Backend keeping blobs as objects of an
+// S3-compatible bucket.
+func NewS3Backend(cfg s3.Config) (Backend, error) {
+	client, err := s3.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return s3Backend{client: client}, nil
+}
+
+func (b s3Backend) Put(key string, r io.Reader) error {
+	return b.client.PutObject(key, r)
+}
+
+// Get streams the object of key. The size and modification time come from
+// a HEAD request, the object itself is requested on the first read, from
+// the offset it was seeked to.
+func (b s3Backend) Get(key string) (io.ReadCloser, BlobInfo, error) {
+	info, err := b.client.HeadObject(key)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	blob := BlobInfo{Key: key, Size: info.Size, ModTime: info.LastModified}
+	if info.Size < 0 {
+		r, _, err := b.client.GetObject(key)
+		if err != nil {
+			return nil, BlobInfo{}, err
+		}
+		return r, blob, nil
+	}
+
+	return &objectReader{client: b.client, key: key, size: info.Size}, blob, nil
+}
+
+func (b s3Backend) List(prefix string) ([]BlobInfo, error) {
+	objects, err := b.client.ListObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := make([]BlobInfo, len(objects))
+	for i, o := range objects {
+		blobs[i] = BlobInfo{Key: o.Key, Size: o.Size, ModTime: o.LastModified}
+	}
+
+	return blobs, nil
+}
+
+func (b s3Backend) Delete(key string) error {
+	return b.client.DeleteObject(key)
+}
+
+// objectReader reads an object of known size from the body of a GET
+// request, opened on the first read and again on the first read after
+// seeking away from the current offset.
+type objectReader struct {
+	client *s3.Client
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.client.GetObjectRange(r.key, r.offset)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	case io.SeekStart:
+	default:
+		return 0, errors.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *objectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
@@ -1,9 +1,15 @@
 package imagestore
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"mime"
 	"os"
+	"path"
+	"slices"
 	"strings"
 
 	"github.com/matmazurk/acc2/model"
@@ -12,79 +18,210 @@ import (
 )
 
 type store struct {
-	basepath string
-	logger   zerolog.Logger
+	backend Backend
+	logger  zerolog.Logger
 }
 
+// NewStore returns a store keeping photos in the local basepath directory.
 func NewStore(basepath string) (store, error) {
 	err := os.MkdirAll(basepath+photosRelativeDir, 0o750)
 	if err != nil && !os.IsExist(err) {
 		return store{}, errors.Wrap(err, "could not create photos dir")
 	}
+	b, err := NewFilesystemBackend(basepath)
+	if err != nil {
+		return store{}, err
+	}
+	return New(b), nil
+}
+
+// New returns a store keeping photos in the given backend.
+func New(b Backend) store {
 	return store{
-		basepath: basepath,
-	}, nil
+		backend: b,
+	}
 }
 
+// PhotosDir is the directory of the store photos are kept in.
+const PhotosDir = "photos"
+
 const (
-	photosRelativeDir  = "/photos"
+	photosRelativeDir  = "/" + PhotosDir
+	photosPrefix       = PhotosDir + "/"
 	filenameTimeLayout = "020106_1504"
+	// checksums of photos are kept next to them, under the photo key
+	// with checksumExtension appended
+	checksumExtension = ".sha256"
 )
 
+// ErrCorrupted is returned by LoadExpensePhoto and VerifyExpensePhoto for
+// photos that do not match the checksum recorded when they were saved.
+var ErrCorrupted = model.ErrPhotoCorrupted
+
 func (s store) SaveExpensePhoto(e model.Expense, fileExtension string, r io.ReadCloser) error {
 	defer r.Close()
 
-	photoPath := s.providePhotoAbsolutePath(e, fileExtension)
-	file, err := os.Create(photoPath)
+	key := photosPrefix + s.providePhotoPath(e, fileExtension)
+	hash := sha256.New()
+	err := s.backend.Put(key, io.TeeReader(r, hash))
 	if err != nil {
-		return errors.Wrapf(err, "could not create file '%s'", photoPath)
+		return err
 	}
-	defer file.Close()
 
-	_, err = io.Copy(file, r)
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	// reading the photo back reports one broken on its way to the backend
+	// right away, loading it later does not check it again
+	err = s.verifyBlob(key, checksum)
+	if err != nil {
+		return err
+	}
+	err = s.backend.Put(key+checksumExtension, strings.NewReader(checksum))
 	if err != nil {
-		return errors.Wrap(err, "could not copy file contents")
+		return errors.Wrap(err, "could not save checksum")
 	}
 
 	return nil
 }
 
-func (s store) LoadExpensePhoto(e model.Expense) (io.ReadCloser, error) {
-	fileWithoutExtension := s.providePhotoPath(e, "")
+// LoadExpensePhoto loads the photo of e, checking it against its checksum
+// first. A corrupted photo fails with ErrCorrupted before anything of it
+// is served.
+func (s store) LoadExpensePhoto(e model.Expense) (model.Photo, error) {
+	key, err := s.photoKey(e)
+	if err != nil {
+		return model.Photo{}, err
+	}
+	checksum, err := s.loadChecksum(key)
+	if err != nil {
+		return model.Photo{}, err
+	}
+	if checksum != "" {
+		err = s.verifyBlob(key, checksum)
+		if err != nil {
+			return model.Photo{}, err
+		}
+	}
 
-	files, err := os.ReadDir(s.dirAbsolutePath())
+	r, info, err := s.backend.Get(key)
 	if err != nil {
-		return nil, err
+		return model.Photo{}, err
 	}
 
-	photoFilepath := ""
-	for _, f := range files {
-		if strings.Contains(f.Name(), fileWithoutExtension) {
-			photoFilepath = f.Name()
-			break
+	// backends stream seekable blobs, only blobs of unknown size are read
+	// into memory
+	rsc, ok := r.(io.ReadSeekCloser)
+	if !ok {
+		defer r.Close()
+		contents, err := io.ReadAll(r)
+		if err != nil {
+			return model.Photo{}, errors.Wrapf(err, "could not read '%s'", key)
 		}
+		rsc = nopCloser{bytes.NewReader(contents)}
 	}
 
-	if photoFilepath == "" {
-		return nil, os.ErrNotExist
+	etag := fmt.Sprintf(`"%x-%x"`, info.ModTime.UnixNano(), info.Size)
+	if checksum != "" {
+		etag = `"` + checksum + `"`
 	}
 
-	f, err := os.Open(s.dirAbsolutePath() + "/" + photoFilepath)
+	return model.Photo{
+		ReadSeekCloser: rsc,
+		ContentType:    mime.TypeByExtension(path.Ext(key)),
+		ModTime:        info.ModTime,
+		ETag:           etag,
+	}, nil
+}
+
+// VerifyExpensePhoto checks the photo of e against the checksum recorded
+// when it was saved and returns ErrCorrupted when they differ. Photos saved
+// before checksums were recorded can not be checked and pass.
+func (s store) VerifyExpensePhoto(e model.Expense) error {
+	key, err := s.photoKey(e)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	checksum, err := s.loadChecksum(key)
+	if err != nil || checksum == "" {
+		return err
 	}
 
-	return f, nil
+	return s.verifyBlob(key, checksum)
 }
 
-func (s store) dirAbsolutePath() string {
-	return s.basepath + photosRelativeDir
+// photoKey returns the key of the photo of e, whatever its extension.
+func (s store) photoKey(e model.Expense) (string, error) {
+	blobs, err := s.backend.List(photosPrefix + s.providePhotoPath(e, ""))
+	if err != nil {
+		return "", err
+	}
+	idx := slices.IndexFunc(blobs, func(b BlobInfo) bool { return !strings.HasSuffix(b.Key, checksumExtension) })
+	if idx == -1 {
+		return "", os.ErrNotExist
+	}
+
+	return blobs[idx].Key, nil
 }
 
-func (s store) providePhotoAbsolutePath(e model.Expense, fileExtension string) string {
-	return fmt.Sprintf("%s/%s", s.dirAbsolutePath(), s.providePhotoPath(e, fileExtension))
+func (s store) loadChecksum(key string) (string, error) {
+	r, _, err := s.backend.Get(key + checksumExtension)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", errors.Wrap(err, "could not load checksum")
+	}
+	defer r.Close()
+
+	checksum, err := io.ReadAll(io.LimitReader(r, 1024))
+	if err != nil {
+		return "", errors.Wrap(err, "could not read checksum")
+	}
+
+	return strings.TrimSpace(string(checksum)), nil
+}
+
+// verifyBlob hashes the blob of key and compares it with checksum.
+func (s store) verifyBlob(key, checksum string) error {
+	r, _, err := s.backend.Get(key)
+	if err != nil {
+		return errors.Wrapf(err, "could not read '%s'", key)
+	}
+	defer r.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, r)
+	if err != nil {
+		return errors.Wrapf(err, "could not read '%s'", key)
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != checksum {
+		return errors.Wrapf(ErrCorrupted, "'%s'", key)
+	}
+
+	return nil
+}
+
+func (s store) RemoveExpensePhoto(e model.Expense) error {
+	blobs, err := s.backend.List(photosPrefix + s.providePhotoPath(e, ""))
+	if err != nil {
+		return err
+	}
+
+	for _, b := range blobs {
+		err := s.backend.Delete(b.Key)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return errors.Wrapf(err, "could not delete '%s'", b.Key)
+		}
+	}
+
+	return nil
 }
 
 func (s store) providePhotoPath(e model.Expense, fileExtension string) string {
 	return fmt.Sprintf("%s_%s%s", e.CreatedAt().Format(filenameTimeLayout), e.ID(), fileExtension)
 }
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
@@ -4,12 +4,15 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"testing"
 	"time"
 
 	"github.com/matmazurk/acc2/imagestore"
 	"github.com/matmazurk/acc2/model"
+	"github.com/matmazurk/acc2/s3"
+	"github.com/matmazurk/acc2/s3/s3test"
 	"github.com/stretchr/testify/require"
 )
 
@@ -73,3 +76,341 @@ func TestSaveExpensePhoto(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, fileContents, actualContents)
 }
+
+func TestLoadExpensePhoto(t *testing.T) {
+	filepath := fmt.Sprintf("./%s%d", "__tmpdir_", time.Now().UnixMilli())
+	store, err := imagestore.NewStore(filepath)
+	require.NoError(t, err)
+	defer os.RemoveAll(filepath)
+
+	someExp, err := model.ExpenseBuilder{
+		Description: "some expense",
+		Payer:       "some payer",
+		Category:    "groceries",
+		Amount:      "22.22",
+		Currency:    "USD",
+		CreatedAt:   time.Now(),
+	}.Build()
+	require.NoError(t, err)
+
+	t.Run("should_return_not_exist_when_no_photo", func(t *testing.T) {
+		_, err := store.LoadExpensePhoto(someExp)
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("should_load_photo_with_metadata", func(t *testing.T) {
+		fileContents := []byte("some contents")
+		err := store.SaveExpensePhoto(someExp, ".png", io.NopCloser(bytes.NewReader(fileContents)))
+		require.NoError(t, err)
+
+		photo, err := store.LoadExpensePhoto(someExp)
+		require.NoError(t, err)
+		defer photo.Close()
+
+		require.Equal(t, "image/png", photo.ContentType)
+		require.NotEmpty(t, photo.ETag)
+		require.False(t, photo.ModTime.IsZero())
+		actualContents, err := io.ReadAll(photo)
+		require.NoError(t, err)
+		require.Equal(t, fileContents, actualContents)
+	})
+}
+
+func TestPhotoIntegrity(t *testing.T) {
+	dir := t.TempDir()
+	store, err := imagestore.NewStore(dir)
+	require.NoError(t, err)
+
+	someExp, err := model.ExpenseBuilder{
+		Id:          "57f8ea23-4387-491b-bbb0-7195a0e15127",
+		Description: "some expense",
+		Payer:       "some payer",
+		Category:    "groceries",
+		Amount:      "22.22",
+		Currency:    "USD",
+		CreatedAt:   time.Date(2024, time.April, 10, 13, 40, 0, 0, time.UTC),
+	}.Build()
+	require.NoError(t, err)
+	photoPath := dir + "/photos/100424_1340_57f8ea23-4387-491b-bbb0-7195a0e15127.jpeg"
+
+	t.Run("should_remove_leftover_temp_files_on_open", func(t *testing.T) {
+		leftover := dir + "/photos/.tmp-100424_1340_57f8ea23-4387-491b-bbb0-7195a0e15127.jpeg-123"
+		require.NoError(t, os.WriteFile(leftover, []byte("truncat"), 0o600))
+
+		// temp files of others in the store dir are not ours to remove
+		unrelated := dir + "/.tmp-unrelated"
+		require.NoError(t, os.WriteFile(unrelated, []byte("other"), 0o600))
+
+		_, err := imagestore.NewStore(dir)
+		require.NoError(t, err)
+		require.NoFileExists(t, leftover)
+		require.FileExists(t, unrelated)
+		require.NoError(t, os.Remove(unrelated))
+	})
+
+	t.Run("should_record_checksum_and_use_it_as_etag", func(t *testing.T) {
+		err := store.SaveExpensePhoto(someExp, ".jpeg", io.NopCloser(bytes.NewReader([]byte("some contents"))))
+		require.NoError(t, err)
+		entries, err := os.ReadDir(dir + "/photos")
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+
+		photo, err := store.LoadExpensePhoto(someExp)
+		require.NoError(t, err)
+		defer photo.Close()
+		require.Equal(t, `"b9e6fc6474139fd230ff8a7a9699484c015cb585e1537efad21ae5edf7f79832"`, photo.ETag)
+		actualContents, err := io.ReadAll(photo)
+		require.NoError(t, err)
+		require.Equal(t, []byte("some contents"), actualContents)
+	})
+
+	t.Run("should_detect_corrupted_photo", func(t *testing.T) {
+		require.NoError(t, store.VerifyExpensePhoto(someExp))
+		require.NoError(t, os.WriteFile(photoPath, []byte("some cont"), 0o600))
+
+		err := store.VerifyExpensePhoto(someExp)
+		require.ErrorIs(t, err, imagestore.ErrCorrupted)
+		_, err = store.LoadExpensePhoto(someExp)
+		require.ErrorIs(t, err, imagestore.ErrCorrupted)
+	})
+}
+
+func TestS3Backend(t *testing.T) {
+	srv := s3test.NewServer("photos-bucket")
+	t.Cleanup(srv.Close)
+
+	backend, err := imagestore.NewS3Backend(s3.Config{
+		Endpoint:  srv.URL,
+		Bucket:    "photos-bucket",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	require.NoError(t, err)
+	store := imagestore.New(backend)
+
+	someDate := time.Date(2024, time.April, 10, 13, 40, 0, 0, time.UTC)
+	someExp, err := model.ExpenseBuilder{
+		Id:          "57f8ea23-4387-491b-bbb0-7195a0e15127",
+		Description: "some expense",
+		Payer:       "some payer",
+		Category:    "groceries",
+		Amount:      "22.22",
+		Currency:    "USD",
+		CreatedAt:   someDate,
+	}.Build()
+	require.NoError(t, err)
+
+	fileContents := []byte("some contents")
+	err = store.SaveExpensePhoto(someExp, ".jpeg", io.NopCloser(bytes.NewReader(fileContents)))
+	require.NoError(t, err)
+
+	o, ok := srv.Object("photos/100424_1340_57f8ea23-4387-491b-bbb0-7195a0e15127.jpeg")
+	require.True(t, ok)
+	require.Equal(t, fileContents, o.Data)
+
+	photo, err := store.LoadExpensePhoto(someExp)
+	require.NoError(t, err)
+	defer photo.Close()
+	require.Equal(t, "image/jpeg", photo.ContentType)
+	head := make([]byte, 4)
+	_, err = io.ReadFull(photo, head)
+	require.NoError(t, err)
+	require.Equal(t, fileContents[:4], head)
+	_, err = photo.Seek(5, io.SeekStart)
+	require.NoError(t, err)
+	actualContents, err := io.ReadAll(photo)
+	require.NoError(t, err)
+	require.Equal(t, fileContents[5:], actualContents)
+
+	// serving photos seeks to the end for their size first
+	size, err := photo.Seek(0, io.SeekEnd)
+	require.NoError(t, err)
+	require.EqualValues(t, len(fileContents), size)
+	_, err = photo.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	actualContents, err = io.ReadAll(photo)
+	require.NoError(t, err)
+	require.Equal(t, fileContents, actualContents)
+
+	// the object is requested once it is read, seeking it for its size
+	// only takes the size of the HEAD request
+	gets := srv.Gets()
+	blob, info, err := backend.Get("photos/100424_1340_57f8ea23-4387-491b-bbb0-7195a0e15127.jpeg")
+	require.NoError(t, err)
+	defer blob.Close()
+	require.EqualValues(t, len(fileContents), info.Size)
+	seeker := blob.(io.Seeker)
+	_, err = seeker.Seek(0, io.SeekEnd)
+	require.NoError(t, err)
+	_, err = seeker.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	require.Equal(t, gets, srv.Gets())
+	actualContents, err = io.ReadAll(blob)
+	require.NoError(t, err)
+	require.Equal(t, fileContents, actualContents)
+	require.Equal(t, gets+1, srv.Gets())
+}
+
+func TestGC(t *testing.T) {
+	dir := t.TempDir()
+	store, err := imagestore.NewStore(dir)
+	require.NoError(t, err)
+
+	newExpense := func() model.Expense {
+		exp, err := model.ExpenseBuilder{
+			Description: "some expense",
+			Payer:       "some payer",
+			Category:    "groceries",
+			Amount:      "22.22",
+			Currency:    "USD",
+			CreatedAt:   time.Date(2024, time.April, 10, 13, 40, 0, 0, time.UTC),
+		}.Build()
+		require.NoError(t, err)
+		err = store.SaveExpensePhoto(exp, ".jpeg", io.NopCloser(bytes.NewReader([]byte("contents"))))
+		require.NoError(t, err)
+		return exp
+	}
+	kept, orphaned, fresh := newExpense(), newExpense(), newExpense()
+	photoPath := func(e model.Expense) string {
+		return dir + "/photos/100424_1340_" + e.ID() + ".jpeg"
+	}
+	quarantinePath := func(e model.Expense) string {
+		return dir + "/quarantine/100424_1340_" + e.ID() + ".jpeg"
+	}
+	dayAgo := time.Now().Add(-24 * time.Hour)
+	for _, e := range []model.Expense{kept, orphaned} {
+		require.NoError(t, os.Chtimes(photoPath(e), dayAgo, dayAgo))
+		require.NoError(t, os.Chtimes(photoPath(e)+".sha256", dayAgo, dayAgo))
+	}
+
+	backend, err := imagestore.NewFilesystemBackend(dir)
+	require.NoError(t, err)
+	gc := imagestore.NewGC(backend, imagestore.GCConfig{
+		ExpenseIDs:  func() ([]string, error) { return []string{kept.ID()}, nil },
+		MinAge:      time.Hour,
+		GracePeriod: 7 * 24 * time.Hour,
+	})
+
+	t.Run("should_quarantine_old_orphans_only", func(t *testing.T) {
+		require.NoError(t, gc.Collect())
+
+		require.FileExists(t, photoPath(kept))
+		require.FileExists(t, photoPath(fresh))
+		require.NoFileExists(t, photoPath(orphaned))
+		require.FileExists(t, quarantinePath(orphaned))
+		require.FileExists(t, quarantinePath(orphaned)+".sha256")
+
+		_, err := store.LoadExpensePhoto(orphaned)
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("should_keep_quarantined_photos_during_grace_period", func(t *testing.T) {
+		require.NoError(t, gc.Collect())
+		require.FileExists(t, quarantinePath(orphaned))
+	})
+
+	t.Run("should_remove_quarantined_photos_after_grace_period", func(t *testing.T) {
+		longAgo := time.Now().Add(-8 * 24 * time.Hour)
+		require.NoError(t, os.Chtimes(quarantinePath(orphaned), longAgo, longAgo))
+		require.NoError(t, os.Chtimes(quarantinePath(orphaned)+".sha256", longAgo, longAgo))
+
+		require.NoError(t, gc.Collect())
+		require.NoFileExists(t, quarantinePath(orphaned))
+		require.NoFileExists(t, quarantinePath(orphaned)+".sha256")
+		require.FileExists(t, photoPath(kept))
+	})
+
+	t.Run("should_remove_expense_photo", func(t *testing.T) {
+		require.NoError(t, store.RemoveExpensePhoto(kept))
+		require.NoFileExists(t, photoPath(kept))
+	})
+}
+
+func TestEncryptedBackend(t *testing.T) {
+	dir := t.TempDir()
+	raw, err := imagestore.NewFilesystemBackend(dir)
+	require.NoError(t, err)
+	key := bytes.Repeat([]byte{1}, imagestore.KeySize)
+	encrypted, err := imagestore.NewEncryptedBackend(raw, key)
+	require.NoError(t, err)
+	store := imagestore.New(encrypted)
+
+	someExp, err := model.ExpenseBuilder{
+		Id:          "57f8ea23-4387-491b-bbb0-7195a0e15127",
+		Description: "some expense",
+		Payer:       "some payer",
+		Category:    "groceries",
+		Amount:      "22.22",
+		Currency:    "USD",
+		CreatedAt:   time.Date(2024, time.April, 10, 13, 40, 0, 0, time.UTC),
+	}.Build()
+	require.NoError(t, err)
+	photoPath := dir + "/photos/100424_1340_57f8ea23-4387-491b-bbb0-7195a0e15127.jpeg"
+	fileContents := []byte("card 1234 some street 5")
+
+	loadContents := func(t *testing.T, s interface {
+		LoadExpensePhoto(model.Expense) (model.Photo, error)
+	}) []byte {
+		t.Helper()
+		photo, err := s.LoadExpensePhoto(someExp)
+		require.NoError(t, err)
+		defer photo.Close()
+		contents, err := io.ReadAll(photo)
+		require.NoError(t, err)
+		return contents
+	}
+
+	t.Run("should_read_photos_stored_before_encryption_only_when_migrating", func(t *testing.T) {
+		plain := imagestore.New(raw)
+		err := plain.SaveExpensePhoto(someExp, ".jpeg", io.NopCloser(bytes.NewReader(fileContents)))
+		require.NoError(t, err)
+
+		_, err = store.LoadExpensePhoto(someExp)
+		require.ErrorIs(t, err, imagestore.ErrNotEncrypted)
+		migrating, err := imagestore.NewMigratingBackend(raw, key)
+		require.NoError(t, err)
+		require.Equal(t, fileContents, loadContents(t, imagestore.New(migrating)))
+	})
+
+	t.Run("should_encrypt_transparently", func(t *testing.T) {
+		err := store.SaveExpensePhoto(someExp, ".jpeg", io.NopCloser(bytes.NewReader(fileContents)))
+		require.NoError(t, err)
+
+		onDisk, err := os.ReadFile(photoPath)
+		require.NoError(t, err)
+		require.NotContains(t, string(onDisk), string(fileContents))
+		require.Equal(t, fileContents, loadContents(t, store))
+	})
+
+	t.Run("should_fail_with_wrong_key", func(t *testing.T) {
+		other, err := imagestore.NewEncryptedBackend(raw, bytes.Repeat([]byte{2}, imagestore.KeySize))
+		require.NoError(t, err)
+
+		_, err = imagestore.New(other).LoadExpensePhoto(someExp)
+		require.ErrorIs(t, err, imagestore.ErrWrongKey)
+	})
+
+	t.Run("should_rotate_key", func(t *testing.T) {
+		newKey := bytes.Repeat([]byte{3}, imagestore.KeySize)
+		rotated, err := imagestore.RotateKey(raw, key, newKey, slog.Default())
+		require.NoError(t, err)
+		require.Equal(t, 2, rotated)
+
+		_, err = store.LoadExpensePhoto(someExp)
+		require.ErrorIs(t, err, imagestore.ErrWrongKey)
+		rotatedBackend, err := imagestore.NewEncryptedBackend(raw, newKey)
+		require.NoError(t, err)
+		require.Equal(t, fileContents, loadContents(t, imagestore.New(rotatedBackend)))
+
+		rotated, err = imagestore.RotateKey(raw, key, newKey, slog.Default())
+		require.NoError(t, err)
+		require.Zero(t, rotated)
+
+		rotated, err = imagestore.RotateKey(raw, newKey, nil, slog.Default())
+		require.NoError(t, err)
+		require.Equal(t, 2, rotated)
+		onDisk, err := os.ReadFile(photoPath)
+		require.NoError(t, err)
+		require.Equal(t, fileContents, onDisk)
+	})
+}
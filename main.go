@@ -1,61 +1,270 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/matmazurk/acc2/backup"
-	"github.com/matmazurk/acc2/db"
+	dbpkg "github.com/matmazurk/acc2/db"
 	lhttp "github.com/matmazurk/acc2/http"
+	"github.com/matmazurk/acc2/http/handler"
 	"github.com/matmazurk/acc2/imagestore"
+	"github.com/matmazurk/acc2/s3"
+	"github.com/matmazurk/acc2/tlscert"
+	"github.com/rs/zerolog"
 )
 
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
 	flags := parseFlags()
-	cleanup, err := setup(flags)
+	logs, cleanup, err := setup(flags)
 	if err != nil {
 		slog.Error("could not setup", "error", err)
 		os.Exit(1)
 	}
 	defer cleanup()
 
+	err = flags.validateTLS()
+	if err != nil {
+		slog.Error("invalid tls flags", "error", err)
+		os.Exit(1)
+	}
+	// a reverse proxy may terminate tls in front of the server, so this is
+	// not fatal
+	if !flags.tlsEnabled() && !flags.insecureCookies {
+		slog.Warn("serving plain http with secure session cookies, browsers reaching the server without https can not log in; set -tls-cert, -self-signed or -insecure-cookies")
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	slog.Info("staring...")
 
-	db, err := db.New(flags.dbFilename)
+	db, err := dbpkg.New(flags.dbFilename)
 	if err != nil {
 		slog.Error("could not setup db", "error", err)
 		os.Exit(1)
 	}
 	slog.Info("database opened", "filename", flags.dbFilename)
 
-	store, err := imagestore.NewStore(flags.storeDir)
+	backend, err := openImagestoreBackend(flags)
 	if err != nil {
-		slog.Error("could not open imagestore", slog.String("dir", flags.storeDir), "error", err)
+		slog.Error("could not open imagestore", slog.String("backend", flags.storeBackend), "error", err)
+		os.Exit(1)
 	}
-	slog.Info("imagestore opened", slog.String("dir", flags.storeDir))
+	store := imagestore.New(backend)
+	slog.Info("imagestore opened", slog.String("backend", flags.storeBackend), slog.String("dir", flags.storeDir))
+	if flags.storeBackend == "s3" && flags.backupInterval > 0 {
+		slog.Warn("backups only hold the database, photos kept in s3 are not backed up", slog.String("bucket", flags.s3Bucket))
+	}
+
+	gc := imagestore.NewGC(backend, imagestore.GCConfig{
+		ExpenseIDs:  db.ExpenseIDs,
+		MinAge:      time.Hour,
+		GracePeriod: flags.gcGracePeriod,
+		Logger:      slog.Default(),
+	})
 
+	passphrase, err := loadSecret(flags.backupPassphraseFile, backupPassphraseEnv)
+	if err != nil {
+		slog.Error("could not load backup passphrase", "error", err)
+		os.Exit(1)
+	}
+	users, err := db.ListUsers()
+	if err != nil {
+		slog.Error("could not list users", "error", err)
+		os.Exit(1)
+	}
+	if len(users) == 0 {
+		slog.Warn("no users can log in, create one with 'acc2 user add -admin -ledger default -role owner <name>'")
+	}
+	ledgers, err := db.ListLedgers()
+	if err != nil {
+		slog.Error("could not list ledgers", "error", err)
+		os.Exit(1)
+	}
+	for _, l := range ledgers {
+		payers, err := db.ListPayers(l.ID)
+		if err != nil {
+			slog.Error("could not list payers", "error", err)
+			os.Exit(1)
+		}
+		if len(payers) == 0 {
+			slog.Warn("expenses can not be added to ledger without payers, create one with 'acc2 payer add -ledger <ledger> <name>' or at /admin/payers",
+				slog.String("ledger", l.Name))
+		}
+	}
+	backupSource := backup.Source{
+		Dir:     flags.storeDir,
+		Include: flags.backupInclude,
+		Exclude: flags.backupExclude,
+		DBPath:  flags.dbFilename,
+		DB:      db,
+	}
+	if !flags.backupWalkStore {
+		backupSource.Paths = []string{imagestore.PhotosDir}
+	}
+	err = backupSource.ValidatePatterns()
+	if err != nil {
+		slog.Error("invalid backup rules", "error", err)
+		os.Exit(1)
+	}
+
+	verifier := backup.NewVerifier(backup.VerifierConfig{
+		Dir: flags.backupDir,
+		Options: backup.VerifyOptions{
+			Passphrase:    passphrase,
+			CheckDatabase: dbpkg.CheckFile,
+			LiveExpenses:  db.CountExpenses,
+		},
+		Logger: slog.Default(),
+	})
+
+	handlerOpts := []handler.Option{
+		handler.WithBackups(backup.Catalog{Dir: flags.backupDir, Source: backupSource, Passphrase: passphrase}),
+		handler.WithBackupVerifier(verifier),
+		handler.WithLogger(zerolog.New(logs).With().Timestamp().Logger()),
+		handler.WithRateLimits(flags.rateLimits),
+		handler.WithBodyLimits(flags.bodyLimits),
+	}
+	if flags.insecureCookies {
+		handlerOpts = append(handlerOpts, handler.WithInsecureCookies())
+	}
 	server := &http.Server{
 		Addr:    flags.httpListenAddr,
-		Handler: lhttp.NewMux(db, store),
+		Handler: lhttp.NewMux(db, store, handlerOpts...),
 	}
 
 	wg := sync.WaitGroup{}
+	var redirectServer *http.Server
+	if flags.tlsEnabled() {
+		certFile, keyFile := flags.tlsCert, flags.tlsKey
+		if flags.selfSigned {
+			certFile, keyFile, err = tlscert.SelfSigned(flags.tlsDir, flags.tlsHosts, time.Now())
+			if err != nil {
+				slog.Error("could not issue self-signed certificate", "error", err)
+				os.Exit(1)
+			}
+			slog.Info("serving self-signed certificate, devices have to trust the local CA",
+				slog.String("ca", filepath.Join(flags.tlsDir, tlscert.CAFile)), slog.Any("hosts", flags.tlsHosts))
+		}
+		reloader, err := tlscert.NewReloader(certFile, keyFile, slog.Default())
+		if err != nil {
+			slog.Error("could not load tls certificate", "error", err)
+			os.Exit(1)
+		}
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}
+		if flags.hstsMaxAge > 0 {
+			server.Handler = lhttp.WithHSTS(server.Handler, flags.hstsMaxAge)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			slog.Info("starting tls certificate reloader", slog.String("cert", certFile), slog.Duration("interval", flags.tlsReloadInterval))
+			reloader.Run(ctx, flags.tlsReloadInterval)
+		}()
+
+		if flags.selfSigned {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				renewSelfSigned(ctx, flags)
+			}()
+		}
+
+		if flags.httpRedirectAddr != "" {
+			redirectServer = &http.Server{
+				Addr:    flags.httpRedirectAddr,
+				Handler: lhttp.RedirectToHTTPS(flags.httpListenAddr),
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				slog.Info("starting http to https redirect server", slog.String("listen_addr", flags.httpRedirectAddr))
+				err := redirectServer.ListenAndServe()
+				if err != nil && !errors.Is(err, http.ErrServerClosed) {
+					slog.Error("error redirect server listen", "error", err)
+				}
+			}()
+		}
+	}
+	if flags.backupInterval > 0 {
+		scheduler := backup.NewScheduler(backup.SchedulerConfig{
+			At:           flags.backupAt,
+			Interval:     flags.backupInterval,
+			Dir:          flags.backupDir,
+			Retention:    flags.backupRetention,
+			Source:       backupSource,
+			FullInterval: flags.backupFullInterval,
+			Passphrase:   passphrase,
+			Targets:      flags.backupTargets,
+			Logger:       slog.Default(),
+		})
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			slog.Info("starting backup scheduler", slog.String("dir", flags.backupDir), slog.Duration("interval", flags.backupInterval))
+			scheduler.Run(ctx)
+		}()
+	}
+
+	if flags.backupVerifyInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			slog.Info("starting backup verifier", slog.Duration("interval", flags.backupVerifyInterval))
+			verifier.Run(ctx, flags.backupVerifyInterval)
+		}()
+	}
+
+	if flags.gcInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			slog.Info("starting photos garbage collector", slog.Duration("interval", flags.gcInterval))
+			gc.Run(ctx, flags.gcInterval)
+		}()
+	}
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 
-		slog.Info("starting http server", slog.String("listen_addr", flags.httpListenAddr))
-		err := server.ListenAndServe()
+		slog.Info("starting http server", slog.String("listen_addr", flags.httpListenAddr), slog.Bool("tls", flags.tlsEnabled()))
+		var err error
+		if flags.tlsEnabled() {
+			// the certificate comes from TLSConfig.GetCertificate
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
 		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			slog.Error("error http server listen", "error", err)
 		}
@@ -74,6 +283,13 @@ func main() {
 		slog.Error("error shutting down http server", "error", err)
 		os.Exit(1)
 	}
+	if redirectServer != nil {
+		err = redirectServer.Shutdown(ctx)
+		if err != nil {
+			slog.Error("error shutting down redirect server", "error", err)
+			os.Exit(1)
+		}
+	}
 	cancel()
 
 	slog.Info("http server gracefully shutdown")
@@ -82,10 +298,44 @@ func main() {
 }
 
 type flags struct {
-	printToStdout  bool
-	httpListenAddr string
-	dbFilename     string
-	storeDir       string
+	printToStdout   bool
+	httpListenAddr  string
+	dbFilename      string
+	storeDir        string
+	storeBackend    string
+	s3Endpoint      string
+	s3Region        string
+	s3Bucket        string
+	storeKeyFile    string
+	storeAllowPlain bool
+	gcInterval      time.Duration
+	gcGracePeriod   time.Duration
+
+	backupDir       string
+	backupAt        time.Duration
+	backupInterval  time.Duration
+	backupRetention backup.Retention
+	// zero makes every backup full
+	backupFullInterval   time.Duration
+	backupPassphraseFile string
+	backupTargets        []backup.Target
+	backupVerifyInterval time.Duration
+	backupWalkStore      bool
+	backupInclude        []string
+	backupExclude        []string
+
+	insecureCookies bool
+	rateLimits      handler.RateLimits
+	bodyLimits      handler.BodyLimits
+
+	tlsCert           string
+	tlsKey            string
+	selfSigned        bool
+	tlsDir            string
+	tlsHosts          []string
+	tlsReloadInterval time.Duration
+	httpRedirectAddr  string
+	hstsMaxAge        time.Duration
 }
 
 func parseFlags() flags {
@@ -93,78 +343,306 @@ func parseFlags() flags {
 
 	flag.BoolVar(&f.printToStdout, "s", false, "print output to stdout")
 	flag.StringVar(&f.dbFilename, "db", "exps.db", "expenses database filename")
-	flag.StringVar(&f.httpListenAddr, "httpaddr", ":80", "http server listen address")
-	flag.StringVar(&f.storeDir, "store", ".", "imagestore directory")
+	flag.StringVar(&f.httpListenAddr, "httpaddr", "", "http server listen address, it serves https when a tls certificate is configured (default :80, :443 with tls)")
+	f.registerStoreFlags(flag.CommandLine)
+	flag.DurationVar(&f.gcInterval, "gc-interval", 24*time.Hour, "interval of orphaned photos garbage collection, 0 disables it")
+	flag.DurationVar(&f.gcGracePeriod, "gc-grace", 7*24*time.Hour, "how long orphaned photos are quarantined before removal")
+	flag.BoolVar(&f.insecureCookies, "insecure-cookies", false, "send session cookies over plain http too, for servers reached without TLS")
+	flag.TextVar(&f.rateLimits.IP, "rate-limit-ip", handler.Limit{Requests: 600, Per: time.Minute}, "requests a client address can make, as requests/period, off disables the limit")
+	flag.TextVar(&f.rateLimits.User, "rate-limit-user", handler.Limit{Requests: 300, Per: time.Minute}, "requests a logged in user can make from any address, as requests/period")
+	flag.TextVar(&f.rateLimits.Login, "rate-limit-login", handler.Limit{Requests: 10, Per: 15 * time.Minute}, "login attempts a client address can make, as requests/period")
+	flag.TextVar(&f.rateLimits.Upload, "rate-limit-upload", handler.Limit{Requests: 30, Per: 10 * time.Minute}, "photo uploads a user can make, as requests/period")
+	flag.Int64Var(&f.bodyLimits.Form, "max-form-size", handler.DefaultBodyLimits.Form, "largest html form body accepted, in bytes")
+	flag.Int64Var(&f.bodyLimits.JSON, "max-json-size", handler.DefaultBodyLimits.JSON, "largest api request body accepted, in bytes")
+	flag.Int64Var(&f.bodyLimits.Upload, "max-upload-size", handler.DefaultBodyLimits.Upload, "largest body of requests uploading photos accepted, in bytes")
+	flag.StringVar(&f.tlsCert, "tls-cert", "", "file with the tls certificate chain, reloaded when it changes")
+	flag.StringVar(&f.tlsKey, "tls-key", "", "file with the key of the tls certificate, reloaded when it changes")
+	flag.BoolVar(&f.selfSigned, "self-signed", false, "serve https with a certificate signed by a local CA kept in -tls-dir, for LAN use")
+	flag.StringVar(&f.tlsDir, "tls-dir", "tls", "directory the local CA and the self-signed certificate are kept in")
+	flag.Func("tls-host", "name or address the self-signed certificate is issued for, may be repeated (default localhost, the hostname and addresses of network interfaces)", func(s string) error {
+		f.tlsHosts = append(f.tlsHosts, s)
+		return nil
+	})
+	flag.DurationVar(&f.tlsReloadInterval, "tls-reload-interval", time.Minute, "interval of checking the tls certificate files for changes")
+	flag.StringVar(&f.httpRedirectAddr, "http-redirect-addr", "", "listen address of a plain http server redirecting to https, disabled when empty")
+	flag.DurationVar(&f.hstsMaxAge, "hsts-max-age", 180*24*time.Hour, "how long browsers only reach the server over https once they visited it, 0 disables HSTS")
+	flag.StringVar(&f.backupDir, "backup-dir", "backups", "directory scheduled backups are written to")
+	flag.Func("backup-at", "time of day of scheduled backups, HH:MM (default 03:00)", func(s string) error {
+		t, err := time.Parse("15:04", s)
+		if err != nil {
+			return err
+		}
+		f.backupAt = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		return nil
+	})
+	f.backupAt = 3 * time.Hour
+	flag.DurationVar(&f.backupInterval, "backup-interval", 24*time.Hour, "interval of scheduled backups, 0 disables them")
+	flag.DurationVar(&f.backupFullInterval, "backup-full-interval", 0, "interval of full backups, backups in between are incremental; 0 makes every backup full")
+	flag.StringVar(&f.backupPassphraseFile, "backup-passphrase-file", "", "file with the passphrase backups are encrypted with, "+backupPassphraseEnv+" is used when not set; backups are not encrypted without one")
+	flag.Func("backup-target", "off-site location backups are copied to, may be repeated: s3://bucket/prefix?endpoint=url&region=name, webdav+https://user@host/path or a directory path", func(s string) error {
+		t, err := parseBackupTarget(s)
+		if err != nil {
+			return err
+		}
+		f.backupTargets = append(f.backupTargets, t)
+		return nil
+	})
+	flag.DurationVar(&f.backupVerifyInterval, "backup-verify-interval", 24*time.Hour, "interval of verifying the newest backup, 0 disables it")
+	flag.BoolVar(&f.backupWalkStore, "backup-walk-store", false, "back up every file of the store directory instead of only the database and photos")
+	flag.Func("backup-include", "only back up files matching the glob, may be repeated; globs without a slash match names, others paths relative to the store directory", func(s string) error {
+		f.backupInclude = append(f.backupInclude, s)
+		return nil
+	})
+	// partially written photos are never worth backing up
+	f.backupExclude = []string{".tmp-*"}
+	flag.Func("backup-exclude", "skip files and directories matching the glob in backups, may be repeated, .tmp-* is always skipped", func(s string) error {
+		f.backupExclude = append(f.backupExclude, s)
+		return nil
+	})
+	flag.IntVar(&f.backupRetention.Daily, "backup-keep-daily", 7, "number of daily backups kept")
+	flag.IntVar(&f.backupRetention.Weekly, "backup-keep-weekly", 4, "number of weekly backups kept")
+	flag.IntVar(&f.backupRetention.Monthly, "backup-keep-monthly", 12, "number of monthly backups kept")
 
 	flag.Parse()
+	if f.selfSigned && len(f.tlsHosts) == 0 {
+		f.tlsHosts = tlscert.DefaultHosts()
+	}
+	if f.httpListenAddr == "" {
+		f.httpListenAddr = ":80"
+		if f.tlsEnabled() {
+			f.httpListenAddr = ":443"
+		}
+	}
 
 	return f
 }
 
-func setup(f flags) (func(), error) {
-	var callbacks []func()
+func (f flags) tlsEnabled() bool {
+	return f.selfSigned || f.tlsCert != ""
+}
 
-	if f.printToStdout {
-		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{})))
-	} else {
-		f, err := os.OpenFile("logs", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
-		if err != nil {
-			return nil, fmt.Errorf("could not open logs file: %w", err)
-		}
-		slog.SetDefault(slog.New(slog.NewJSONHandler(f, &slog.HandlerOptions{})))
-		callbacks = append(callbacks, func() { f.Close() })
+func (f flags) validateTLS() error {
+	switch {
+	case (f.tlsCert == "") != (f.tlsKey == ""):
+		return errors.New("-tls-cert and -tls-key have to be set together")
+	case f.selfSigned && f.tlsCert != "":
+		return errors.New("-self-signed can not be used with -tls-cert")
+	case f.httpRedirectAddr != "" && !f.tlsEnabled():
+		return errors.New("-http-redirect-addr requires tls")
+	case f.tlsEnabled() && f.tlsReloadInterval <= 0:
+		return errors.New("-tls-reload-interval has to be positive")
 	}
 
-	return func() {
-		for _, c := range callbacks {
-			c()
-		}
-	}, nil
+	return nil
 }
 
-func obsoleteCron(ctx context.Context) {
-	const jobHour = 3
-	ticker := time.NewTicker(time.Minute)
+// renewSelfSigned issues the self-signed certificate again once a day when
+// it is about to expire, the reloader then picks it up.
+func renewSelfSigned(ctx context.Context, f flags) {
+	ticker := time.NewTicker(24 * time.Hour)
 	defer ticker.Stop()
 
-	now := time.Now()
-	nextBackup := time.Date(now.Year(), now.Month(), now.Day(), jobHour, 0, 0, 0, time.UTC)
-	if now.After(nextBackup) {
-		nextBackup = nextBackup.Add(24 * time.Hour)
-	}
-
 	for {
 		select {
 		case <-ctx.Done():
-			// logger.Info().Msg("stopping cron")
 			return
 		case <-ticker.C:
-			now := time.Now()
-			if now.Before(nextBackup) {
-				continue
-			}
+		}
 
-			filename := fmt.Sprintf("acc-backup-%s.zip", now.Format("2006-01-02_15:04:05"))
-			// logger.Info().Msgf("starting backup job, filename %s", filename)
+		_, _, err := tlscert.SelfSigned(f.tlsDir, f.tlsHosts, time.Now())
+		if err != nil {
+			slog.Error("could not renew self-signed certificate", "error", err)
+		}
+	}
+}
 
-			f, err := os.Create(filename)
-			if err != nil {
-				// logger.Error().Err(err).Msg("could not create new backup file")
-				continue
-			}
+func (f *flags) registerStoreFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.storeDir, "store", ".", "imagestore directory")
+	// backups read photos from the -store directory, photos of the s3
+	// backend are left to the versioning or replication of the bucket
+	fs.StringVar(&f.storeBackend, "store-backend", "fs", "imagestore backend, one of: fs, s3; backups do not include photos kept in s3")
+	fs.StringVar(&f.s3Endpoint, "s3-endpoint", "", "S3-compatible endpoint url used by the s3 imagestore backend")
+	fs.StringVar(&f.s3Region, "s3-region", "us-east-1", "S3 region used by the s3 imagestore backend")
+	fs.StringVar(&f.s3Bucket, "s3-bucket", "", "S3 bucket used by the s3 imagestore backend")
+	fs.StringVar(&f.storeKeyFile, "store-key-file", "", "file with the key photos are encrypted with, "+storeKeyEnv+" is used when not set")
+	fs.BoolVar(&f.storeAllowPlain, "store-allow-plain", false, "read photos stored before encryption was enabled as they are, until rotate-key encrypts them")
+}
 
-			err = backup.Backup(f, ".")
-			if err != nil {
-				// logger.Error().Err(err).Msg("could not execute backup")
-				f.Close()
-				os.Remove(filename)
-				continue
+// backupPassphraseEnv holds the backup passphrase when no passphrase file
+// is given
+const backupPassphraseEnv = "ACC2_BACKUP_PASSPHRASE"
+
+// webDAVPasswordEnv holds the password of webdav backup targets
+const webDAVPasswordEnv = "ACC2_WEBDAV_PASSWORD"
+
+// parseBackupTarget opens the backup target described by raw. Credentials
+// of s3 targets are taken from the AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY environment variables, passwords of webdav targets
+// from ACC2_WEBDAV_PASSWORD.
+func parseBackupTarget(raw string) (backup.Target, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" || u.Scheme == "file" {
+		if u != nil && u.Scheme == "file" {
+			raw = u.Path
+		}
+		return backup.NewDirTarget(raw), nil
+	}
+
+	switch u.Scheme {
+	case "s3":
+		region := u.Query().Get("region")
+		if region == "" {
+			region = "us-east-1"
+		}
+		prefix := strings.TrimPrefix(u.Path, "/")
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return backup.NewS3Target(s3.Config{
+			Endpoint:  u.Query().Get("endpoint"),
+			Region:    region,
+			Bucket:    u.Host,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}, prefix)
+	case "webdav+http", "webdav+https":
+		cfg := backup.WebDAVConfig{Password: os.Getenv(webDAVPasswordEnv)}
+		if u.User != nil {
+			cfg.Username = u.User.Username()
+			if pass, ok := u.User.Password(); ok {
+				cfg.Password = pass
 			}
-			f.Close()
+			u.User = nil
+		}
+		u.Scheme = strings.TrimPrefix(u.Scheme, "webdav+")
+		cfg.URL = u.String()
+		return backup.NewWebDAVTarget(cfg)
+	default:
+		return nil, fmt.Errorf("unknown backup target scheme '%s'", u.Scheme)
+	}
+}
+
+// storeKeyEnv holds the imagestore encryption key when no key file is given
+const storeKeyEnv = "ACC2_STORE_KEY"
+
+// openImagestoreBackend opens the imagestore backend selected by flags,
+// encrypting it when a key is configured.
+func openImagestoreBackend(f flags) (imagestore.Backend, error) {
+	backend, err := openRawImagestoreBackend(f)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := loadKey(f.storeKeyFile, storeKeyEnv)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return backend, nil
+	}
+	if f.storeAllowPlain {
+		return imagestore.NewMigratingBackend(backend, key)
+	}
+
+	return imagestore.NewEncryptedBackend(backend, key)
+}
+
+// openRawImagestoreBackend opens the imagestore backend selected by flags.
+// Credentials of the s3 backend are taken from the AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY environment variables.
+func openRawImagestoreBackend(f flags) (imagestore.Backend, error) {
+	switch f.storeBackend {
+	case "fs":
+		return imagestore.NewFilesystemBackend(f.storeDir)
+	case "s3":
+		return imagestore.NewS3Backend(s3.Config{
+			Endpoint:  f.s3Endpoint,
+			Region:    f.s3Region,
+			Bucket:    f.s3Bucket,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		})
+	default:
+		return nil, fmt.Errorf("unknown imagestore backend '%s'", f.storeBackend)
+	}
+}
+
+// loadKey reads an encryption key from file, or from the env variable when
+// file is empty. It returns nil when neither is set. Raw keys are binary
+// and may end in a newline byte, so the key is parsed untrimmed.
+func loadKey(file, env string) ([]byte, error) {
+	raw, err := readSecret(file, env)
+	if err != nil || raw == nil {
+		return nil, err
+	}
+
+	key, err := imagestore.ParseKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+
+	return key, nil
+}
+
+// loadSecret reads a secret from file, or from the env variable when file
+// is empty, without a trailing newline. It returns nil when neither is set.
+func loadSecret(file, env string) ([]byte, error) {
+	raw, err := readSecret(file, env)
+	if err != nil || raw == nil {
+		return nil, err
+	}
 
-			// logger.Info().Msg("backup job successfully finished")
+	raw = bytes.TrimRight(raw, "\r\n")
+	if len(raw) == 0 {
+		if file == "" {
+			return nil, fmt.Errorf("environment variable %s is empty", env)
+		}
+		return nil, fmt.Errorf("secret file '%s' is empty", file)
+	}
 
-			nextBackup = nextBackup.Add(24 * time.Hour)
+	return raw, nil
+}
+
+// readSecret reads file, or the env variable when file is empty, as it is.
+// It returns nil when neither is set.
+func readSecret(file, env string) ([]byte, error) {
+	if file != "" {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read secret file: %w", err)
 		}
+		return raw, nil
 	}
+	if v := os.Getenv(env); v != "" {
+		return []byte(v), nil
+	}
+
+	return nil, nil
+}
+
+// setup sets up the default logger and returns where request logs go.
+func setup(f flags) (io.Writer, func(), error) {
+	var (
+		callbacks []func()
+		logs      io.Writer
+	)
+
+	if f.printToStdout {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{})))
+		logs = zerolog.ConsoleWriter{Out: os.Stdout}
+	} else {
+		f, err := os.OpenFile("logs", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not open logs file: %w", err)
+		}
+		slog.SetDefault(slog.New(slog.NewJSONHandler(f, &slog.HandlerOptions{})))
+		logs = f
+		callbacks = append(callbacks, func() { f.Close() })
+	}
+
+	return logs, func() {
+		for _, c := range callbacks {
+			c()
+		}
+	}, nil
 }
@@ -15,6 +15,7 @@ type Expense struct {
 	amount      string
 	currency    string
 	createdAt   time.Time
+	createdBy   string
 }
 
 type ExpenseBuilder struct {
@@ -26,6 +27,9 @@ type ExpenseBuilder struct {
 	Amount      string
 	Currency    string
 	CreatedAt   time.Time
+	// name of the user who added the expense, empty for expenses added
+	// before users existed
+	CreatedBy string
 }
 
 func (eb ExpenseBuilder) Build() (Expense, error) {
@@ -66,6 +70,7 @@ func (eb ExpenseBuilder) Build() (Expense, error) {
 		amount:      eb.Amount,
 		currency:    eb.Currency,
 		createdAt:   eb.CreatedAt,
+		createdBy:   eb.CreatedBy,
 	}, nil
 }
 
@@ -83,7 +88,8 @@ func (e Expense) Equal(other Expense) bool {
 		e.Category() == other.Category() &&
 		e.Amount() == other.Amount() &&
 		e.Currency() == other.Currency() &&
-		e.CreatedAt().Equal(other.CreatedAt())
+		e.CreatedAt().Equal(other.CreatedAt()) &&
+		e.CreatedBy() == other.CreatedBy()
 }
 
 func (e Expense) ID() string {
@@ -113,3 +119,7 @@ func (e Expense) Currency() string {
 func (e Expense) CreatedAt() time.Time {
 	return e.createdAt
 }
+
+func (e Expense) CreatedBy() string {
+	return e.createdBy
+}
@@ -99,6 +99,7 @@ func TestExpenseBuilder(t *testing.T) {
 			Amount:      "2.22",
 			Currency:    "USD",
 			CreatedAt:   time.Now(),
+			CreatedBy:   "some user",
 		}
 		expense, err := eb.Build()
 		require.NoError(t, err)
@@ -109,6 +110,7 @@ func TestExpenseBuilder(t *testing.T) {
 		require.Equal(t, eb.Amount, expense.Amount())
 		require.Equal(t, eb.Currency, expense.Currency())
 		require.True(t, eb.CreatedAt.Equal(expense.CreatedAt()))
+		require.Equal(t, eb.CreatedBy, expense.CreatedBy())
 	})
 }
 
@@ -0,0 +1,47 @@
+package model
+
+import (
+	"slices"
+
+	"github.com/pkg/errors"
+)
+
+// Ledger holds its own expenses, payers and categories, shared by the
+// users who are its members.
+type Ledger struct {
+	ID   int64
+	Name string
+	// Role is the role of the user the ledger was listed for, empty when
+	// listed for no one
+	Role Role
+}
+
+// Role is what a member of a ledger may do in it.
+type Role string
+
+const (
+	// RoleViewer browses and exports expenses
+	RoleViewer Role = "viewer"
+	// RoleEditor also adds expenses and edits the ones they added
+	RoleEditor Role = "editor"
+	// RoleOwner also edits and deletes any expense and manages payers and
+	// categories
+	RoleOwner Role = "owner"
+)
+
+// roles are ordered from the least to the most privileged
+var roles = []Role{RoleViewer, RoleEditor, RoleOwner}
+
+// ParseRole returns the role named s.
+func ParseRole(s string) (Role, error) {
+	r := Role(s)
+	if !slices.Contains(roles, r) {
+		return "", errors.Errorf("invalid role '%s', expected one of %v", s, roles)
+	}
+	return r, nil
+}
+
+// Allows reports whether r may do everything required may.
+func (r Role) Allows(required Role) bool {
+	return slices.Index(roles, r) >= slices.Index(roles, required)
+}
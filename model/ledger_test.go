@@ -0,0 +1,30 @@
+package model_test
+
+import (
+	"testing"
+
+	"github.com/matmazurk/acc2/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRole(t *testing.T) {
+	t.Run("should_parse_roles", func(t *testing.T) {
+		for _, s := range []string{"viewer", "editor", "owner"} {
+			r, err := model.ParseRole(s)
+			require.NoError(t, err)
+			require.Equal(t, model.Role(s), r)
+		}
+
+		_, err := model.ParseRole("admin")
+		require.ErrorContains(t, err, "invalid role 'admin'")
+	})
+
+	t.Run("should_allow_less_privileged_roles", func(t *testing.T) {
+		require.True(t, model.RoleOwner.Allows(model.RoleEditor))
+		require.True(t, model.RoleEditor.Allows(model.RoleEditor))
+		require.True(t, model.RoleEditor.Allows(model.RoleViewer))
+		require.False(t, model.RoleViewer.Allows(model.RoleEditor))
+		require.False(t, model.RoleEditor.Allows(model.RoleOwner))
+		require.False(t, model.Role("").Allows(model.RoleViewer))
+	})
+}
@@ -0,0 +1,22 @@
+package model
+
+import (
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrPhotoCorrupted is returned by the imagestore for photos that do not
+// match the checksum recorded when they were saved
+var ErrPhotoCorrupted = errors.New("photo does not match its checksum")
+
+// Photo is an expense photo as loaded from the imagestore, together with
+// the metadata needed to serve it over http.
+type Photo struct {
+	io.ReadSeekCloser
+	// when empty, content type is sniffed while serving
+	ContentType string
+	ModTime     time.Time
+	ETag        string
+}
@@ -0,0 +1,28 @@
+package model
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNotFound is returned by persistence for missing records
+	ErrNotFound = errors.New("not found")
+	// ErrInUse is returned by persistence for records still referenced
+	// by expenses
+	ErrInUse = errors.New("in use")
+)
+
+// ExpenseQuery filters and pages expenses, zero fields do not filter.
+type ExpenseQuery struct {
+	Payer    string
+	Category string
+	// From and To limit the creation time to [From, To), they are compared
+	// as stored, so pass them in the location expenses are created in
+	From time.Time
+	To   time.Time
+	// Limit of zero returns all expenses
+	Limit  int
+	Offset int
+}
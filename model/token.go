@@ -0,0 +1,58 @@
+package model
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TokenScope is what an api token may do.
+type TokenScope string
+
+const (
+	// ScopeRead only reads
+	ScopeRead TokenScope = "read"
+	// ScopeWrite also changes data, as far as the role of the user allows
+	ScopeWrite TokenScope = "write"
+)
+
+// ParseTokenScope returns the scope named s.
+func ParseTokenScope(s string) (TokenScope, error) {
+	scope := TokenScope(s)
+	if scope != ScopeRead && scope != ScopeWrite {
+		return "", errors.Errorf("invalid scope '%s', expected read or write", s)
+	}
+	return scope, nil
+}
+
+// APIToken lets scripts use the api as its user without logging in. Only
+// the hash of the token is stored, like for sessions.
+type APIToken struct {
+	ID        int64
+	Name      string
+	Scope     TokenScope
+	TokenHash string
+	User      User
+	CreatedAt time.Time
+	// LastUsedAt is zero for tokens never used
+	LastUsedAt time.Time
+}
+
+// NewAPIToken validates name and returns a token of user with tokenHash.
+func NewAPIToken(user User, name string, scope TokenScope, tokenHash string) (APIToken, error) {
+	if name == "" || strings.ContainsAny(name, "\t\r\n/") {
+		return APIToken{}, errors.Errorf("invalid token name '%s'", name)
+	}
+	if _, err := ParseTokenScope(string(scope)); err != nil {
+		return APIToken{}, err
+	}
+
+	return APIToken{
+		Name:      name,
+		Scope:     scope,
+		TokenHash: tokenHash,
+		User:      user,
+		CreatedAt: time.Now(),
+	}, nil
+}
@@ -0,0 +1,32 @@
+package model_test
+
+import (
+	"testing"
+
+	"github.com/matmazurk/acc2/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAPIToken(t *testing.T) {
+	u := model.User{ID: 1, Name: "user"}
+
+	t.Run("should_create_token", func(t *testing.T) {
+		token, err := model.NewAPIToken(u, "phone shortcut", model.ScopeWrite, "hash")
+		require.NoError(t, err)
+		require.Equal(t, "phone shortcut", token.Name)
+		require.Equal(t, model.ScopeWrite, token.Scope)
+		require.Equal(t, "hash", token.TokenHash)
+		require.Equal(t, u, token.User)
+		require.False(t, token.CreatedAt.IsZero())
+		require.True(t, token.LastUsedAt.IsZero())
+	})
+
+	t.Run("should_reject_invalid_tokens", func(t *testing.T) {
+		_, err := model.NewAPIToken(u, "", model.ScopeRead, "hash")
+		require.ErrorContains(t, err, "invalid token name ''")
+		_, err = model.NewAPIToken(u, "a/b", model.ScopeRead, "hash")
+		require.ErrorContains(t, err, "invalid token name 'a/b'")
+		_, err = model.NewAPIToken(u, "script", model.TokenScope("admin"), "hash")
+		require.ErrorContains(t, err, "invalid scope 'admin'")
+	})
+}
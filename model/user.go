@@ -0,0 +1,66 @@
+package model
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MinPasswordLength is the length passwords of new users must have
+const MinPasswordLength = 10
+
+// User is an account able to log in.
+type User struct {
+	ID   int64
+	Name string
+	// PasswordHash is a bcrypt hash of the password
+	PasswordHash string
+	Admin        bool
+	CreatedAt    time.Time
+}
+
+// NewUser validates name and password and returns a user holding the hash
+// of password.
+func NewUser(name, password string, admin bool) (User, error) {
+	if name == "" || strings.ContainsAny(name, " \t\r\n/") {
+		return User{}, errors.Errorf("invalid user name '%s'", name)
+	}
+	if len(password) < MinPasswordLength {
+		return User{}, errors.Errorf("password must have at least %d characters", MinPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, errors.Wrap(err, "could not hash password")
+	}
+
+	return User{
+		Name:         name,
+		PasswordHash: string(hash),
+		Admin:        admin,
+		CreatedAt:    time.Now(),
+	}, nil
+}
+
+// CheckPassword reports whether password is the password of u.
+func (u User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// Session is a logged in user. Only the hash of the session token is
+// stored, so a leaked database does not leak sessions.
+type Session struct {
+	TokenHash string
+	User      User
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Payer pays for expenses, it may be linked to the user who logs in as
+// the payer.
+type Payer struct {
+	Name string
+	// User is the name of the linked user, empty when there is none
+	User string
+}
@@ -0,0 +1,59 @@
+package model_test
+
+import (
+	"testing"
+
+	"github.com/matmazurk/acc2/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewUser(t *testing.T) {
+	tcs := []struct {
+		name        string
+		userName    string
+		password    string
+		errContains string
+	}{
+		{
+			name:        "empty_name",
+			userName:    "",
+			password:    "long enough password",
+			errContains: "invalid user name ''",
+		},
+		{
+			name:        "name_with_space",
+			userName:    "some one",
+			password:    "long enough password",
+			errContains: "invalid user name 'some one'",
+		},
+		{
+			name:        "name_with_slash",
+			userName:    "some/one",
+			password:    "long enough password",
+			errContains: "invalid user name 'some/one'",
+		},
+		{
+			name:        "short_password",
+			userName:    "someone",
+			password:    "short",
+			errContains: "password must have at least 10 characters",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := model.NewUser(tc.userName, tc.password, false)
+			require.ErrorContains(t, err, tc.errContains)
+		})
+	}
+
+	t.Run("should_hash_password", func(t *testing.T) {
+		u, err := model.NewUser("someone", "long enough password", true)
+		require.NoError(t, err)
+		require.Equal(t, "someone", u.Name)
+		require.True(t, u.Admin)
+		require.NotContains(t, u.PasswordHash, "long enough password")
+		require.True(t, u.CheckPassword("long enough password"))
+		require.False(t, u.CheckPassword("other password"))
+	})
+}
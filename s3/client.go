@@ -0,0 +1,350 @@
+// Package s3 is a minimal client for S3-compatible object storage using
+// path-style requests and signature version 4.
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MinPartSize is the smallest part size S3 accepts for multipart uploads
+	MinPartSize     = 5 << 20
+	defaultPartSize = 8 << 20
+	defaultTimeout  = 5 * time.Minute
+)
+
+type Config struct {
+	// base url of the service, e.g. https://s3.eu-central-1.amazonaws.com
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// objects bigger than PartSize are sent with multipart upload,
+	// defaults to 8MiB
+	PartSize   int64
+	HTTPClient *http.Client
+}
+
+type Client struct {
+	endpoint   *url.URL
+	region     string
+	bucket     string
+	accessKey  string
+	secretKey  string
+	partSize   int64
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ETag         string
+}
+
+// Error is returned for non successful responses. Errors with status 404
+// match fs.ErrNotExist.
+type Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("s3: status %d: %s %s", e.StatusCode, e.Code, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	return target == fs.ErrNotExist && e.StatusCode == http.StatusNotFound
+}
+
+func New(cfg Config) (*Client, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("endpoint cannot be empty")
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("bucket cannot be empty")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = defaultPartSize
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: defaultTimeout}
+	}
+
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid endpoint '%s'", cfg.Endpoint)
+	}
+
+	return &Client{
+		endpoint:   endpoint,
+		region:     cfg.Region,
+		bucket:     cfg.Bucket,
+		accessKey:  cfg.AccessKey,
+		secretKey:  cfg.SecretKey,
+		partSize:   cfg.PartSize,
+		httpClient: cfg.HTTPClient,
+		now:        time.Now,
+	}, nil
+}
+
+// PutObject uploads r under key. Contents bigger than the configured part
+// size are uploaded in parts, so memory use is bounded by the part size.
+func (c *Client) PutObject(key string, r io.Reader) error {
+	first, err := readPart(r, c.partSize)
+	if err != nil {
+		return errors.Wrap(err, "could not read object contents")
+	}
+	if int64(len(first)) < c.partSize {
+		resp, err := c.do("PUT", key, nil, first)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	return c.multipartUpload(key, first, r)
+}
+
+func (c *Client) multipartUpload(key string, first []byte, r io.Reader) error {
+	resp, err := c.do("POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not create multipart upload")
+	}
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = decodeXML(resp, &created)
+	if err != nil {
+		return errors.Wrap(err, "could not decode multipart upload")
+	}
+
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []part
+	abort := func(err error) error {
+		resp, abortErr := c.do("DELETE", key, url.Values{"uploadId": {created.UploadID}}, nil)
+		if abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	data := first
+	for number := 1; len(data) > 0; number++ {
+		resp, err := c.do("PUT", key, url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {created.UploadID},
+		}, data)
+		if err != nil {
+			return abort(errors.Wrapf(err, "could not upload part %d", number))
+		}
+		resp.Body.Close()
+		parts = append(parts, part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+		data, err = readPart(r, c.partSize)
+		if err != nil {
+			return abort(errors.Wrap(err, "could not read object contents"))
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return abort(err)
+	}
+	resp, err = c.do("POST", key, url.Values{"uploadId": {created.UploadID}}, body)
+	if err != nil {
+		return abort(errors.Wrap(err, "could not complete multipart upload"))
+	}
+	// errors of complete requests may come with status 200
+	var completed struct {
+		XMLName xml.Name
+		Error
+	}
+	err = decodeXML(resp, &completed)
+	if err != nil {
+		return abort(errors.Wrap(err, "could not decode complete multipart upload"))
+	}
+	if completed.XMLName.Local == "Error" {
+		completed.Error.StatusCode = http.StatusOK
+		return abort(&completed.Error)
+	}
+
+	return nil
+}
+
+func (c *Client) GetObject(key string) (io.ReadCloser, ObjectInfo, error) {
+	resp, err := c.do("GET", key, nil, nil)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	return resp.Body, objectInfo(key, resp), nil
+}
+
+// GetObjectRange returns the contents of the object from offset on.
+func (c *Client) GetObjectRange(key string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{"Range": {"bytes=" + strconv.FormatInt(offset, 10) + "-"}}
+	resp, err := c.send("GET", key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (c *Client) HeadObject(key string) (ObjectInfo, error) {
+	resp, err := c.do("HEAD", key, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+
+	return objectInfo(key, resp), nil
+}
+
+func (c *Client) DeleteObject(key string) error {
+	resp, err := c.do("DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// ListObjects returns all objects with keys starting with prefix.
+func (c *Client) ListObjects(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := c.do("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+				ETag         string    `xml:"ETag"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = decodeXML(resp, &result)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not decode objects list")
+		}
+
+		for _, o := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          o.Key,
+				Size:         o.Size,
+				LastModified: o.LastModified,
+				ETag:         o.ETag,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// do sends a signed request for key (or the bucket itself when key is
+// empty), returning an *Error for non 2xx responses.
+func (c *Client) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	return c.send(method, key, query, nil, body)
+}
+
+// send is do with extra headers, which are signed along.
+func (c *Client) send(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = u.Path + "/" + c.bucket + "/" + key
+	u.RawPath = c.endpoint.EscapedPath() + "/" + uriEncode(c.bucket, true) + "/" + uriEncode(key, false)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create request")
+	}
+	req.ContentLength = int64(len(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	sign(req, c.accessKey, c.secretKey, c.region, hashHex(body), c.now())
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s request failed", method)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	s3Err := &Error{StatusCode: resp.StatusCode}
+	contents, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(contents, s3Err)
+	return nil, s3Err
+}
+
+func objectInfo(key string, resp *http.Response) ObjectInfo {
+	info := ObjectInfo{
+		Key:          key,
+		Size:         resp.ContentLength,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: time.Now(),
+	}
+	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err == nil {
+		info.LastModified = lastModified
+	}
+	return info
+}
+
+func readPart(r io.Reader, size int64) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	_, err := io.CopyN(buf, r, size)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeXML(resp *http.Response, v any) error {
+	defer resp.Body.Close()
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,84 @@
+package s3_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/matmazurk/acc2/s3"
+	"github.com/matmazurk/acc2/s3/s3test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	srv := s3test.NewServer("bucket")
+	t.Cleanup(srv.Close)
+
+	c, err := s3.New(s3.Config{
+		Endpoint:  srv.URL,
+		Bucket:    "bucket",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PartSize:  16,
+	})
+	require.NoError(t, err)
+
+	t.Run("should_put_and_get_small_object", func(t *testing.T) {
+		contents := []byte("small")
+		require.NoError(t, c.PutObject("photos/small file.jpeg", bytes.NewReader(contents)))
+
+		r, info, err := c.GetObject("photos/small file.jpeg")
+		require.NoError(t, err)
+		defer r.Close()
+		actual, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, contents, actual)
+		require.Equal(t, int64(len(contents)), info.Size)
+		require.Zero(t, srv.Uploads())
+	})
+
+	t.Run("should_get_object_from_offset", func(t *testing.T) {
+		r, err := c.GetObjectRange("photos/small file.jpeg", 2)
+		require.NoError(t, err)
+		defer r.Close()
+		actual, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, []byte("all"), actual)
+	})
+
+	t.Run("should_use_multipart_upload_for_big_objects", func(t *testing.T) {
+		contents := bytes.Repeat([]byte("0123456789"), 5)
+		require.NoError(t, c.PutObject("photos/big.jpeg", bytes.NewReader(contents)))
+
+		o, ok := srv.Object("photos/big.jpeg")
+		require.True(t, ok)
+		require.Equal(t, contents, o.Data)
+		require.Equal(t, 1, srv.Uploads())
+
+		info, err := c.HeadObject("photos/big.jpeg")
+		require.NoError(t, err)
+		require.Equal(t, int64(len(contents)), info.Size)
+	})
+
+	t.Run("should_list_objects_across_pages", func(t *testing.T) {
+		srv.MaxKeys = 1
+		t.Cleanup(func() { srv.MaxKeys = 1000 })
+		require.NoError(t, c.PutObject("other/file", bytes.NewReader([]byte("x"))))
+
+		objects, err := c.ListObjects("photos/")
+		require.NoError(t, err)
+		require.Len(t, objects, 2)
+		require.Equal(t, "photos/big.jpeg", objects[0].Key)
+		require.Equal(t, "photos/small file.jpeg", objects[1].Key)
+	})
+
+	t.Run("should_return_not_exist_for_missing_objects", func(t *testing.T) {
+		require.NoError(t, c.DeleteObject("photos/big.jpeg"))
+
+		_, _, err := c.GetObject("photos/big.jpeg")
+		require.ErrorIs(t, err, os.ErrNotExist)
+		_, err = c.HeadObject("photos/big.jpeg")
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
@@ -0,0 +1,255 @@
+// Package s3test provides an in-memory fake of the subset of the S3 API
+// used by the s3 package, for use in tests.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Object struct {
+	Data         []byte
+	LastModified time.Time
+}
+
+type Server struct {
+	*httptest.Server
+	Bucket string
+	// MaxKeys limits the size of a single list page, defaults to 1000
+	MaxKeys int
+
+	mu         sync.Mutex
+	objects    map[string]Object
+	uploads    map[string]map[int][]byte
+	nextUpload int
+	gets       int
+}
+
+// NewServer starts a fake serving bucket. It rejects unsigned requests
+// and requests whose payload does not match x-amz-content-sha256.
+func NewServer(bucket string) *Server {
+	s := &Server{
+		Bucket:  bucket,
+		MaxKeys: 1000,
+		objects: map[string]Object{},
+		uploads: map[string]map[int][]byte{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *Server) Object(key string) (Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.objects[key]
+	return o, ok
+}
+
+func (s *Server) PutObject(key string, data []byte, lastModified time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = Object{Data: data, LastModified: lastModified}
+}
+
+// Gets returns the number of GET requests of objects served so far.
+func (s *Server) Gets() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gets
+}
+
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.objects))
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Uploads returns the number of started multipart uploads
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextUpload
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") {
+		writeError(w, http.StatusForbidden, "AccessDenied", "missing signature")
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	sum := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		writeError(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "payload hash mismatch")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.Bucket {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", bucket)
+		return
+	}
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == "GET" && key == "":
+		s.list(w, query.Get("prefix"), query.Get("continuation-token"))
+	case r.Method == "POST" && query.Has("uploads"):
+		s.nextUpload++
+		id := strconv.Itoa(s.nextUpload)
+		s.uploads[id] = map[int][]byte{}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			UploadID string   `xml:"UploadId"`
+		}{UploadID: id})
+	case r.Method == "PUT" && query.Has("uploadId"):
+		parts, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload", "")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[number] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == "POST" && query.Has("uploadId"):
+		s.complete(w, key, query.Get("uploadId"), body)
+	case r.Method == "DELETE" && query.Has("uploadId"):
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PUT":
+		s.objects[key] = Object{Data: body, LastModified: time.Now()}
+		w.Header().Set("ETag", etag(body))
+	case r.Method == "GET" || r.Method == "HEAD":
+		o, ok := s.objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", key)
+			return
+		}
+		if r.Method == "GET" {
+			s.gets++
+		}
+		// serves ranges and leaves the body out for HEAD requests
+		w.Header().Set("ETag", etag(o.Data))
+		http.ServeContent(w, r, "", o.LastModified, bytes.NewReader(o.Data))
+	case r.Method == "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, prefix, token string) {
+	type content struct {
+		Key          string `xml:"Key"`
+		Size         int    `xml:"Size"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+	}
+	result := struct {
+		XMLName               xml.Name  `xml:"ListBucketResult"`
+		Contents              []content `xml:"Contents"`
+		IsTruncated           bool      `xml:"IsTruncated"`
+		NextContinuationToken string    `xml:"NextContinuationToken,omitempty"`
+	}{}
+
+	keys := make([]string, 0, len(s.objects))
+	for k := range s.objects {
+		if strings.HasPrefix(k, prefix) && k > token {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > s.MaxKeys {
+		keys = keys[:s.MaxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, k := range keys {
+		o := s.objects[k]
+		result.Contents = append(result.Contents, content{
+			Key:          k,
+			Size:         len(o.Data),
+			LastModified: o.LastModified.UTC().Format(time.RFC3339),
+			ETag:         etag(o.Data),
+		})
+	}
+	writeXML(w, result)
+}
+
+func (s *Server) complete(w http.ResponseWriter, key, uploadID string, body []byte) {
+	parts, ok := s.uploads[uploadID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", uploadID)
+		return
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	err := xml.Unmarshal(body, &req)
+	if err != nil || len(req.Parts) == 0 {
+		writeError(w, http.StatusBadRequest, "MalformedXML", "")
+		return
+	}
+
+	var data []byte
+	for i, p := range req.Parts {
+		part, ok := parts[p.PartNumber]
+		if !ok || p.PartNumber != i+1 || p.ETag != etag(part) {
+			writeError(w, http.StatusBadRequest, "InvalidPart", strconv.Itoa(p.PartNumber))
+			return
+		}
+		data = append(data, part...)
+	}
+	delete(s.uploads, uploadID)
+	s.objects[key] = Object{Data: data, LastModified: time.Now()}
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Key     string   `xml:"Key"`
+	}{Key: key})
+}
+
+func etag(data []byte) string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(data))
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: message})
+}
@@ -0,0 +1,126 @@
+package tlscert
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type loaded struct {
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// Reloader serves the certificate and key pair of CertFile and KeyFile and
+// reloads it once either file changes, so renewed certificates are picked
+// up without restarting the server.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	logger   *slog.Logger
+
+	mu   *sync.RWMutex
+	last *loaded
+}
+
+// NewReloader loads the certificate and key pair, failing when it can not
+// be used.
+func NewReloader(certFile, keyFile string, logger *slog.Logger) (Reloader, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	r := Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+		mu:       &sync.RWMutex{},
+		last:     &loaded{},
+	}
+	_, err := r.Reload()
+	if err != nil {
+		return Reloader{}, err
+	}
+
+	return r, nil
+}
+
+// GetCertificate returns the last certificate loaded, it is meant for
+// tls.Config.GetCertificate.
+func (r Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.last.cert, nil
+}
+
+// Reload loads the pair again when either file changed since the last load
+// and reports whether it did. The previous pair is kept when the new one is
+// invalid, e.g. when only one of the files has been replaced yet.
+func (r Reloader) Reload() (bool, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false, errors.Wrap(err, "could not stat certificate")
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false, errors.Wrap(err, "could not stat key")
+	}
+
+	r.mu.RLock()
+	unchanged := r.last.cert != nil &&
+		certInfo.ModTime().Equal(r.last.certMod) &&
+		keyInfo.ModTime().Equal(r.last.keyMod)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, errors.Wrap(err, "could not load certificate")
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false, errors.Wrap(err, "could not parse certificate")
+	}
+
+	r.mu.Lock()
+	*r.last = loaded{cert: &cert, certMod: certInfo.ModTime(), keyMod: keyInfo.ModTime()}
+	r.mu.Unlock()
+
+	return true, nil
+}
+
+// Run checks the files for changes every interval until ctx is done.
+func (r Reloader) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			r.logger.Info("stopping tls certificate reloader")
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := r.Reload()
+		if err != nil {
+			r.logger.Error("could not reload tls certificate", "error", err)
+			continue
+		}
+		if reloaded {
+			r.mu.RLock()
+			leaf := r.last.cert.Leaf
+			r.mu.RUnlock()
+			r.logger.Info("tls certificate reloaded", slog.String("subject", leaf.Subject.String()), slog.Time("not_after", leaf.NotAfter))
+		}
+	}
+}
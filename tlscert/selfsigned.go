@@ -0,0 +1,235 @@
+package tlscert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CAFile is the name of the local authority certificate devices have to
+// trust to accept self-signed server certificates
+const CAFile = "ca.pem"
+
+const (
+	caKey    = "ca-key.pem"
+	certFile = "cert.pem"
+	keyFile  = "key.pem"
+
+	caValidity     = 10 * 365 * 24 * time.Hour
+	serverValidity = 365 * 24 * time.Hour
+	// server certificates are renewed this long before they expire
+	renewBefore = 30 * 24 * time.Hour
+)
+
+// SelfSigned keeps a local certificate authority in dir together with a
+// server certificate it signed for hosts, and returns the paths of the
+// server certificate and key. The authority is created once and reused, so
+// devices only need to trust dir/ca.pem a single time. The server
+// certificate is issued again when it is missing, about to expire or does
+// not cover all hosts.
+func SelfSigned(dir string, hosts []string, now time.Time) (string, string, error) {
+	certPath, keyPath := filepath.Join(dir, certFile), filepath.Join(dir, keyFile)
+	if len(hosts) == 0 {
+		return "", "", errors.New("no hosts to issue certificate for")
+	}
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return "", "", errors.Wrap(err, "could not create tls directory")
+	}
+
+	ca, caSigner, err := loadCA(dir, now)
+	if err != nil {
+		return "", "", err
+	}
+	if serverCertValid(certPath, keyPath, ca, hosts, now) {
+		return certPath, keyPath, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", errors.Wrap(err, "could not generate server key")
+	}
+	template, err := newTemplate(hosts[0], now, serverValidity)
+	if err != nil {
+		return "", "", err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caSigner)
+	if err != nil {
+		return "", "", errors.Wrap(err, "could not create server certificate")
+	}
+
+	err = writePair(certPath, keyPath, der, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	return certPath, keyPath, nil
+}
+
+// loadCA loads the authority of dir, creating it when there is none yet.
+// A broken authority is reported rather than replaced, as devices may
+// already trust it.
+func loadCA(dir string, now time.Time) (*x509.Certificate, crypto.Signer, error) {
+	caPath, caKeyPath := filepath.Join(dir, CAFile), filepath.Join(dir, caKey)
+	pair, err := tls.LoadX509KeyPair(caPath, caKeyPath)
+	if err == nil {
+		ca, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "could not parse ca certificate")
+		}
+		signer, ok := pair.PrivateKey.(crypto.Signer)
+		if !ok {
+			return nil, nil, errors.New("ca key can not sign")
+		}
+		return ca, signer, nil
+	}
+	_, certErr := os.Stat(caPath)
+	_, keyErr := os.Stat(caKeyPath)
+	if !os.IsNotExist(certErr) || !os.IsNotExist(keyErr) {
+		return nil, nil, errors.Wrap(err, "could not load ca")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not generate ca key")
+	}
+	template, err := newTemplate("acc2 local CA", now, caValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not create ca certificate")
+	}
+	err = writePair(caPath, caKeyPath, der, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not parse ca certificate")
+	}
+
+	return ca, key, nil
+}
+
+func serverCertValid(certPath, keyPath string, ca *x509.Certificate, hosts []string, now time.Time) bool {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return false
+	}
+	if now.Add(renewBefore).After(cert.NotAfter) || cert.CheckSignatureFrom(ca) != nil {
+		return false
+	}
+
+	return !slices.ContainsFunc(hosts, func(h string) bool { return cert.VerifyHostname(h) != nil })
+}
+
+func newTemplate(commonName string, now time.Time, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not generate serial number")
+	}
+
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"acc2"}},
+		// tolerate clocks of devices being a bit behind
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(validity),
+	}, nil
+}
+
+// writePair writes the key before the certificate, each file replaced at
+// once, so a reloader never reads a partially written file.
+func writePair(certPath, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal key")
+	}
+	err = writeFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
+
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path)+"-*")
+	if err != nil {
+		return errors.Wrapf(err, "could not create '%s'", path)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not write '%s'", path)
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// DefaultHosts lists the names and addresses the server is likely reached
+// at: localhost, the hostname and the addresses of network interfaces.
+func DefaultHosts() []string {
+	hosts := []string{"localhost"}
+	if name, err := os.Hostname(); err == nil && name != "" {
+		hosts = append(hosts, name)
+		// mDNS name of machines without a domain
+		if !strings.Contains(name, ".") {
+			hosts = append(hosts, name+".local")
+		}
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return append(hosts, "127.0.0.1", "::1")
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		hosts = append(hosts, ipNet.IP.String())
+	}
+
+	return hosts
+}
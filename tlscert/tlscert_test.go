@@ -0,0 +1,128 @@
+package tlscert_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matmazurk/acc2/tlscert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	hosts := []string{"acc2.local", "192.168.1.10"}
+
+	certPath, keyPath, err := tlscert.SelfSigned(dir, hosts, now)
+	require.NoError(t, err)
+	ca := readCert(t, filepath.Join(dir, tlscert.CAFile))
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	t.Run("should_issue_certificate_trusted_through_ca", func(t *testing.T) {
+		_, err := tls.LoadX509KeyPair(certPath, keyPath)
+		require.NoError(t, err)
+		cert := readCert(t, certPath)
+		for _, h := range hosts {
+			_, err := cert.Verify(x509.VerifyOptions{DNSName: h, Roots: roots})
+			require.NoError(t, err, h)
+		}
+		_, err = cert.Verify(x509.VerifyOptions{DNSName: "other.local", Roots: roots})
+		require.Error(t, err)
+
+		info, err := os.Stat(keyPath)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	})
+
+	t.Run("should_keep_valid_certificate", func(t *testing.T) {
+		before := readCert(t, certPath)
+		_, _, err := tlscert.SelfSigned(dir, hosts, now.Add(24*time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, before.SerialNumber, readCert(t, certPath).SerialNumber)
+	})
+
+	t.Run("should_reissue_certificate_for_new_hosts_with_same_ca", func(t *testing.T) {
+		_, _, err := tlscert.SelfSigned(dir, append(hosts, "acc2.lan"), now)
+		require.NoError(t, err)
+
+		require.Equal(t, ca.SerialNumber, readCert(t, filepath.Join(dir, tlscert.CAFile)).SerialNumber)
+		_, err = readCert(t, certPath).Verify(x509.VerifyOptions{DNSName: "acc2.lan", Roots: roots})
+		require.NoError(t, err)
+	})
+
+	t.Run("should_renew_certificate_before_expiry", func(t *testing.T) {
+		before := readCert(t, certPath)
+		_, _, err := tlscert.SelfSigned(dir, hosts, before.NotAfter.Add(-24*time.Hour))
+		require.NoError(t, err)
+		require.True(t, readCert(t, certPath).NotAfter.After(before.NotAfter))
+	})
+
+	t.Run("should_not_replace_broken_ca", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, tlscert.CAFile), []byte("broken"), 0o644))
+		_, _, err := tlscert.SelfSigned(dir, hosts, now)
+		require.ErrorContains(t, err, "could not load ca")
+	})
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath, err := tlscert.SelfSigned(dir, []string{"acc2.local"}, time.Now())
+	require.NoError(t, err)
+
+	r, err := tlscert.NewReloader(certPath, keyPath, nil)
+	require.NoError(t, err)
+	served := func() *x509.Certificate {
+		cert, err := r.GetCertificate(nil)
+		require.NoError(t, err)
+		return cert.Leaf
+	}
+	first := served()
+
+	t.Run("should_not_reload_unchanged_files", func(t *testing.T) {
+		reloaded, err := r.Reload()
+		require.NoError(t, err)
+		require.False(t, reloaded)
+	})
+
+	t.Run("should_reload_changed_files", func(t *testing.T) {
+		_, _, err := tlscert.SelfSigned(dir, []string{"acc2.local", "acc2.lan"}, time.Now())
+		require.NoError(t, err)
+
+		reloaded, err := r.Reload()
+		require.NoError(t, err)
+		require.True(t, reloaded)
+		require.NotEqual(t, first.SerialNumber, served().SerialNumber)
+		require.Contains(t, served().DNSNames, "acc2.lan")
+	})
+
+	t.Run("should_keep_last_certificate_when_files_are_invalid", func(t *testing.T) {
+		last := served()
+		require.NoError(t, os.WriteFile(certPath, []byte("half written"), 0o644))
+
+		_, err := r.Reload()
+		require.Error(t, err)
+		require.Equal(t, last.SerialNumber, served().SerialNumber)
+	})
+
+	t.Run("should_fail_without_valid_pair", func(t *testing.T) {
+		_, err := tlscert.NewReloader(certPath, keyPath, nil)
+		require.Error(t, err)
+	})
+}
+
+func readCert(t *testing.T, path string) *x509.Certificate {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	block, _ := pem.Decode(raw)
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return cert
+}